@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultReplayMaxTurns = 10
+	maxBulkUsers          = 1000
+)
+
+// adminOnly guards operator endpoints behind ADMIN_TOKEN, presented as a
+// bearer token.
+func (s *Server) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimSpace(r.Header.Get("Authorization"))
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+			auth = strings.TrimSpace(auth[7:])
+		}
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(s.adminToken)) != 1 {
+			writeOpenAIErrorCode(w, http.StatusUnauthorized, "invalid admin token", "unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// cacheEntryID is the opaque handle the admin API uses for a cache key, so
+// user keys (which are client credentials) are never echoed back.
+func cacheEntryID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// handleAdminCache lists the conversations currently resident in memory.
+func (s *Server) handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	entries := s.store.CacheEntries()
+	data := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		data = append(data, map[string]interface{}{
+			"id":              cacheEntryID(entry.Key),
+			"user":            maskIdentifier(entry.UserKey),
+			"conversation_id": entry.ConversationID,
+			"messages":        entry.Messages,
+			"bytes":           entry.Bytes,
+			"in_use":          entry.InUse,
+			"dirty":           entry.Dirty,
+			"last_active":     entry.LastActive.Unix(),
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// handleAdminCacheEvict persists and evicts one cached conversation by id, or
+// every cached conversation when "all" is set.
+func (s *Server) handleAdminCacheEvict(w http.ResponseWriter, r *http.Request) {
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	id, _ := body["id"].(string)
+	all, _ := body["all"].(bool)
+	if id == "" && !all {
+		writeOpenAIError(w, http.StatusBadRequest, "id or all is required")
+		return
+	}
+
+	var evicted, skipped []string
+	if all {
+		evicted, skipped = s.store.Evict()
+	} else {
+		var keys []string
+		for _, entry := range s.store.CacheEntries() {
+			if cacheEntryID(entry.Key) == id {
+				keys = append(keys, entry.Key)
+			}
+		}
+		if len(keys) == 0 {
+			writeOpenAIErrorCode(w, http.StatusNotFound, "cache entry not found", "not_found")
+			return
+		}
+		evicted, skipped = s.store.Evict(keys...)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"evicted": cacheEntryIDs(evicted),
+		"skipped": cacheEntryIDs(skipped),
+	})
+}
+
+func cacheEntryIDs(keys []string) []string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, cacheEntryID(key))
+	}
+	return ids
+}
+
+// handleAdminReplay re-sends a stored conversation's user turns, in order, to
+// the upstream on a fresh internal conversation and reports each replayed
+// answer next to the stored one. At most replayMaxTurns turns are replayed.
+// History holds the user's own messages, so each turn's query is rebuilt
+// with the persisted system prompt, prompt templates and query template as
+// the original request built it; no summary applies, since the replay
+// carries the full history from the first turn.
+func (s *Server) handleAdminReplay(w http.ResponseWriter, r *http.Request) {
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	userKey, _ := body["user_key"].(string)
+	conversationID, _ := body["conversation_id"].(string)
+	_, owner, conversationID := s.store.conversationKey(userKey, conversationID)
+	if userKey == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "user_key is required")
+		return
+	}
+	maxTurns := s.replayMaxTurns
+	if n, ok := body["max_turns"].(float64); ok && n > 0 && int(n) < maxTurns {
+		maxTurns = int(n)
+	}
+
+	history, systemPrompt, found, err := s.store.Transcript(r.Context(), userKey, conversationID)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+	if !found {
+		writeOpenAIError(w, http.StatusNotFound, "conversation_not_found")
+		return
+	}
+	user, err := s.store.getOrCreateUser(owner)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+
+	scratch := &Conversation{
+		UserKey:    owner,
+		OAID:       user.OAID,
+		MiID:       user.MiID,
+		InternalID: newConversationID(user.OAID),
+		Device:     s.store.fingerprints.Profile(user.Fingerprint),
+	}
+	opts := ChatOptions{
+		DeepThinking: getBool(body, "deep_thinking"),
+		OnlineSearch: getBool(body, "online_search"),
+	}
+	queryOpts := RequestOptions{DeepThinking: opts.DeepThinking, OnlineSearch: opts.OnlineSearch}
+
+	turns := []map[string]interface{}{}
+	for i := 0; i < len(history) && len(turns) < maxTurns; i++ {
+		if history[i].Source != "user" {
+			continue
+		}
+		asked := history[i].Content
+		query := asked
+		// Turns stored before history kept the bare message already hold
+		// the system prompt.
+		if systemPrompt == "" || !strings.HasPrefix(asked, systemPrompt) {
+			query = s.buildQuery(scratch, queryOpts, systemPrompt, asked)
+		}
+		stored := ""
+		if i+1 < len(history) && history[i+1].Source == "assistant" {
+			stored = history[i+1].Content
+		}
+
+		answer, err := s.miui.Chat(r.Context(), scratch, query, opts)
+		turn := map[string]interface{}{
+			"index":           len(turns),
+			"query":           query,
+			"stored_answer":   stored,
+			"replayed_answer": answer,
+			"match":           err == nil && strings.TrimSpace(answer) == strings.TrimSpace(stored),
+		}
+		if err != nil {
+			turn["error"] = err.Error()
+		}
+		turns = append(turns, turn)
+		if err != nil {
+			break
+		}
+		scratch.History = append(scratch.History,
+			Message{Source: "user", Content: asked},
+			Message{Source: "assistant", Content: answer},
+		)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"conversation_id": conversationID,
+		"turns":           turns,
+	})
+}
+
+// handleAdminUsers pre-creates users from an array of {user_key, oaid?,
+// mi_id?}, generating device identifiers that are omitted.
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var entries []struct {
+		UserKey string `json:"user_key"`
+		OAID    string `json:"oaid"`
+		MiID    string `json:"mi_id"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 10<<20)).Decode(&entries); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	if len(entries) == 0 || len(entries) > maxBulkUsers {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("expected 1 to %d users", maxBulkUsers))
+		return
+	}
+
+	seeds := make([]UserSeed, 0, len(entries))
+	for i, entry := range entries {
+		userKey := strings.TrimSpace(entry.UserKey)
+		if userKey == "" {
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("users[%d].user_key is required", i))
+			return
+		}
+		seeds = append(seeds, UserSeed{UserKey: userKey, OAID: entry.OAID, MiID: entry.MiID})
+	}
+
+	created, existing, err := s.store.CreateUsers(r.Context(), seeds)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"created":  nonNil(created),
+		"existing": nonNil(existing),
+	})
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// handleAdminFingerprintBan bans a device profile by id. Users holding it are
+// moved to another profile on their next request.
+func (s *Server) handleAdminFingerprintBan(w http.ResponseWriter, r *http.Request) {
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	id, _ := body["id"].(string)
+	if id == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+
+	users, err := s.store.BanFingerprint(r.Context(), id)
+	if errors.Is(err, errUnknownFingerprint) {
+		writeOpenAIErrorCode(w, http.StatusNotFound, "fingerprint not found", "not_found")
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":     id,
+		"banned": true,
+		"users":  users,
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testAdminToken = "admin-secret"
+
+// adminRequest calls an admin handler through adminOnly with the test token.
+func adminRequest(s *Server, handler http.HandlerFunc, method, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, "/admin", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	s.adminOnly(handler)(rec, req)
+	var resp map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestAdminOnlyRequiresToken(t *testing.T) {
+	s := &Server{adminToken: testAdminToken}
+	called := false
+	handler := s.adminOnly(func(w http.ResponseWriter, r *http.Request) { called = true })
+	for _, auth := range []string{"", "Bearer wrong", "admin-secret-but-longer"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/cache", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusUnauthorized || called {
+			t.Errorf("Authorization %q: status %d, handler called %v", auth, rec.Code, called)
+		}
+	}
+}
+
+func TestAdminCacheListAndEvict(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	s.adminToken = testAdminToken
+	if _, err := s.store.GetConversation(context.Background(), "cache-user", "idle"); err != nil {
+		t.Fatal(err)
+	}
+	busy, err := s.store.GetConversation(context.Background(), "cache-user", "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt32(&busy.InUse, 1)
+
+	code, resp := adminRequest(s, s.handleAdminCache, http.MethodGet, "")
+	data, _ := resp["data"].([]interface{})
+	if code != http.StatusOK || len(data) != 2 {
+		t.Fatalf("listing: %d %v", code, resp)
+	}
+	ids := map[string]string{}
+	for _, item := range data {
+		entry := item.(map[string]interface{})
+		if strings.Contains(entry["user"].(string), "cache-user") {
+			t.Errorf("listing exposes the user key: %v", entry)
+		}
+		ids[entry["conversation_id"].(string)] = entry["id"].(string)
+		if entry["in_use"] != (entry["conversation_id"] == "busy") {
+			t.Errorf("entry %v: wrong in_use", entry)
+		}
+	}
+
+	code, resp = adminRequest(s, s.handleAdminCacheEvict, http.MethodPost, `{"id":"`+ids["busy"]+`"}`)
+	if skipped, _ := resp["skipped"].([]interface{}); code != http.StatusOK || len(skipped) != 1 {
+		t.Errorf("evicting an in-use conversation: %d %v, want it skipped", code, resp)
+	}
+	code, resp = adminRequest(s, s.handleAdminCacheEvict, http.MethodPost, `{"all":true}`)
+	if evicted, _ := resp["evicted"].([]interface{}); code != http.StatusOK || len(evicted) != 1 || evicted[0] != ids["idle"] {
+		t.Errorf("evicting all: %d %v, want only the idle conversation", code, resp)
+	}
+	if entries := s.store.CacheEntries(); len(entries) != 1 || entries[0].ConversationID != "busy" {
+		t.Errorf("resident after eviction: %v", entries)
+	}
+	if code, _ := adminRequest(s, s.handleAdminCacheEvict, http.MethodPost, `{"id":"`+ids["idle"]+`"}`); code != http.StatusNotFound {
+		t.Errorf("evicting a gone entry: status %d, want 404", code)
+	}
+}
+
+func TestAdminReplay(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("first answer")
+	queries := make(chan string, 8)
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		queries <- payload.Content
+		answerUpstream(answer.Load().(string))(w, r)
+	})
+	s.adminToken = testAdminToken
+	for _, content := range []string{"one", "two", "three"} {
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, chatRequest("replay-user", "replayed", content))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", content, rec.Code, rec.Body)
+		}
+		<-queries
+	}
+
+	answer.Store("a different answer")
+	code, resp := adminRequest(s, s.handleAdminReplay, http.MethodPost,
+		`{"user_key":"replay-user","conversation_id":"replayed","max_turns":2}`)
+	turns, _ := resp["turns"].([]interface{})
+	if code != http.StatusOK || len(turns) != 2 {
+		t.Fatalf("replay: %d %v, want 2 turns", code, resp)
+	}
+	for i, want := range []string{"one", "two"} {
+		turn := turns[i].(map[string]interface{})
+		if q := <-queries; !strings.Contains(q, want) {
+			t.Errorf("turn %d sent %q upstream, want %q", i, q, want)
+		}
+		if turn["stored_answer"] != "first answer" || turn["replayed_answer"] != "a different answer" || turn["match"] != false {
+			t.Errorf("turn %d: %v", i, turn)
+		}
+	}
+
+	answer.Store("first answer")
+	code, resp = adminRequest(s, s.handleAdminReplay, http.MethodPost, `{"user_key":"replay-user","conversation_id":"replayed"}`)
+	turns, _ = resp["turns"].([]interface{})
+	if code != http.StatusOK || len(turns) != 3 {
+		t.Fatalf("full replay: %d %v, want 3 turns", code, resp)
+	}
+	for i, turn := range turns {
+		<-queries
+		if turn.(map[string]interface{})["match"] != true {
+			t.Errorf("turn %d did not match with the same upstream answer: %v", i, turn)
+		}
+	}
+
+	if code, _ := adminRequest(s, s.handleAdminReplay, http.MethodPost, `{"user_key":"replay-user","conversation_id":"missing"}`); code != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d, want 404", code)
+	}
+	if code, _ := adminRequest(s, s.handleAdminReplay, http.MethodPost, `{"conversation_id":"replayed"}`); code != http.StatusBadRequest {
+		t.Errorf("missing user_key: status %d, want 400", code)
+	}
+}
+
+func TestAdminBulkUsers(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	s.adminToken = testAdminToken
+	old, err := s.store.getOrCreateUser("old-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, resp := adminRequest(s, s.handleAdminUsers, http.MethodPost, `[
+		{"user_key":"new-1","oaid":"oaid-1","mi_id":"mi-1"},
+		{"user_key":"new-2"},
+		{"user_key":"old-key","oaid":"ignored"},
+		{"user_key":"new-1","oaid":"oaid-again"}
+	]`)
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %v", code, resp)
+	}
+	if got := fmt.Sprint(resp["created"], resp["existing"]); got != "[new-1 new-2] [old-key new-1]" {
+		t.Errorf("created and existing = %s", got)
+	}
+
+	for key, want := range map[string]User{"new-1": {OAID: "oaid-1", MiID: "mi-1"}, "old-key": old} {
+		user, err := s.store.getOrCreateUser(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.OAID != want.OAID || user.MiID != want.MiID {
+			t.Errorf("%s: oaid %q mi_id %q, want %q %q", key, user.OAID, user.MiID, want.OAID, want.MiID)
+		}
+	}
+	if user, err := s.store.getOrCreateUser("new-2"); err != nil || user.OAID == "" || user.MiID == "" || user.Fingerprint == "" {
+		t.Errorf("new-2 was not given device identifiers: %+v %v", user, err)
+	}
+
+	for _, body := range []string{`[]`, `[{"oaid":"x"}]`, `{"user_key":"x"}`} {
+		if code, _ := adminRequest(s, s.handleAdminUsers, http.MethodPost, body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, code)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// apiKeys restricts the API to a fixed set of keys (API_KEYS). With no keys
+// configured every credential, or none, is accepted as before.
+type apiKeys struct {
+	keys []string
+}
+
+func newAPIKeys(keys []string) *apiKeys {
+	return &apiKeys{keys: keys}
+}
+
+func (a *apiKeys) allowed(key string) bool {
+	ok := 0
+	for _, allowed := range a.keys {
+		ok |= subtle.ConstantTimeCompare([]byte(key), []byte(allowed))
+	}
+	return key != "" && ok == 1
+}
+
+// presentedKey reads the client key from Authorization (with or without the
+// Bearer scheme), or where Claude and Gemini SDKs send it: x-api-key,
+// x-goog-api-key or the key query parameter.
+func presentedKey(r *http.Request) string {
+	if auth := strings.TrimSpace(r.Header.Get("Authorization")); auth != "" {
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+			return strings.TrimSpace(auth[7:])
+		}
+		return auth
+	}
+	if key := strings.TrimSpace(r.Header.Get("X-Api-Key")); key != "" {
+		return key
+	}
+	if key := strings.TrimSpace(r.Header.Get("X-Goog-Api-Key")); key != "" {
+		return key
+	}
+	return strings.TrimSpace(r.URL.Query().Get("key"))
+}
+
+// Handler answers 401 in the caller's protocol unless the request carries an
+// allowed key. Health, metrics and the admin endpoints, which have their own
+// token, are exempt.
+func (a *apiKeys) Handler(next http.Handler) http.Handler {
+	if len(a.keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/health" || path == "/metrics" || strings.HasPrefix(path, "/admin/") || a.allowed(presentedKey(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeProtocolError(w, path, http.StatusUnauthorized, "invalid api key", "authentication_error", "invalid_api_key")
+	})
+}
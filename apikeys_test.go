@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, tc := range []struct {
+		keys   []string
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{nil, "/v1/chat/completions", "", "", http.StatusOK},
+		{nil, "/v1/chat/completions", "Authorization", "Bearer anything", http.StatusOK},
+		{[]string{"k1", "k2"}, "/v1/chat/completions", "Authorization", "Bearer k2", http.StatusOK},
+		{[]string{"k1"}, "/v1/messages", "X-Api-Key", "k1", http.StatusOK},
+		{[]string{"k1"}, geminiPathPrefix + "DOUBAO:generateContent", "X-Goog-Api-Key", "k1", http.StatusOK},
+		{[]string{"k1"}, "/health", "", "", http.StatusOK},
+		{[]string{"k1"}, "/v1/chat/completions", "", "", http.StatusUnauthorized},
+		{[]string{"k1"}, "/v1/chat/completions", "Authorization", "Bearer k10", http.StatusUnauthorized},
+		{[]string{"k1"}, "/v1/messages", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+		newAPIKeys(tc.keys).Handler(ok).ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("keys %v, %s %s=%q: status %d, want %d", tc.keys, tc.path, tc.header, tc.value, rec.Code, tc.status)
+			continue
+		}
+		if tc.status == http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Type  string `json:"type"`
+			Error struct {
+				Type string `json:"type"`
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v in %q", tc.path, err, rec.Body)
+		}
+		if tc.path == "/v1/messages" {
+			if body.Type != "error" || body.Error.Type != "authentication_error" {
+				t.Errorf("Claude 401 body = %s", rec.Body)
+			}
+		} else if body.Error.Code != "invalid_api_key" {
+			t.Errorf("OpenAI 401 body = %s", rec.Body)
+		}
+	}
+}
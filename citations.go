@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// citationsHeading opens the footnote block appended to online-search
+// answers. undecorate looks for it to strip the block from turns that
+// clients send back.
+const citationsHeading = "\n\n**Sources**\n"
+
+// Citation is a source the upstream cited for an online-search answer.
+type Citation struct {
+	Title string
+	URL   string
+}
+
+// miuiReference is one entry of a chunk's references or sources array;
+// title/name and url/link are accepted interchangeably.
+type miuiReference struct {
+	Title string `json:"title"`
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Link  string `json:"link"`
+}
+
+func (r miuiReference) citation() Citation {
+	c := Citation{Title: strings.TrimSpace(r.Title), URL: strings.TrimSpace(r.URL)}
+	if c.Title == "" {
+		c.Title = strings.TrimSpace(r.Name)
+	}
+	if c.URL == "" {
+		c.URL = strings.TrimSpace(r.Link)
+	}
+	return c
+}
+
+// citationList collects citations across chunks, keeping the first of each
+// URL in the order they arrived.
+type citationList struct {
+	items []Citation
+	seen  map[string]bool
+}
+
+func (l *citationList) add(citations []Citation) {
+	if l.seen == nil {
+		l.seen = make(map[string]bool)
+	}
+	for _, c := range citations {
+		if c.URL == "" || l.seen[c.URL] {
+			continue
+		}
+		l.seen[c.URL] = true
+		l.items = append(l.items, c)
+	}
+}
+
+// footnotes renders the citations as a numbered markdown list under
+// citationsHeading, or "" when there are none.
+func (l *citationList) footnotes() string {
+	if len(l.items) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(citationsHeading)
+	for i, c := range l.items {
+		title := c.Title
+		if title == "" {
+			title = c.URL
+		}
+		fmt.Fprintf(&b, "%d. [%s](%s)\n", i+1, title, c.URL)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// stripCitations drops a trailing footnote block from an answer.
+func stripCitations(content string) string {
+	if i := strings.LastIndex(content, citationsHeading); i >= 0 {
+		return content[:i]
+	}
+	return content
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func citingUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, `data: {"answer":"Paris.","references":[{"title":"Wiki","url":"https://a.example"}]}`+"\n\n")
+	fmt.Fprint(w, `data: {"sources":[{"name":"Atlas","link":"https://b.example"},{"url":"https://a.example"}]}`+"\n\n")
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func TestCitationsFootnotes(t *testing.T) {
+	s := newTestServer(t, citingUpstream)
+	footnotes := citationsHeading + "1. [Wiki](https://a.example)\n2. [Atlas](https://b.example)"
+
+	for _, disabled := range []bool{false, true} {
+		req := chatRequest("citation-user", fmt.Sprintf("cite-%v", disabled), "capital of France?")
+		if disabled {
+			req.Header.Set("X-Disable-Citations", "true")
+		}
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		var resp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+		want := "Paris." + footnotes
+		if disabled {
+			want = "Paris."
+		}
+		if got := resp.Choices[0].Message.Content; got != want {
+			t.Errorf("disabled=%v: content %q, want %q", disabled, got, want)
+		}
+	}
+
+	conv, err := s.store.GetConversation(context.Background(), "citation-user", "cite-false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv.mu.Lock()
+	last := conv.History[len(conv.History)-1]
+	conv.mu.Unlock()
+	if last.Content != "Paris." {
+		t.Errorf("history holds %q, want the answer without footnotes", last.Content)
+	}
+	if got := stripCitations("Paris." + footnotes); got != "Paris." {
+		t.Errorf("stripCitations = %q", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultMaxConnsPerIP = 64
+
+// trustedProxies decides whether X-Forwarded-For may be believed. Only hops
+// inside TRUSTED_PROXIES are skipped when walking the header.
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+	var nets trustedProxies
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. When the peer is a trusted
+// proxy, X-Forwarded-For is walked from the right and the first untrusted hop
+// is used.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !t.contains(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !t.contains(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// connLimiter caps concurrent in-flight requests per client IP so a single
+// client cannot pin hundreds of long-lived streams.
+type connLimiter struct {
+	mu      sync.Mutex
+	max     int
+	active  map[string]int
+	proxies trustedProxies
+}
+
+func newConnLimiter(maxPerIP int, proxies trustedProxies) *connLimiter {
+	return &connLimiter{
+		max:     maxPerIP,
+		active:  make(map[string]int),
+		proxies: proxies,
+	}
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// Handler rejects requests with 429 while their IP is at the limit. A
+// non-positive limit disables the check.
+func (l *connLimiter) Handler(next http.Handler) http.Handler {
+	if l.max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.proxies.clientIP(r)
+		if !l.acquire(ip) {
+			writeProtocolError(w, r.URL.Path, http.StatusTooManyRequests, "too many concurrent connections",
+				"rate_limit_error", "too_many_connections")
+			return
+		}
+		defer l.release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7, 10.9.9.9", "198.51.100.7"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := proxies.clientIP(req); got != tc.want {
+			t.Errorf("%s via %q: clientIP = %q, want %q", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestConnLimiterRejectsPastLimit(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := newConnLimiter(2, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hold") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	call := func(path, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			call("/v1/chat/completions?hold=1", "203.0.113.5:1000")
+			done <- struct{}{}
+		}()
+		<-entered
+	}
+
+	rec := call("/v1/chat/completions", "203.0.113.5:2000")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "too_many_connections") {
+		t.Errorf("OpenAI path past the limit: %d %s", rec.Code, rec.Body)
+	}
+	rec = call("/v1/messages", "203.0.113.5:2000")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "rate_limit_error") {
+		t.Errorf("Claude path past the limit: %d %s", rec.Code, rec.Body)
+	}
+	if rec := call("/v1/chat/completions", "198.51.100.7:2000"); rec.Code != http.StatusOK {
+		t.Errorf("another IP: status %d, want 200", rec.Code)
+	}
+
+	close(release)
+	<-done
+	<-done
+	if rec := call("/v1/chat/completions", "203.0.113.5:2000"); rec.Code != http.StatusOK {
+		t.Errorf("after release: status %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleCompletions serves the legacy text completions API. The prompt is
+// treated as a user turn on the same conversation the chat endpoint uses.
+func (s *Server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+
+	userText := extractPrompt(body["prompt"])
+	if strings.TrimSpace(userText) == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "missing_prompt")
+		return
+	}
+
+	turn, ok := s.beginTurn(w, r, nil, userText, s.parseRequestOptions(body, r))
+	if !ok {
+		return
+	}
+	defer turn.done()
+	model := s.responseModel(body["model"], turn.opts.Model)
+
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
+		if !ok {
+			return
+		}
+		defer sw.Close()
+
+		id := newID("cmpl")
+		created := time.Now().Unix()
+		onChunk := func(text string) {
+			sw.Data(s.withObjectType(newTextCompletion(id, created, model, text, nil)))
+		}
+
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(_ turnResult, f chatFailure) {
+			sw.Batch(func(w http.ResponseWriter) {
+				writeSSEData(w, newOpenAIStreamFailure(f))
+				writeSSELine(w, "data: [DONE]\n\n")
+			})
+		})
+		if !ok {
+			return
+		}
+		finishReason := "stop"
+		if truncated(res.err) {
+			finishReason = "length"
+		}
+
+		sw.Batch(func(w http.ResponseWriter) {
+			writeSSEData(w, markFallback(s.withObjectType(newTextCompletion(id, created, model, "", &finishReason)), res.fallback))
+			if turn.opts.IncludeUsage {
+				final := s.withObjectType(newTextCompletion(id, created, model, "", nil))
+				final["choices"] = []interface{}{}
+				final["usage"] = res.usage.openAI()
+				writeSSEData(w, final)
+			}
+			writeSSELine(w, "data: [DONE]\n\n")
+		})
+		return
+	}
+
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
+		return
+	}
+
+	finishReason := "stop"
+	if truncated(res.err) {
+		finishReason = "length"
+	}
+	resp := newTextCompletion(newID("cmpl"), time.Now().Unix(), model, res.full, &finishReason)
+	resp["usage"] = res.usage.openAI()
+	writeJSON(w, s.shapeResponse(resp))
+}
+
+// extractPrompt reads a completions prompt: a string, or an array of strings
+// joined by newlines. Token-id prompts are not supported.
+func extractPrompt(raw interface{}) string {
+	switch v := raw.(type) {
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if text, ok := item.(string); ok && text != "" {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	default:
+		return ""
+	}
+}
+
+// newTextCompletion builds a text_completion object; streams send one per
+// chunk with the same id.
+func newTextCompletion(id string, created int64, model, text string, finishReason *string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      id,
+		"object":  "text_completion",
+		"created": created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{
+				"text":          text,
+				"index":         0,
+				"logprobs":      nil,
+				"finish_reason": finishReason,
+			},
+		},
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func completionsRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer completions-user")
+	return req
+}
+
+func TestCompletionsPrompt(t *testing.T) {
+	for _, tc := range []struct {
+		name, prompt, query string
+	}{
+		{"string", `"Say hi"`, "Say hi"},
+		{"array", `["Say", "", "hi"]`, "Say\nhi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			queries := make(chan string, 1)
+			s := newTestServer(t, queryRecorder(queries))
+
+			rec := httptest.NewRecorder()
+			s.handleCompletions(rec, completionsRequest(`{"model":"DOUBAO","prompt":`+tc.prompt+`}`))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if query := <-queries; query != tc.query {
+				t.Errorf("upstream query %q, want %q", query, tc.query)
+			}
+			var resp struct {
+				Object  string `json:"object"`
+				Choices []struct {
+					Text         string `json:"text"`
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+				Usage struct {
+					CompletionTokens int `json:"completion_tokens"`
+				} `json:"usage"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Object != "text_completion" || len(resp.Choices) != 1 ||
+				resp.Choices[0].Text != "ok" || resp.Choices[0].FinishReason != "stop" || resp.Usage.CompletionTokens == 0 {
+				t.Errorf("response %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestCompletionsMissingPrompt(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	rec := httptest.NewRecorder()
+	s.handleCompletions(rec, completionsRequest(`{"model":"DOUBAO","prompt":["", " "]}`))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing_prompt") {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCompletionsStream(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+
+	rec := httptest.NewRecorder()
+	s.handleCompletions(rec, completionsRequest(
+		`{"model":"DOUBAO","stream":true,"stream_options":{"include_usage":true},"prompt":"Say hello"}`))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("content type %q: %s", ct, rec.Body)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("stream not terminated: %q", rec.Body)
+	}
+
+	var text strings.Builder
+	var finish []string
+	usage := 0
+	for _, data := range sseData(rec.Body.String()) {
+		var chunk struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Text         string  `json:"text"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *struct {
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if chunk.Object != "text_completion" {
+			t.Errorf("chunk object %q", chunk.Object)
+		}
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Text)
+			if choice.FinishReason != nil {
+				finish = append(finish, *choice.FinishReason)
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.CompletionTokens
+		}
+	}
+	if text.String() != "Hello" || len(finish) != 1 || finish[0] != "stop" || usage == 0 {
+		t.Errorf("text %q, finish %v, usage %d: %s", text.String(), finish, usage, rec.Body)
+	}
+}
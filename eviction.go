@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// evictionPolicy decides which idle conversations the cleanup loop drops
+// from memory (EVICTION_POLICY):
+//   - ttl: conversations inactive for longer than ttl (the default).
+//   - lru: least recently used conversations while more than maxLive are
+//     cached.
+//   - hybrid: both.
+type evictionPolicy struct {
+	name    string
+	ttl     time.Duration
+	maxLive int
+}
+
+type evictionCandidate struct {
+	key        string
+	lastActive time.Time
+}
+
+func newEvictionPolicy(name string, ttl time.Duration, maxLive int) (evictionPolicy, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "ttl":
+		return evictionPolicy{name: "ttl", ttl: ttl}, nil
+	case "lru", "hybrid":
+		if maxLive <= 0 {
+			return evictionPolicy{}, fmt.Errorf("EVICTION_POLICY=%s requires MAX_LIVE_CONVERSATIONS", name)
+		}
+		policy := evictionPolicy{name: name, maxLive: maxLive}
+		if name == "hybrid" {
+			policy.ttl = ttl
+		}
+		return policy, nil
+	default:
+		return evictionPolicy{}, fmt.Errorf("unknown EVICTION_POLICY %q", name)
+	}
+}
+
+// choose returns the keys to evict. live is the number of cached
+// conversations; idle holds those not in use, the only ones that may go.
+func (p evictionPolicy) choose(now time.Time, live int, idle []evictionCandidate) []string {
+	var evict []string
+	var rest []evictionCandidate
+	for _, c := range idle {
+		if p.ttl > 0 && now.Sub(c.lastActive) >= p.ttl {
+			evict = append(evict, c.key)
+			continue
+		}
+		rest = append(rest, c)
+	}
+
+	over := live - len(evict) - p.maxLive
+	if p.maxLive <= 0 || over <= 0 {
+		return evict
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].lastActive.Before(rest[j].lastActive) })
+	for _, c := range rest[:min(over, len(rest))] {
+		evict = append(evict, c.key)
+	}
+	return evict
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicyChoose(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Conversations idle for 10s, 30s, 90s and 120s; one more is in use.
+	idle := []evictionCandidate{
+		{"fresh", now.Add(-10 * time.Second)},
+		{"warm", now.Add(-30 * time.Second)},
+		{"stale", now.Add(-90 * time.Second)},
+		{"oldest", now.Add(-120 * time.Second)},
+	}
+	const live = 5
+
+	for _, tc := range []struct {
+		name    string
+		maxLive int
+		want    []string
+	}{
+		{"ttl", 0, []string{"oldest", "stale"}},
+		{"", 0, []string{"oldest", "stale"}},
+		{"lru", 4, []string{"oldest"}},
+		{"lru", 2, []string{"oldest", "stale", "warm"}},
+		{"lru", 1, []string{"fresh", "oldest", "stale", "warm"}},
+		{"lru", 10, nil},
+		{"hybrid", 4, []string{"oldest", "stale"}},
+		{"hybrid", 2, []string{"oldest", "stale", "warm"}},
+	} {
+		policy, err := newEvictionPolicy(tc.name, time.Minute, tc.maxLive)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := policy.choose(now, live, idle)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s with max %d: evicts %v, want %v", tc.name, tc.maxLive, got, tc.want)
+		}
+	}
+}
+
+func TestNewEvictionPolicyRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		maxLive int
+	}{
+		{"lru", 0},
+		{"hybrid", 0},
+		{"fifo", 10},
+	} {
+		if _, err := newEvictionPolicy(tc.name, time.Minute, tc.maxLive); err == nil {
+			t.Errorf("%s with max %d: no error", tc.name, tc.maxLive)
+		}
+	}
+}
+
+func TestCleanupLoopAppliesLRU(t *testing.T) {
+	t.Setenv("EVICTION_POLICY", "lru")
+	t.Setenv("MAX_LIVE_CONVERSATIONS", "2")
+	t.Setenv("CLEANUP_PERIOD", "5ms")
+	st := newTestStore(t)
+
+	// The conversations stay in use until all are set up, so the loop
+	// cannot evict one before its LastActive is in place.
+	now := time.Now()
+	var convs []*Conversation
+	for i, id := range []string{"c0", "c1", "c2", "c3"} {
+		conv, err := st.GetConversation(context.Background(), "lru-user", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.AddInt32(&conv.InUse, 1)
+		conv.mu.Lock()
+		conv.LastActive = now.Add(time.Duration(i) * time.Second)
+		conv.mu.Unlock()
+		convs = append(convs, conv)
+	}
+	for _, conv := range convs {
+		atomic.AddInt32(&conv.InUse, -1)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var ids []string
+		for _, entry := range st.CacheEntries() {
+			ids = append(ids, entry.ConversationID)
+		}
+		sort.Strings(ids)
+		if reflect.DeepEqual(ids, []string{"c2", "c3"}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resident conversations %v, want the two most recent", ids)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
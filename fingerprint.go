@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+var errUnknownFingerprint = errors.New("unknown fingerprint")
+
+// DeviceProfile is the device a user presents to the upstream.
+type DeviceProfile struct {
+	ID             string `json:"id"`
+	DeviceModel    string `json:"device_model"`
+	AppVersionCode string `json:"app_version_code"`
+	UserAgent      string `json:"user_agent"`
+	// Banned profiles are never assigned; users holding one are moved to
+	// another profile on their next request.
+	Banned bool `json:"banned,omitempty"`
+}
+
+var defaultDeviceProfile = DeviceProfile{
+	ID:             "default",
+	DeviceModel:    "M2012K11AC",
+	AppVersionCode: "201110100",
+	UserAgent:      "Mozilla/5.0 (Linux; U; Android 11; zh-cn; M2012K11AC Build/RKQ1.200826.002) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/135.0.7049.79 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.11.1010115",
+}
+
+// builtinDeviceProfiles is the pool used without FINGERPRINT_POOL_FILE, so
+// users are spread over several devices rather than all presenting one.
+var builtinDeviceProfiles = []DeviceProfile{
+	defaultDeviceProfile,
+	{
+		ID:             "redmi-k50",
+		DeviceModel:    "22041211AC",
+		AppVersionCode: "201110100",
+		UserAgent:      "Mozilla/5.0 (Linux; U; Android 13; zh-cn; 22041211AC Build/TP1A.220624.014) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/135.0.7049.79 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.11.1010115",
+	},
+	{
+		ID:             "xiaomi-12-pro",
+		DeviceModel:    "2201122C",
+		AppVersionCode: "201030200",
+		UserAgent:      "Mozilla/5.0 (Linux; U; Android 14; zh-cn; 2201122C Build/UKQ1.230917.001) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.6778.200 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.10.30200",
+	},
+	{
+		ID:             "xiaomi-13-ultra",
+		DeviceModel:    "2304FPN6DC",
+		AppVersionCode: "201110100",
+		UserAgent:      "Mozilla/5.0 (Linux; U; Android 14; zh-cn; 2304FPN6DC Build/UKQ1.230804.001) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/135.0.7049.79 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.11.1010115",
+	},
+	{
+		ID:             "xiaomi-14",
+		DeviceModel:    "23127PN0CC",
+		AppVersionCode: "201090300",
+		UserAgent:      "Mozilla/5.0 (Linux; U; Android 15; zh-cn; 23127PN0CC Build/AQ3A.240627.003) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.6943.137 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.9.30300",
+	},
+}
+
+// FingerprintPool holds the device profiles users are assigned from. A user's
+// profile is chosen by hashing its key, so assignment is stable across
+// restarts and stores; it is persisted in the users table and kept until the
+// profile is banned.
+type FingerprintPool struct {
+	mu       sync.RWMutex
+	profiles []DeviceProfile
+	byID     map[string]int
+}
+
+// LoadFingerprintPool reads a JSON array of device profiles; omitted fields
+// take the default profile's values. Without a file the pool holds the
+// built-in profiles.
+func LoadFingerprintPool(path string) (*FingerprintPool, error) {
+	profiles := append([]DeviceProfile(nil), builtinDeviceProfiles...)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		profiles = nil
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return nil, fmt.Errorf("fingerprint pool %s: %w", path, err)
+		}
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("fingerprint pool %s: no profiles", path)
+		}
+	}
+
+	pool := &FingerprintPool{profiles: profiles, byID: make(map[string]int, len(profiles))}
+	for i, profile := range profiles {
+		if profile.ID == "" {
+			return nil, fmt.Errorf("fingerprint pool %s: profile %d has no id", path, i)
+		}
+		if profile.DeviceModel == "" {
+			pool.profiles[i].DeviceModel = defaultDeviceProfile.DeviceModel
+		}
+		if profile.AppVersionCode == "" {
+			pool.profiles[i].AppVersionCode = defaultDeviceProfile.AppVersionCode
+		}
+		if profile.UserAgent == "" {
+			pool.profiles[i].UserAgent = defaultDeviceProfile.UserAgent
+		}
+		if _, dup := pool.byID[profile.ID]; dup {
+			return nil, fmt.Errorf("fingerprint pool %s: duplicate id %q", path, profile.ID)
+		}
+		pool.byID[profile.ID] = i
+	}
+	return pool, nil
+}
+
+// Assign picks a usable profile id for userKey by hash, or "" when every
+// profile is banned. The same key gets the same profile while the pool's
+// usable set is unchanged.
+func (p *FingerprintPool) Assign(userKey string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var usable []string
+	for _, profile := range p.profiles {
+		if !profile.Banned {
+			usable = append(usable, profile.ID)
+		}
+	}
+	if len(usable) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userKey))
+	return usable[h.Sum32()%uint32(len(usable))]
+}
+
+// Usable reports whether id names a profile that is not banned.
+func (p *FingerprintPool) Usable(id string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	i, ok := p.byID[id]
+	return ok && !p.profiles[i].Banned
+}
+
+// Profile returns the profile for id, falling back to the first profile for
+// users not yet assigned one.
+func (p *FingerprintPool) Profile(id string) DeviceProfile {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if i, ok := p.byID[id]; ok {
+		return p.profiles[i]
+	}
+	return p.profiles[0]
+}
+
+// Ban stops assigning the profile. Bans last until restart unless also
+// recorded in the pool file.
+func (p *FingerprintPool) Ban(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i, ok := p.byID[id]
+	if !ok {
+		return errUnknownFingerprint
+	}
+	p.profiles[i].Banned = true
+	return nil
+}
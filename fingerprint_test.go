@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprintStickyAndReassignedOnBan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := st.getOrCreateUser("sticky-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.fingerprints.Usable(user.Fingerprint) {
+		t.Fatalf("assigned unusable fingerprint %q", user.Fingerprint)
+	}
+	st.Close()
+
+	st, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	again, err := st.getOrCreateUser("sticky-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Fingerprint != user.Fingerprint {
+		t.Fatalf("fingerprint changed across restarts: %q then %q", user.Fingerprint, again.Fingerprint)
+	}
+
+	conv, err := st.GetConversation(context.Background(), "sticky-user", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conv.device().ID; got != user.Fingerprint {
+		t.Fatalf("conversation presents %q, want %q", got, user.Fingerprint)
+	}
+
+	users, err := st.BanFingerprint(context.Background(), user.Fingerprint)
+	if err != nil || users != 1 {
+		t.Fatalf("ban: %d users, %v", users, err)
+	}
+	moved, err := st.getOrCreateUser("sticky-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Fingerprint == user.Fingerprint || !st.fingerprints.Usable(moved.Fingerprint) {
+		t.Fatalf("after the ban the user holds %q", moved.Fingerprint)
+	}
+	var stored string
+	if err := st.db.QueryRow(`SELECT fingerprint FROM users WHERE user_key = 'sticky-user'`).Scan(&stored); err != nil || stored != moved.Fingerprint {
+		t.Errorf("users table holds %q (%v), want %q", stored, err, moved.Fingerprint)
+	}
+	if conv, err = st.GetConversation(context.Background(), "sticky-user", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conv.device().ID; got != moved.Fingerprint {
+		t.Errorf("resident conversation still presents %q after the ban", got)
+	}
+
+	if _, err := st.BanFingerprint(context.Background(), "no-such-device"); !errors.Is(err, errUnknownFingerprint) {
+		t.Errorf("banning an unknown id: %v", err)
+	}
+}
+
+func TestLoadFingerprintPool(t *testing.T) {
+	write := func(text string) string {
+		path := filepath.Join(t.TempDir(), "pool.json")
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	pool, err := LoadFingerprintPool(write(`[{"id":"a"},{"id":"b","device_model":"X1"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := pool.Profile("a"); a.DeviceModel != defaultDeviceProfile.DeviceModel || a.UserAgent != defaultDeviceProfile.UserAgent {
+		t.Errorf("profile a did not take the defaults: %+v", a)
+	}
+	if b := pool.Profile("b"); b.DeviceModel != "X1" {
+		t.Errorf("profile b = %+v", b)
+	}
+	if got := pool.Assign("some-user"); got != pool.Assign("some-user") {
+		t.Error("Assign is not stable for a key")
+	}
+
+	for _, text := range []string{`[]`, `[{"device_model":"X1"}]`, `[{"id":"a"},{"id":"a"}]`, `not json`} {
+		if _, err := LoadFingerprintPool(write(text)); err == nil {
+			t.Errorf("%s: loaded without error", text)
+		}
+	}
+}
+
+func TestDeviceProfilesPerUser(t *testing.T) {
+	pool, err := LoadFingerprintPool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadFingerprintPool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assigned := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("fleet-user-%d", i)
+		id := pool.Assign(key)
+		if id == "" || again.Assign(key) != id {
+			t.Fatalf("%s: assigned %q, then %q by a fresh pool", key, id, again.Assign(key))
+		}
+		assigned[id] = key
+	}
+	if len(assigned) < 2 {
+		t.Fatalf("20 users all share profile %v", assigned)
+	}
+
+	// Two users on different profiles present them upstream.
+	type sent struct{ userAgent, deviceModel string }
+	requests := make(chan sent, 2)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		requests <- sent{r.Header.Get("User-Agent"), payload.DeviceModel}
+		answerUpstream("ok")(w, r)
+	}))
+	defer up.Close()
+	routes, err := LoadModelRoutes("", up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewMiuiClient(routes)
+	st := newTestStore(t)
+	n := 0
+	for id, key := range assigned {
+		if n++; n > 2 {
+			break
+		}
+		conv, err := st.GetConversation(context.Background(), key, "device")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Chat(context.Background(), conv, "hi", ChatOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		profile := pool.Profile(id)
+		if got := <-requests; got.userAgent != profile.UserAgent || got.deviceModel != profile.DeviceModel {
+			t.Errorf("%s on %s sent %+v", key, id, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const geminiPathPrefix = "/v1beta/models/"
+
+// handleGemini routes POST /v1beta/models/{model}:generateContent and
+// :streamGenerateContent. Streams are SSE, one GenerateContentResponse per
+// event, as the Gemini SDKs request with alt=sse.
+func (s *Server) handleGemini(w http.ResponseWriter, r *http.Request) {
+	model, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, geminiPathPrefix), ":")
+	if !ok || model == "" || (method != "generateContent" && method != "streamGenerateContent") {
+		writeGeminiError(w, http.StatusNotFound, "method not found")
+		return
+	}
+
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+
+	systemParts, userText, transcript := extractMessages(geminiMessages(body["contents"]))
+	instruction, _ := body["systemInstruction"].(map[string]interface{})
+	if system := extractContent(instruction["parts"]); system != "" {
+		systemParts = append([]string{system}, systemParts...)
+	}
+	if userText == "" {
+		writeGeminiError(w, http.StatusBadRequest, "missing_user_message")
+		return
+	}
+
+	// The model comes from the path; flag suffixes work as elsewhere.
+	body["model"] = model
+	opts := s.parseRequestOptions(body, r)
+	opts.Stream = method == "streamGenerateContent"
+	model = s.responseModel(model, model)
+	opts.Transcript = transcript
+	if config, ok := body["generationConfig"].(map[string]interface{}); ok {
+		if n := getInt(config, "maxOutputTokens"); n > 0 {
+			opts.MaxTokens = n
+		}
+		if stops, ok := config["stopSequences"]; ok {
+			opts.Stop = append(opts.Stop, parseStopSequences(map[string]interface{}{"stop": stops})...)
+		}
+	}
+
+	// Gemini SDKs send their API key in x-goog-api-key or ?key=.
+	if r.Header.Get("Authorization") == "" {
+		key := r.Header.Get("X-Goog-Api-Key")
+		if key == "" {
+			key = r.URL.Query().Get("key")
+		}
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+	turn, ok := s.beginTurn(w, r, systemParts, userText, opts)
+	if !ok {
+		return
+	}
+	defer turn.done()
+
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
+		if !ok {
+			return
+		}
+		defer sw.Close()
+
+		onChunk := func(text string) {
+			sw.Data(newGeminiResponse(model, text, ""))
+		}
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(_ turnResult, f chatFailure) {
+			body := newGeminiErrorBody(f.status, f.message)
+			f.withRetryAfter(body["error"].(map[string]interface{}))
+			sw.Data(body)
+		})
+		if !ok {
+			return
+		}
+
+		final := newGeminiResponse(model, "", geminiFinishReason(res.err))
+		final["usageMetadata"] = res.usage.gemini()
+		sw.Data(markFallback(final, res.fallback))
+		return
+	}
+
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
+		return
+	}
+
+	resp := newGeminiResponse(model, res.full, geminiFinishReason(res.err))
+	resp["usageMetadata"] = res.usage.gemini()
+	writeJSON(w, s.shapeResponse(resp))
+}
+
+// geminiMessages converts Gemini contents to chat messages for
+// extractMessages; the "model" role is the assistant.
+func geminiMessages(raw interface{}) interface{} {
+	contents, _ := raw.([]interface{})
+	msgs := make([]interface{}, 0, len(contents))
+	for _, item := range contents {
+		content, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := content["role"].(string)
+		if role == "model" {
+			role = "assistant"
+		} else {
+			role = "user"
+		}
+		msgs = append(msgs, map[string]interface{}{
+			"role":    role,
+			"content": content["parts"],
+		})
+	}
+	return msgs
+}
+
+func geminiFinishReason(err error) string {
+	if truncated(err) {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
+
+// newGeminiResponse builds a GenerateContentResponse with one candidate.
+// finishReason is empty on intermediate stream chunks.
+func newGeminiResponse(model, text, finishReason string) map[string]interface{} {
+	candidate := map[string]interface{}{
+		"index": 0,
+		"content": map[string]interface{}{
+			"role":  "model",
+			"parts": []map[string]interface{}{{"text": text}},
+		},
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	return map[string]interface{}{
+		"candidates":   []map[string]interface{}{candidate},
+		"modelVersion": model,
+	}
+}
+
+// geminiStatus is the google.rpc status name for an HTTP status.
+func geminiStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	case http.StatusBadGateway:
+		return "UNAVAILABLE"
+	default:
+		return "INTERNAL"
+	}
+}
+
+func newGeminiErrorBody(status int, msg string) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": msg,
+			"status":  geminiStatus(status),
+		},
+	}
+}
+
+func writeGeminiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	data, _ := json.Marshal(withResponseRequestID(w, newGeminiErrorBody(status, msg)))
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeminiTwoPartMessage(t *testing.T) {
+	queries := make(chan string, 2)
+	s := newTestServer(t, queryRecorder(queries))
+
+	body := `{"systemInstruction":{"parts":[{"text":"be brief"}]},` +
+		`"contents":[{"role":"user","parts":[{"text":"Tell me a joke "},{"text":"about cats."}]}]}`
+	req := httptest.NewRequest(http.MethodPost, geminiPathPrefix+"DOUBAO:generateContent", strings.NewReader(body))
+	req.Header.Set("X-Goog-Api-Key", "gemini-user")
+	rec := httptest.NewRecorder()
+	s.handleGemini(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d: %s", rec.Code, rec.Body)
+	}
+
+	query := <-queries
+	if !strings.HasSuffix(query, "Tell me a joke about cats.") || strings.Count(query, "about cats.") != 1 {
+		t.Errorf("parts did not join into one query: %q", query)
+	}
+	if !strings.Contains(query, "be brief") {
+		t.Errorf("system instruction missing from query %q", query)
+	}
+
+	var resp struct {
+		Candidates []struct {
+			Content struct {
+				Role  string `json:"role"`
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Candidates) != 1 || len(resp.Candidates[0].Content.Parts) != 1 ||
+		resp.Candidates[0].Content.Parts[0].Text != "ok" || resp.Candidates[0].FinishReason != "STOP" {
+		t.Errorf("response = %s", rec.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, geminiPathPrefix+"DOUBAO:streamGenerateContent?alt=sse", strings.NewReader(body))
+	req.Header.Set("X-Goog-Api-Key", "gemini-user")
+	req.Header.Set("ConversationId", "stream")
+	rec = httptest.NewRecorder()
+	s.handleGemini(rec, req)
+	<-queries
+	events := sseData(rec.Body.String())
+	if len(events) < 2 || !strings.Contains(events[0], `"text":"ok"`) || !strings.Contains(events[len(events)-1], `"finishReason":"STOP"`) {
+		t.Errorf("stream = %q", rec.Body)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const conversationsPathPrefix = "/v1/conversations/"
+
+// handleConversations routes GET /v1/conversations/{id} and
+// /v1/conversations/{id}/history for the caller's own conversations.
+func (s *Server) handleConversations(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, conversationsPathPrefix)
+	conversationID, history := strings.CutSuffix(rest, "/history")
+	if conversationID == "" || strings.Contains(conversationID, "/") {
+		writeOpenAIError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if history {
+		s.handleConversationHistory(w, r, conversationID)
+		return
+	}
+	s.handleConversationStats(w, r, conversationID)
+}
+
+// handleConversationStats reports message count and estimated token totals
+// accumulated across the conversation's turns.
+func (s *Server) handleConversationStats(w http.ResponseWriter, r *http.Request, conversationID string) {
+	stats, found, err := s.store.ConversationStats(r.Context(), extractUserKey(r), conversationID)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+	if !found {
+		writeOpenAIError(w, http.StatusNotFound, "conversation_not_found")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"conversation_id": conversationID,
+		"object":          "conversation",
+		"messages":        stats.Messages,
+		"usage": map[string]interface{}{
+			"prompt_tokens":     stats.PromptTokens,
+			"completion_tokens": stats.CompletionTokens,
+			"total_tokens":      stats.PromptTokens + stats.CompletionTokens,
+		},
+	})
+}
+
+// handleConversationHistory serves the stored messages. The format query
+// parameter selects raw, openai or claude message shapes; limit and before
+// page backwards through the history by message index.
+func (s *Server) handleConversationHistory(w http.ResponseWriter, r *http.Request, conversationID string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "raw"
+	}
+	if format != "raw" && format != "openai" && format != "claude" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_format")
+		return
+	}
+
+	limit, okLimit := queryIndex(r, "limit")
+	before, okBefore := queryIndex(r, "before")
+	if !okLimit || !okBefore {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_pagination")
+		return
+	}
+
+	userKey := extractUserKey(r)
+	history, found, err := s.store.History(r.Context(), userKey, conversationID)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+	if !found {
+		writeOpenAIError(w, http.StatusNotFound, "conversation_not_found")
+		return
+	}
+
+	total := len(history)
+	end := total
+	if before >= 0 && before < end {
+		end = before
+	}
+	start := 0
+	if limit >= 0 && end-limit > 0 {
+		start = end - limit
+	}
+	history = history[start:end]
+
+	resp := map[string]interface{}{
+		"conversation_id": conversationID,
+		"total":           total,
+		"first_index":     start,
+		"has_more":        start > 0,
+	}
+	switch format {
+	case "openai":
+		resp["messages"] = historyToOpenAI(history)
+	case "claude":
+		system, messages := historyToClaude(history)
+		if system != "" {
+			resp["system"] = system
+		}
+		resp["messages"] = messages
+	default:
+		resp["messages"] = history
+	}
+	writeJSON(w, resp)
+}
+
+// queryIndex reads a non-negative integer query parameter, returning -1 when
+// it is absent and false when it is malformed.
+func queryIndex(r *http.Request, name string) (int, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return -1, true
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// historyRole maps an internal message source to a chat role.
+func historyRole(source string) string {
+	switch source {
+	case "assistant", "system", "tool":
+		return source
+	default:
+		return "user"
+	}
+}
+
+func historyToOpenAI(history []Message) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(history))
+	for _, msg := range history {
+		entry := map[string]interface{}{
+			"role":    historyRole(msg.Source),
+			"content": msg.Content,
+		}
+		if msg.Source == "tool" {
+			entry["tool_call_id"] = msg.ToolCallID
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// historyToClaude lifts system messages into the top-level system prompt, as
+// the Anthropic messages shape has no system role.
+func historyToClaude(history []Message) (string, []map[string]interface{}) {
+	var systemParts []string
+	out := make([]map[string]interface{}, 0, len(history))
+	for _, msg := range history {
+		role := historyRole(msg.Source)
+		if role == "system" {
+			systemParts = append(systemParts, msg.Content)
+			continue
+		}
+		if role == "tool" {
+			out = append(out, map[string]interface{}{
+				"role": "user",
+				"content": []map[string]interface{}{
+					{"type": "tool_result", "tool_use_id": msg.ToolCallID, "content": msg.Content},
+				},
+			})
+			continue
+		}
+		out = append(out, map[string]interface{}{
+			"role": role,
+			"content": []map[string]interface{}{
+				{"type": "text", "text": msg.Content},
+			},
+		})
+	}
+	return strings.Join(systemParts, "\n"), out
+}
+
+// adoptTranscript replaces the stored history with the client's transcript
+// when the two diverge, so stateless clients that resend the whole
+// conversation are honored. Stored user messages may carry the system prompt
+// prefix added by buildFinalQuery, so they match by suffix. The caller must
+// hold c.mu.
+func (c *Conversation) adoptTranscript(transcript []Message) bool {
+	if len(transcript) == 0 || transcriptMatches(c.History, transcript) {
+		return false
+	}
+	c.History = append([]Message(nil), transcript...)
+	c.Summary = ""
+	c.SummaryUpTo = 0
+	c.Dirty = true
+	return true
+}
+
+func transcriptMatches(history, transcript []Message) bool {
+	if len(history) != len(transcript) {
+		return false
+	}
+	for i, msg := range transcript {
+		stored := history[i]
+		if historyRole(stored.Source) != msg.Source {
+			return false
+		}
+		if stored.Content != msg.Content && !(msg.Source == "user" && strings.HasSuffix(stored.Content, msg.Content)) {
+			return false
+		}
+	}
+	return true
+}
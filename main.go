@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -26,33 +33,126 @@ func main() {
 		dbPath = defaultDBPath
 	}
 
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	store, err := NewStore(dbPath)
 	if err != nil {
 		panic(err)
 	}
 	defer store.Close()
+	if n := envInt("PRELOAD_CONVERSATIONS", 0); n > 0 {
+		loaded, err := store.Preload(n)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Preloaded %d conversations\n", loaded)
+	}
+
+	moderation, err := NewModerator(os.Getenv("MODERATION_RULES_FILE"))
+	if err != nil {
+		panic(err)
+	}
+
+	endpoint := os.Getenv("MIUI_ENDPOINT")
+	if endpoint == "" {
+		endpoint = miuiEndpoint
+	}
+	routes, err := LoadModelRoutes(os.Getenv("MODEL_ROUTES_FILE"), endpoint)
+	if err != nil {
+		panic(err)
+	}
+
+	prompts, err := LoadPromptTemplates(os.Getenv("SYSTEM_PROMPT_TEMPLATES_FILE"))
+	if err != nil {
+		panic(err)
+	}
+
+	queryTemplate, err := LoadQueryTemplate(os.Getenv("QUERY_TEMPLATE_FILE"), os.Getenv("QUERY_SEPARATOR"))
+	if err != nil {
+		panic(err)
+	}
 
-	server := NewServer(store, NewMiuiClient())
+	server := NewServer(store, NewMiuiClient(routes), moderation, prompts, queryTemplate)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", methodOnly(http.MethodGet, server.handleHealth))
 	mux.HandleFunc("/v1/models", methodOnly(http.MethodGet, server.handleModels))
 	mux.HandleFunc("/v1/chat/completions", methodOnly(http.MethodPost, server.handleChatCompletions))
+	mux.HandleFunc("/v1/completions", methodOnly(http.MethodPost, server.handleCompletions))
 	mux.HandleFunc("/v1/responses", methodOnly(http.MethodPost, server.handleResponses))
 	mux.HandleFunc("/v1/messages", methodOnly(http.MethodPost, server.handleClaudeMessages))
+	mux.HandleFunc("/v1/moderations", methodOnly(http.MethodPost, server.handleModerations))
+	mux.HandleFunc("/v1/whoami", methodOnly(http.MethodGet, server.handleWhoami))
+	mux.HandleFunc("/api/chat", methodOnly(http.MethodPost, server.handleOllamaChat))
+	mux.HandleFunc("/api/tags", methodOnly(http.MethodGet, server.handleOllamaTags))
+	mux.HandleFunc(geminiPathPrefix, methodOnly(http.MethodPost, server.handleGemini))
+	mux.HandleFunc(conversationsPathPrefix, methodOnly(http.MethodGet, server.handleConversations))
+	if server.adminToken != "" {
+		mux.HandleFunc("/admin/cache", methodOnly(http.MethodGet, server.adminOnly(server.handleAdminCache)))
+		mux.HandleFunc("/admin/cache/evict", methodOnly(http.MethodPost, server.adminOnly(server.handleAdminCacheEvict)))
+		mux.HandleFunc("/admin/replay", methodOnly(http.MethodPost, server.adminOnly(server.handleAdminReplay)))
+		mux.HandleFunc("/admin/users", methodOnly(http.MethodPost, server.adminOnly(server.handleAdminUsers)))
+		mux.HandleFunc("/admin/fingerprints/ban", methodOnly(http.MethodPost, server.adminOnly(server.handleAdminFingerprintBan)))
+	}
+	if envBool("METRICS", false) {
+		registerStoreMetrics(store)
+		mux.Handle("/metrics", promhttp.Handler())
+	}
 
+	proxies, err := parseTrustedProxies(splitList(os.Getenv("TRUSTED_PROXIES")))
+	if err != nil {
+		panic(err)
+	}
+	conns := newConnLimiter(envInt("MAX_CONNS_PER_IP", defaultMaxConnsPerIP), proxies)
+
+	gate := newShutdownGate(envInt("SHUTDOWN_RETRY_AFTER", defaultShutdownRetryAfter))
+	keys := newAPIKeys(splitList(os.Getenv("API_KEYS")))
+	limiter := newUserRateLimiter(envInt("RATE_LIMIT_RPM", 0), proxies)
+	ids := newRequestIDs(os.Getenv("REQUEST_ID_HEADER"))
 	httpServer := &http.Server{
 		Addr:              ":" + port,
-		Handler:           mux,
+		Handler:           ids.Handler(countRequests(gate.Handler(conns.Handler(traceRequests(recoverPanics(keys.Handler(limiter.Handler(mux)))))))),
 		ReadTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
 		WriteTimeout:      0,
 		IdleTimeout:       120 * time.Second,
 	}
 
-	fmt.Printf("Miui proxy server listening on :%s\n", port)
-	if err := httpServer.ListenAndServe(); err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Miui proxy server listening on :%s\n", port)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	// New requests now get a 503 with Retry-After; give load balancers a
+	// moment to notice before the listener goes away.
+	gate.Begin()
+	fmt.Println("Shutting down, draining in-flight requests")
+	time.Sleep(envDuration("SHUTDOWN_DRAIN_DELAY", defaultShutdownDrainDelay))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := gate.Wait(shutdownCtx); err != nil {
+		log.Printf("in-flight requests did not drain: %v", err)
 	}
 }
 
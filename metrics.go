@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dbCommitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "miui_db_commit_duration_seconds",
+	Help:    "Duration of SQLite transaction commits in the write loop.",
+	Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+})
+
+var fallbackResponses = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_fallback_responses_total",
+	Help: "Answers replaced by FALLBACK_RESPONSE after an upstream failure.",
+})
+
+var malformedChunks = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_malformed_stream_chunks_total",
+	Help: "Upstream data lines that were not valid JSON.",
+})
+
+var corruptHistoryRows = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_corrupt_history_total",
+	Help: "Stored conversation histories that failed to decode.",
+})
+
+var httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "miui_http_requests_total",
+	Help: "HTTP requests by endpoint and response status.",
+}, []string{"endpoint", "status"})
+
+var streamedBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_streamed_bytes_total",
+	Help: "Bytes written to clients in SSE and NDJSON streams.",
+})
+
+var upstreamDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "miui_upstream_request_duration_seconds",
+	Help:    "Duration of upstream chat calls, from request to the end of the answer.",
+	Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 20, 40, 60, 120, 300},
+})
+
+var upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "miui_upstream_errors_total",
+	Help: "Failed upstream chat calls by error type.",
+}, []string{"type"})
+
+var conversationsPersisted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_conversations_persisted_total",
+	Help: "Conversation writes queued for SQLite.",
+})
+
+var conversationsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "miui_conversations_evicted_total",
+	Help: "Conversations dropped from the in-memory cache.",
+})
+
+// registerStoreMetrics exposes gauges that read live Store state.
+func registerStoreMetrics(store *Store) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "miui_db_write_queue_depth",
+		Help: "Pending requests in the SQLite write queue.",
+	}, func() float64 {
+		return float64(store.Stats().WriteQueueDepth)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "miui_active_conversations",
+		Help: "Conversations held in the in-memory cache.",
+	}, func() float64 {
+		return float64(store.Stats().Conversations)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "miui_cached_users",
+		Help: "User identities held in the in-memory cache.",
+	}, func() float64 {
+		return float64(store.Stats().Users)
+	}))
+}
+
+// countRequests counts requests by endpoint and status, and the bytes sent
+// in streamed responses.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(metricsEndpoint(r.URL.Path), strconv.Itoa(status)).Inc()
+		contentType := rw.Header().Get("Content-Type")
+		if strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson") {
+			streamedBytes.Add(float64(rw.bytes))
+		}
+	})
+}
+
+// metricsEndpoint collapses paths carrying ids or model names into one label
+// value each, and unknown paths into "other", to bound label cardinality.
+func metricsEndpoint(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/v1/conversations/"):
+		return "/v1/conversations/{id}"
+	case isGeminiPath(path):
+		return geminiPathPrefix + "{model}"
+	}
+	switch path {
+	case "/v1/chat/completions", "/v1/completions", "/v1/responses", "/v1/messages",
+		"/v1/models", "/v1/moderations", "/v1/whoami", "/api/chat", "/api/tags",
+		"/health", "/metrics", "/admin/cache", "/admin/cache/evict", "/admin/replay",
+		"/admin/users", "/admin/fingerprints/ban":
+		return path
+	}
+	return "other"
+}
+
+// upstreamErrorType labels a failed upstream call for miui_upstream_errors_total.
+func upstreamErrorType(err error) string {
+	var upErr *UpstreamError
+	var rateErr *RateLimitError
+	var tooLarge *PayloadTooLargeError
+	switch {
+	case errors.As(err, &rateErr):
+		return "rate_limited"
+	case errors.As(err, &upErr):
+		return "status"
+	case errors.As(err, &tooLarge):
+		return "payload_too_large"
+	case errors.Is(err, errThinkingTimeout):
+		return "thinking_timeout"
+	case errors.Is(err, errMalformedChunk):
+		return "malformed_chunk"
+	case errors.Is(err, errStreamInterrupted):
+		return "interrupted"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
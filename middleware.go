@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// responseRecorder tracks whether headers have been sent so middleware can
+// tell a fresh response from a stream already in progress.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// bytes counts the body bytes written.
+	bytes int64
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = status
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(data []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(data)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends the headers, if not yet sent, and flushes the underlying writer.
+func (rw *responseRecorder) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := flusherOf(rw.ResponseWriter); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController and flusherOf reach the wrapped writer.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// flusherOf finds the http.Flusher behind w. Middleware writers that do not
+// flush themselves are looked through via Unwrap, as http.ResponseController
+// does, so wrapping a response never silently breaks streaming.
+func flusherOf(w http.ResponseWriter) (http.Flusher, bool) {
+	for {
+		if flusher, ok := w.(http.Flusher); ok {
+			return flusher, true
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+func isClaudePath(path string) bool {
+	return path == "/v1/messages"
+}
+
+func isGeminiPath(path string) bool {
+	return strings.HasPrefix(path, geminiPathPrefix)
+}
+
+func isOllamaPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// writeProtocolError answers with an error in the shape of the protocol the
+// path belongs to. claudeType and openAICode are the error type and code for
+// those protocols; Gemini derives its status from the HTTP status.
+func writeProtocolError(w http.ResponseWriter, path string, status int, msg, claudeType string, openAICode interface{}) {
+	switch {
+	case isClaudePath(path):
+		writeClaudeErrorType(w, status, claudeType, msg)
+	case isGeminiPath(path):
+		writeGeminiError(w, status, msg)
+	case isOllamaPath(path):
+		writeOllamaError(w, status, msg)
+	default:
+		writeOpenAIErrorCode(w, status, msg, openAICode)
+	}
+}
+
+// recoverPanics turns a handler panic into a protocol-shaped 500, or a
+// terminal error event when a stream has already started. Every protocol
+// the mux serves gets its own error shape.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			logf(r.Context(), "panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+
+			path := r.URL.Path
+			if !rw.wroteHeader {
+				writeProtocolError(rw, path, http.StatusInternalServerError, "internal_error", "api_error", nil)
+				return
+			}
+			// Streams are closed in the framing they were started with.
+			switch contentType := rw.Header().Get("Content-Type"); {
+			case strings.HasPrefix(contentType, "application/x-ndjson"):
+				switch {
+				case isClaudePath(path):
+					writeNDJSON(rw, newClaudeStreamError("internal_error"))
+				case isOllamaPath(path):
+					writeNDJSON(rw, map[string]interface{}{"error": "internal_error"})
+				default:
+					writeNDJSON(rw, newOpenAIStreamError("internal_error"))
+				}
+			case strings.HasPrefix(contentType, "text/event-stream"):
+				switch {
+				case isClaudePath(path):
+					writeSSEEvent(rw, "error", newClaudeStreamError("internal_error"))
+				case isGeminiPath(path):
+					writeSSEData(rw, newGeminiErrorBody(http.StatusInternalServerError, "internal_error"))
+				default:
+					writeSSEData(rw, newOpenAIStreamError("internal_error"))
+					writeSSELine(rw, "data: [DONE]\n\n")
+				}
+			default:
+				return
+			}
+			rw.Flush()
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
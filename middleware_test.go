@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanicsWritesProtocolError(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	for _, tc := range []struct {
+		path string
+		key  string
+	}{
+		{"/v1/chat/completions", "error"},
+		{"/v1/messages", "type"},
+		{"/api/chat", "error"},
+		{geminiPathPrefix + "DOUBAO:generateContent", "error"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.path, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v in %q", tc.path, err, rec.Body)
+		}
+		if rec.Code != http.StatusInternalServerError || body[tc.key] == nil {
+			t.Errorf("%s: %d %v, want a 500 error body", tc.path, rec.Code, body)
+		}
+	}
+}
+
+func TestRecoverPanicsPassesAbortHandler(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler re-panicked", rec)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// unwrapOnly wraps a writer without implementing http.Flusher itself.
+type unwrapOnly struct{ w http.ResponseWriter }
+
+func (u unwrapOnly) Header() http.Header         { return u.w.Header() }
+func (u unwrapOnly) Write(p []byte) (int, error) { return u.w.Write(p) }
+func (u unwrapOnly) WriteHeader(status int)      { u.w.WriteHeader(status) }
+func (u unwrapOnly) Unwrap() http.ResponseWriter { return u.w }
+
+func TestFlusherOfLooksThroughWrappers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	for _, w := range []http.ResponseWriter{
+		&responseRecorder{ResponseWriter: rec},
+		unwrapOnly{&responseRecorder{ResponseWriter: rec}},
+		&ndjsonFramer{ResponseWriter: unwrapOnly{rec}},
+	} {
+		flusher, ok := flusherOf(w)
+		if !ok {
+			t.Fatalf("%T: no flusher found", w)
+		}
+		rec.Flushed = false
+		flusher.Flush()
+		if !rec.Flushed {
+			t.Errorf("%T: Flush did not reach the recorder", w)
+		}
+	}
+	if _, ok := flusherOf(unwrapOnly{struct{ http.ResponseWriter }{rec}}); ok {
+		t.Error("found a flusher behind a writer that hides it")
+	}
+}
+
+// TestStreamingThroughMiddlewareChain wraps the chat handler in main's
+// middleware chain and reads the first chunk while the upstream is still
+// open, which only arrives if every layer forwards Flush.
+func TestStreamingThroughMiddlewareChain(t *testing.T) {
+	gone := make(chan struct{}, 1)
+	s := newTestServer(t, stallingUpstream(gone, "first"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	handler := newRequestIDs("").Handler(countRequests(newShutdownGate(defaultShutdownRetryAfter).Handler(
+		newConnLimiter(defaultMaxConnsPerIP, nil).Handler(traceRequests(recoverPanics(
+			newAPIKeys(nil).Handler(newUserRateLimiter(0, nil).Handler(mux))))))))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req := streamChatRequest("chain-user", "chain", "hi")
+	req.RequestURI = ""
+	req.URL, _ = url.Parse(srv.URL + "/v1/chat/completions")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	first := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "first") {
+				first <- true
+				return
+			}
+		}
+		first <- false
+	}()
+	select {
+	case ok := <-first:
+		if !ok {
+			t.Fatal("stream ended without the first chunk")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first chunk not flushed through the middleware chain")
+	}
+	resp.Body.Close()
+	<-gone
+}
+
+func TestRecoverPanicsKeepsServerUp(t *testing.T) {
+	logs := captureLog(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") != "" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			writeSSEData(w, map[string]string{"id": "started"})
+		}
+		var body map[string]interface{}
+		_ = body["messages"].([]interface{})
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+	srv := httptest.NewServer(recoverPanics(mux))
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, body := get("/v1/chat/completions")
+		if status != http.StatusInternalServerError || !strings.Contains(body, `"internal_error"`) {
+			t.Errorf("panic %d: %d %q", i, status, body)
+		}
+	}
+	status, body := get("/v1/chat/completions?stream=1")
+	if status != http.StatusOK || !strings.Contains(body, `"started"`) ||
+		!strings.Contains(body, "internal_error") || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("panic mid-stream: %d %q", status, body)
+	}
+	if status, body := get("/health"); status != http.StatusOK || !strings.Contains(body, "ok") {
+		t.Errorf("server did not stay up: %d %q", status, body)
+	}
+	if !strings.Contains(logs.String(), "panic serving GET /v1/chat/completions") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("panic not logged with a stack: %.200q", logs.String())
+	}
+}
@@ -7,20 +7,195 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/maphash"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const miuiEndpoint = "https://ai.search.miui.com/api/llm/browser/query"
+const (
+	miuiEndpoint = "https://ai.search.miui.com/api/llm/browser/query"
+
+	defaultMaxFrameChars          = 4096
+	defaultMaxHistoryMessages     = 40
+	defaultMaxBufferedAnswerChars = 1 << 20
+)
+
+var (
+	errThinkingTimeout   = errors.New("miui upstream thinking timeout")
+	errMalformedChunk    = errors.New("miui upstream sent a malformed chunk")
+	errAnswerLimit       = errors.New("miui answer reached its length limit")
+	errStreamInterrupted = errors.New("miui upstream stream interrupted")
+)
+
+// PayloadTooLargeError reports an upstream payload over maxPayloadBytes that
+// could not be shrunk by dropping history.
+type PayloadTooLargeError struct {
+	Bytes int
+	Limit int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("upstream payload is %d bytes, over the %d byte limit", e.Bytes, e.Limit)
+}
+
+// decodeBody unwraps a gzip-encoded response. The transport only does this
+// itself when it asked for compression, which an injecting proxy or the
+// upstream can ignore.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("miui upstream gzip body: %w", err)
+		}
+		return gz, nil
+	default:
+		return io.NopCloser(resp.Body), nil
+	}
+}
+
+// RateLimitError reports an upstream 429. RetryAfter is zero when the
+// upstream sent no usable Retry-After header.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("miui upstream rate limited, retry after %s", e.RetryAfter)
+	}
+	return "miui upstream rate limited"
+}
+
+// UnexpectedContentTypeError reports an upstream 200 whose body is not an
+// event stream, typically a WAF or captcha HTML interstitial.
+type UnexpectedContentTypeError struct {
+	ContentType string
+	Snippet     string
+}
+
+func (e *UnexpectedContentTypeError) Error() string {
+	return fmt.Sprintf("miui upstream returned %s instead of an event stream: %q", e.ContentType, e.Snippet)
+}
+
+// UpstreamError reports a non-200 upstream response other than 429. Body is
+// the start of the response body with anything token-like redacted.
+type UpstreamError struct {
+	Status int
+	Body   string
+}
+
+func (e *UpstreamError) Error() string {
+	msg := fmt.Sprintf("miui upstream http %d %s", e.Status, http.StatusText(e.Status))
+	if e.Body != "" {
+		msg += fmt.Sprintf(": %q", e.Body)
+	}
+	return msg
+}
+
+const upstreamErrorBodyBytes = 4096
+
+// Credentials an upstream error body may echo back: bearer tokens,
+// key/token/secret fields and long opaque strings.
+var (
+	bearerPattern      = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	secretFieldPattern = regexp.MustCompile(`(?i)((?:token|secret|password|api[_-]?key|authorization|oaid|mi_?id)["']?\s*[:=]\s*["']?)[^"'&,\s}]+`)
+	opaquePattern      = regexp.MustCompile(`[A-Za-z0-9_-]{32,}`)
+)
+
+// newUpstreamError reads the start of resp's body for diagnostics.
+func newUpstreamError(resp *http.Response) *UpstreamError {
+	upErr := &UpstreamError{Status: resp.StatusCode}
+	body, err := decodeBody(resp)
+	if err != nil {
+		return upErr
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(io.LimitReader(body, upstreamErrorBodyBytes))
+	if !utf8.Valid(data) {
+		data = bytes.ToValidUTF8(data, []byte("\uFFFD"))
+	}
+	upErr.Body = redactSecrets(strings.TrimSpace(string(data)))
+	return upErr
+}
+
+// redactSecrets masks anything in text that looks like a credential.
+func redactSecrets(text string) string {
+	text = bearerPattern.ReplaceAllString(text, "${1}[REDACTED]")
+	text = secretFieldPattern.ReplaceAllString(text, "${1}[REDACTED]")
+	return opaquePattern.ReplaceAllString(text, "[REDACTED]")
+}
+
+// streamContentTypes are the media types Chat parses as an answer stream.
+var streamContentTypes = map[string]bool{
+	"":                     true,
+	"text/event-stream":    true,
+	"text/plain":           true,
+	"application/json":     true,
+	"application/x-ndjson": true,
+}
+
+const contentTypeSnippetBytes = 256
 
 type MiuiClient struct {
 	httpClient *http.Client
 	headers    map[string]string
+	limiter    *upstreamLimiter
+	routes     *ModelRoutes
+
+	// thinkingTimeout bounds how long a deep-thinking request may wait for
+	// its first answer chunk; zero disables it.
+	thinkingTimeout time.Duration
+	// maxFrameChars splits oversized answer chunks into several onChunk
+	// calls so no single SSE frame exceeds it; zero disables splitting.
+	maxFrameChars int
+	// abortOnMalformed ends the stream with errMalformedChunk instead of
+	// skipping chunks that are not valid JSON (MALFORMED_CHUNK_POLICY=abort).
+	abortOnMalformed bool
+	// maxAnswerChars caps the accumulated answer; at the cap the upstream
+	// body is closed and Chat returns errAnswerLimit. Zero disables it.
+	maxAnswerChars int
+	// maxBufferedAnswerChars is the answer cap for calls without OnChunk,
+	// whose whole answer is held in memory; the lower of the two wins.
+	maxBufferedAnswerChars int
+	// maxHistoryTurns and thinkingHistoryTurns bound how many recent
+	// user/assistant turns are sent upstream for normal and deep-thinking
+	// requests. Zero means unlimited; thinking falls back to the normal limit.
+	maxHistoryTurns      int
+	thinkingHistoryTurns int
+	// maxHistoryMessages and maxHistoryBytes further bound the window by
+	// message count and by compressed size, dropping whole turns.
+	maxHistoryMessages int
+	maxHistoryBytes    int
+
+	// maxPayloadBytes bounds the marshaled upstream payload. Over it, Chat
+	// drops the oldest history turns when truncateOversized is set
+	// (OVERSIZED_PAYLOAD_POLICY=truncate) and fails otherwise.
+	maxPayloadBytes   int
+	truncateOversized bool
+
+	// doneMarkers end the stream when a data payload or event name matches
+	// one, ignoring case, spacing and brackets (UPSTREAM_DONE_MARKERS).
+	doneMarkers []string
+
+	health upstreamHealth
 }
 
-func NewMiuiClient() *MiuiClient {
+func NewMiuiClient(routes *ModelRoutes) *MiuiClient {
 	return &MiuiClient{
 		httpClient: &http.Client{
 			Timeout: 0,
@@ -36,21 +211,94 @@ func NewMiuiClient() *MiuiClient {
 		},
 		headers: map[string]string{
 			"sec-ch-ua-platform": `"Android"`,
-			"user-agent":         "Mozilla/5.0 (Linux; U; Android 11; zh-cn; M2012K11AC Build/RKQ1.200826.002) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/135.0.7049.79 Mobile Safari/537.36 XiaoMi/MiuiBrowser/20.11.1010115",
 			"accept":             "text/event-stream",
 			"content-type":       "application/json",
 			"origin":             "https://ai.search.miui.com",
 			"referer":            "https://ai.search.miui.com/browserAiSearch/?source=homepage",
 		},
+		limiter: newUpstreamLimiter(
+			envInt("UPSTREAM_MAX_CONCURRENCY", defaultUpstreamConcurrency),
+			envInt("UPSTREAM_LOW_REMAINING", defaultLowRemaining),
+		),
+		routes:          routes,
+		thinkingTimeout: envDuration("THINKING_TIMEOUT", 0),
+		maxFrameChars:   envInt("MAX_STREAM_FRAME_CHARS", defaultMaxFrameChars),
+
+		abortOnMalformed: strings.EqualFold(strings.TrimSpace(os.Getenv("MALFORMED_CHUNK_POLICY")), "abort"),
+		maxAnswerChars:   envInt("MAX_ANSWER_CHARS", 0),
+
+		maxBufferedAnswerChars: envInt("MAX_BUFFERED_ANSWER_CHARS", defaultMaxBufferedAnswerChars),
+
+		maxHistoryTurns:      envInt("MAX_HISTORY_TURNS", 0),
+		thinkingHistoryTurns: envInt("DEEP_THINKING_HISTORY_TURNS", 0),
+		maxHistoryMessages:   envInt("MAX_HISTORY_MESSAGES", defaultMaxHistoryMessages),
+		maxHistoryBytes:      envInt("MAX_HISTORY_BYTES", 0),
+
+		maxPayloadBytes:   envInt("MAX_UPSTREAM_PAYLOAD_BYTES", 0),
+		truncateOversized: strings.EqualFold(strings.TrimSpace(os.Getenv("OVERSIZED_PAYLOAD_POLICY")), "truncate"),
+
+		doneMarkers: parseDoneMarkers(os.Getenv("UPSTREAM_DONE_MARKERS")),
 	}
 }
 
 type miuiStreamChunk struct {
-	Answer        string `json:"answer"`
+	Answer string `json:"answer"`
+	// IntentionInfo.End closes the intention (thinking) phase, not the
+	// stream; the answer follows it.
 	IntentionInfo *struct {
 		IntentionText string `json:"intentionText"`
 		End           bool   `json:"end"`
 	} `json:"intentionInfo"`
+	// End and Finished are final-chunk flags; either ends the stream once
+	// the chunk's answer has been taken.
+	End      bool `json:"end"`
+	Finished bool `json:"finished"`
+	// References and Sources carry online-search citations; which of the
+	// two the upstream fills varies.
+	References []miuiReference `json:"references"`
+	Sources    []miuiReference `json:"sources"`
+}
+
+// parseDoneMarkers normalizes UPSTREAM_DONE_MARKERS, defaulting to [DONE].
+func parseDoneMarkers(val string) []string {
+	markers := splitList(val)
+	if len(markers) == 0 {
+		markers = []string{"[DONE]"}
+	}
+	for i, marker := range markers {
+		markers[i] = normalizeDoneMarker(marker)
+	}
+	return markers
+}
+
+// normalizeDoneMarker lower-cases s and drops whitespace and square
+// brackets, so "[DONE]", "[ done ]" and "done" compare equal.
+func normalizeDoneMarker(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '[' || r == ']' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+func (c *MiuiClient) isDoneMarker(s string) bool {
+	s = normalizeDoneMarker(s)
+	for _, marker := range c.doneMarkers {
+		if s == marker {
+			return true
+		}
+	}
+	return false
+}
+
+// sseField returns the value of an SSE line's field, matching the field
+// name case-insensitively.
+func sseField(line, field string) (string, bool) {
+	if len(line) <= len(field) || !strings.EqualFold(line[:len(field)], field) || line[len(field)] != ':' {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(field)+1:]), true
 }
 
 func compressHistory(history []Message) ([]int, error) {
@@ -95,13 +343,79 @@ type MiuiPayload struct {
 	IsUnLoginSystem  bool                   `json:"isUnLoginSystem"`
 	QuerySource      string                 `json:"querySource"`
 	IsDeepThinking   bool                   `json:"isDeepThinking,omitempty"`
+	// SearchDepth and SearchResults are passed through for online search;
+	// the upstream ignores fields it does not know.
+	SearchDepth   string `json:"searchDepth,omitempty"`
+	SearchResults int    `json:"searchResults,omitempty"`
+}
+
+// ChatOptions selects upstream behavior for a single Chat call.
+type ChatOptions struct {
+	// Model is the client-requested model name with flag suffixes stripped;
+	// it selects the upstream route.
+	Model        string
+	DeepThinking bool
+	OnlineSearch bool
+	OnChunk      func(string)
+	// OnQueued reports the queue position while waiting for an upstream slot.
+	OnQueued func(position int)
+	// MaxTokens caps the estimated answer tokens like maxAnswerChars caps
+	// characters. Zero disables it.
+	MaxTokens int
+	// OnReasoning receives the intention (thinking) text of deep-thinking
+	// requests, separately from the answer.
+	OnReasoning func(string)
+	// SearchDepth and SearchResults are sent only with OnlineSearch.
+	SearchDepth   string
+	SearchResults int
+	// OnCitations receives the online-search sources of each chunk that
+	// carries any.
+	OnCitations func([]Citation)
 }
 
-func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string, deepThinking, onlineSearch bool, onChunk func(string)) (string, error) {
-	rawHistory, err := compressHistory(conv.History)
+func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string, opts ChatOptions) (_ string, err error) {
+	deepThinking, onlineSearch, onChunk := opts.DeepThinking, opts.OnlineSearch, opts.OnChunk
+	route := c.routes.Resolve(opts.Model)
+	device := conv.device()
+	if device.ID == "" {
+		device = defaultDeviceProfile
+	}
+	history := c.historyWindow(conv.upstreamHistory(), deepThinking)
+
+	ctx, span := tracer.Start(ctx, "miui.Chat",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Bool("miui.deep_thinking", deepThinking),
+			attribute.Bool("miui.online_search", onlineSearch),
+			attribute.Int("miui.history_messages", len(history)),
+			attribute.String("miui.upstream_model", route.Model),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	// Calls the client gave up on, or that hit the stream duration cap, say
+	// nothing about the upstream.
+	parent := ctx
+	start := time.Now()
+	defer func() {
+		if parent.Err() != nil {
+			return
+		}
+		upstreamDuration.Observe(time.Since(start).Seconds())
+		if err != nil && !errors.Is(err, errAnswerLimit) {
+			upstreamErrors.WithLabelValues(upstreamErrorType(err)).Inc()
+		}
+		var tooLarge *PayloadTooLargeError
+		if !errors.As(err, &tooLarge) {
+			c.health.record(err)
+		}
+	}()
+
+	history, rawHistory, err := c.compressWindow(conv, history)
 	if err != nil {
 		return "", err
 	}
+	span.SetAttributes(attribute.Int("miui.history_bytes", len(rawHistory)))
 
 	payload := MiuiPayload{
 		Content:          query,
@@ -109,13 +423,13 @@ func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string,
 		ChatType:         "SUMMARY",
 		SearchID:         newSearchID(conv.OAID),
 		MiID:             conv.MiID,
-		Model:            "DOUBAO",
+		Model:            route.Model,
 		Business:         "BROWSER",
 		ConversationID:   conv.InternalID,
 		SupportVideo:     true,
-		AppVersionCode:   "201110100",
+		AppVersionCode:   device.AppVersionCode,
 		DeviceType:       "phone",
-		DeviceModel:      "M2012K11AC",
+		DeviceModel:      device.DeviceModel,
 		Scene:            "main",
 		RawLastQueryList: rawHistory,
 		OnlineSearch:     onlineSearch,
@@ -126,42 +440,126 @@ func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string,
 	if deepThinking {
 		payload.IsDeepThinking = true
 	}
+	if onlineSearch {
+		payload.SearchDepth = opts.SearchDepth
+		payload.SearchResults = opts.SearchResults
+	}
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return "", err
 	}
+	for c.maxPayloadBytes > 0 && len(body) > c.maxPayloadBytes {
+		if !c.truncateOversized || len(history) == 0 {
+			return "", &PayloadTooLargeError{Bytes: len(body), Limit: c.maxPayloadBytes}
+		}
+		history = dropOldestTurn(history)
+		if payload.RawLastQueryList, err = compressHistory(history); err != nil {
+			return "", err
+		}
+		if body, err = json.Marshal(payload); err != nil {
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, miuiEndpoint, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route.Endpoint, bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
 	for k, v := range c.headers {
 		req.Header.Set(k, v)
 	}
+	req.Header.Set("user-agent", device.UserAgent)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if err := c.limiter.Acquire(ctx, opts.OnQueued); err != nil {
+		return "", err
+	}
+	defer c.limiter.Release()
+
+	// The thinking phase lasts until the first answer chunk; intention-only
+	// chunks do not reset the timer.
+	var thinkingTimer *time.Timer
+	if deepThinking && c.thinkingTimeout > 0 {
+		thinkingTimer = time.AfterFunc(c.thinkingTimeout, func() { cancel(errThinkingTimeout) })
+		defer thinkingTimer.Stop()
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		if errors.Is(context.Cause(ctx), errThinkingTimeout) {
+			return "", errThinkingTimeout
+		}
 		return "", err
 	}
 	defer resp.Body.Close()
+	// Closing the body as soon as the request is cancelled unblocks a read
+	// waiting on a silent upstream and releases its connection, rather than
+	// leaving both to the transport.
+	defer context.AfterFunc(ctx, func() { resp.Body.Close() })()
 
+	c.limiter.Observe(resp.StatusCode, resp.Header)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := parseRetryAfter(resp.Header, time.Now())
+		return "", &RateLimitError{RetryAfter: retryAfter}
+	}
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("miui upstream http " + resp.Status)
+		return "", newUpstreamError(resp)
+	}
+	stream, err := decodeBody(resp)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !streamContentTypes[strings.ToLower(mediaType)] {
+		snippet, _ := io.ReadAll(io.LimitReader(stream, contentTypeSnippetBytes))
+		ctErr := &UnexpectedContentTypeError{ContentType: contentType, Snippet: strings.TrimSpace(string(snippet))}
+		logf(ctx, "%v", ctErr)
+		return "", ctErr
 	}
 
-	reader := bufio.NewReader(resp.Body)
+	reader := bufio.NewReader(stream)
+	answerLimit := c.maxAnswerChars
+	if onChunk == nil && c.maxBufferedAnswerChars > 0 && (answerLimit == 0 || c.maxBufferedAnswerChars < answerLimit) {
+		answerLimit = c.maxBufferedAnswerChars
+	}
 	var full strings.Builder
+	answerChars := 0
+	answerTokens := 0
 
 	for {
+		// A cancelled request normally fails the read below, but buffered
+		// lines would still be parsed without this check.
+		if ctx.Err() != nil {
+			if errors.Is(context.Cause(ctx), errThinkingTimeout) {
+				return full.String(), errThinkingTimeout
+			}
+			return full.String(), ctx.Err()
+		}
 		line, err := reader.ReadString('\n')
 		if err != nil && !errors.Is(err, io.EOF) {
-			return full.String(), err
+			if ctx.Err() != nil {
+				// The body was closed by the cancellation; report that
+				// rather than a broken stream.
+				continue
+			}
+			// A broken connection, unlike a clean EOF, is an error even
+			// when part of the answer already arrived.
+			return full.String(), fmt.Errorf("%w: %v", errStreamInterrupted, err)
 		}
 		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "data:") {
-			jsonStr := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-			if jsonStr == "[DONE]" {
+		if event, ok := sseField(line, "event"); ok && c.isDoneMarker(event) {
+			break
+		}
+		if jsonStr, ok := sseField(line, "data"); ok {
+			if c.isDoneMarker(jsonStr) {
 				break
 			}
 			var chunk miuiStreamChunk
@@ -169,18 +567,64 @@ func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string,
 				if errors.Is(err, io.EOF) {
 					break
 				}
-				if err == io.ErrUnexpectedEOF {
-					continue
+				malformedChunks.Inc()
+				logf(ctx, "malformed miui chunk (%d bytes): %v: %.120q", len(jsonStr), err, jsonStr)
+				if c.abortOnMalformed {
+					return full.String(), fmt.Errorf("%w: %v", errMalformedChunk, err)
 				}
-				// ignore malformed chunk
 				continue
 			}
+			if deepThinking && opts.OnReasoning != nil && chunk.IntentionInfo != nil && chunk.IntentionInfo.IntentionText != "" {
+				opts.OnReasoning(chunk.IntentionInfo.IntentionText)
+			}
+			if opts.OnCitations != nil {
+				if refs := append(chunk.References, chunk.Sources...); len(refs) > 0 {
+					citations := make([]Citation, len(refs))
+					for i, ref := range refs {
+						citations[i] = ref.citation()
+					}
+					opts.OnCitations(citations)
+				}
+			}
 			if chunk.Answer != "" {
-				full.WriteString(chunk.Answer)
-				if onChunk != nil {
-					onChunk(chunk.Answer)
+				if thinkingTimer != nil {
+					thinkingTimer.Stop()
+				}
+				answer := chunk.Answer
+				limited := false
+				if answerLimit > 0 {
+					n := utf8.RuneCountInString(answer)
+					if answerChars+n > answerLimit {
+						answer, _ = splitRunes(answer, answerLimit-answerChars)
+						limited = true
+					}
+					answerChars += n
+				}
+				if opts.MaxTokens > 0 {
+					kept, cut := truncateTokens(answer, opts.MaxTokens-answerTokens)
+					if cut {
+						answer = kept
+						limited = true
+					}
+					answerTokens += estimateTokens(answer)
+				}
+				full.WriteString(answer)
+				if onChunk != nil && answer != "" {
+					for _, part := range splitFrames(answer, c.maxFrameChars) {
+						onChunk(part)
+					}
+				}
+				if limited {
+					// Stop the upstream from generating further instead of
+					// reading and discarding the rest.
+					cancel(errAnswerLimit)
+					resp.Body.Close()
+					return full.String(), errAnswerLimit
 				}
 			}
+			if chunk.End || chunk.Finished {
+				break
+			}
 		}
 		if errors.Is(err, io.EOF) {
 			break
@@ -189,3 +633,99 @@ func (c *MiuiClient) Chat(ctx context.Context, conv *Conversation, query string,
 
 	return full.String(), nil
 }
+
+// historyWindow keeps the most recent turns allowed for the request mode and
+// maxHistoryMessages. A turn is a user message and the replies that follow
+// it; turns are never split.
+func (c *MiuiClient) historyWindow(history []Message, deepThinking bool) []Message {
+	turns := c.maxHistoryTurns
+	if deepThinking && c.thinkingHistoryTurns > 0 {
+		turns = c.thinkingHistoryTurns
+	}
+	if turns > 0 {
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Source != "user" {
+				continue
+			}
+			turns--
+			if turns == 0 {
+				history = history[i:]
+				break
+			}
+		}
+	}
+	for c.maxHistoryMessages > 0 && len(history) > c.maxHistoryMessages {
+		history = dropOldestTurn(history)
+	}
+	return history
+}
+
+// compressWindow compresses history for rawLastQueryList, dropping the oldest
+// turns while the result exceeds maxHistoryBytes. The result is cached on the
+// conversation, so a window that has not changed since the last request is
+// not compressed again; callers hold conv.mu, as for History.
+func (c *MiuiClient) compressWindow(conv *Conversation, history []Message) ([]Message, []int, error) {
+	key := hashHistory(history)
+	if cached := conv.rawHistory; cached.raw != nil && cached.key == key && cached.n <= len(history) {
+		return history[len(history)-cached.n:], cached.raw, nil
+	}
+	window := history
+	raw, err := compressHistory(window)
+	for err == nil && c.maxHistoryBytes > 0 && len(raw) > c.maxHistoryBytes && len(window) > 0 {
+		window = dropOldestTurn(window)
+		raw, err = compressHistory(window)
+	}
+	if err == nil {
+		conv.rawHistory = historyCache{key: key, n: len(window), raw: raw}
+	}
+	return window, raw, err
+}
+
+// historyCache is the compressed form of the last history window sent for a
+// conversation: key hashes the window before trimming to maxHistoryBytes, n
+// is how many of its trailing messages raw holds.
+type historyCache struct {
+	key uint64
+	n   int
+	raw []int
+}
+
+var historySeed = maphash.MakeSeed()
+
+// hashHistory fingerprints a history window without marshaling it.
+func hashHistory(history []Message) uint64 {
+	var h maphash.Hash
+	h.SetSeed(historySeed)
+	for _, msg := range history {
+		for _, field := range [...]string{msg.Source, msg.Content, msg.ToolCallID} {
+			_, _ = h.WriteString(field)
+			_ = h.WriteByte(0)
+		}
+	}
+	return h.Sum64()
+}
+
+// dropOldestTurn removes the first user message and the replies after it.
+func dropOldestTurn(history []Message) []Message {
+	for i := 1; i < len(history); i++ {
+		if history[i].Source == "user" {
+			return history[i:]
+		}
+	}
+	return nil
+}
+
+// splitFrames cuts text into pieces of at most n runes, never splitting a
+// multi-byte character.
+func splitFrames(text string, n int) []string {
+	if n <= 0 || len(text) <= n {
+		return []string{text}
+	}
+	var parts []string
+	for text != "" {
+		var part string
+		part, text = splitRunes(text, n)
+		parts = append(parts, part)
+	}
+	return parts
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// turnsHistory builds n user/assistant turns.
+func turnsHistory(n int) []Message {
+	history := make([]Message, 0, 2*n)
+	for i := 0; i < n; i++ {
+		history = append(history,
+			Message{Source: "user", Content: fmt.Sprintf("question %d: how does the cache behave here?", i)},
+			Message{Source: "assistant", Content: fmt.Sprintf("answer %d: it reuses the compressed window until history changes.", i)})
+	}
+	return history
+}
+
+func TestCompressWindowCache(t *testing.T) {
+	c := &MiuiClient{}
+	conv := &Conversation{}
+	history := turnsHistory(5)
+
+	_, first, err := c.compressWindow(conv, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := c.compressWindow(conv, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &first[0] != &second[0] {
+		t.Error("unchanged history was compressed again")
+	}
+
+	history = append(history, Message{Source: "user", Content: "one more"})
+	_, third, err := c.compressWindow(conv, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := compressHistory(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(third) != fmt.Sprint(want) {
+		t.Error("changed history was served from the stale cache")
+	}
+}
+
+func TestDropOldestTurn(t *testing.T) {
+	for _, tc := range []struct {
+		sources []string
+		want    int
+	}{
+		{[]string{"user", "assistant", "user", "assistant"}, 2},
+		{[]string{"user", "assistant", "tool", "assistant", "user"}, 1},
+		{[]string{"user", "assistant"}, 0},
+		{nil, 0},
+	} {
+		history := make([]Message, len(tc.sources))
+		for i, source := range tc.sources {
+			history[i] = Message{Source: source}
+		}
+		if got := dropOldestTurn(history); len(got) != tc.want {
+			t.Errorf("dropOldestTurn(%v) left %d messages, want %d", tc.sources, len(got), tc.want)
+		}
+	}
+}
+
+// BenchmarkCompressWindow compares repeated requests on an unchanged
+// 50-turn conversation with and without the cached compressed window.
+func BenchmarkCompressWindow(b *testing.B) {
+	c := &MiuiClient{}
+	history := turnsHistory(50)
+
+	b.Run("cached", func(b *testing.B) {
+		conv := &Conversation{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.compressWindow(conv, history); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		conv := &Conversation{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			conv.rawHistory = historyCache{}
+			if _, _, err := c.compressWindow(conv, history); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// newTestClient returns a client for upstream and a fresh conversation.
+func newTestClient(t *testing.T, upstream http.HandlerFunc) (*MiuiClient, *Conversation) {
+	t.Helper()
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	routes, err := LoadModelRoutes("", up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, err := newTestStore(t).GetConversation(context.Background(), "client-user", "client-conv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMiuiClient(routes), conv
+}
+
+// endlessUpstream writes chunk every 10ms until the client goes away, then
+// closes gone.
+func endlessUpstream(chunk string, gone chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer close(gone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func TestChatCancelClosesUpstream(t *testing.T) {
+	gone := make(chan struct{})
+	c, conv := newTestClient(t, endlessUpstream(`{"answer":"tick"}`, gone))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunks := 0
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Chat(ctx, conv, "hi", ChatOptions{OnChunk: func(string) {
+			if chunks++; chunks == 3 {
+				cancel()
+			}
+		}})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Chat returned %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Chat did not return after cancellation")
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not closed after cancellation")
+	}
+}
+
+func TestChatThinkingTimeout(t *testing.T) {
+	gone := make(chan struct{})
+	c, conv := newTestClient(t, endlessUpstream(`{"intentionInfo":{"intentionText":"thinking"}}`, gone))
+	c.thinkingTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Chat(context.Background(), conv, "hi", ChatOptions{DeepThinking: true, OnChunk: func(string) {}})
+	if !errors.Is(err, errThinkingTimeout) {
+		t.Fatalf("Chat returned %v, want errThinkingTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("thinking timeout fired after %v", elapsed)
+	}
+	<-gone
+}
+
+func TestChatThinkingTimeoutStopsAtFirstAnswer(t *testing.T) {
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"intentionInfo\":{\"intentionText\":\"thinking\",\"end\":true}}\n\n")
+		for i := 0; i < 5; i++ {
+			fmt.Fprint(w, "data: {\"answer\":\"a\"}\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	c.thinkingTimeout = 100 * time.Millisecond
+
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{DeepThinking: true, OnChunk: func(string) {}})
+	if err != nil {
+		t.Fatalf("answer streaming past the thinking timeout failed: %v", err)
+	}
+	if answer != "aaaaa" {
+		t.Errorf("answer = %q, want aaaaa", answer)
+	}
+}
+
+func TestChatSplitsGiantChunk(t *testing.T) {
+	giant := strings.Repeat("长", 2500) + strings.Repeat("x", 10)
+	c, conv := newTestClient(t, answerUpstream(giant))
+	c.maxFrameChars = 1000
+
+	var frames []string
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(part string) {
+		frames = append(frames, part)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != giant || strings.Join(frames, "") != giant {
+		t.Fatal("frames do not reassemble the chunk")
+	}
+	if len(frames) != 3 {
+		t.Errorf("%d frames, want 3", len(frames))
+	}
+	for i, frame := range frames {
+		if n := utf8.RuneCountInString(frame); n > 1000 || !utf8.ValidString(frame) {
+			t.Errorf("frame %d: %d runes, valid UTF-8 %v", i, n, utf8.ValidString(frame))
+		}
+	}
+}
+
+// counterValue reads the current value of a Prometheus counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func malformedUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "data: {\"answer\":\"Hel\"}\n\n")
+	fmt.Fprint(w, "data: {\"answer\":\"oops\n\n")
+	fmt.Fprint(w, "data: {\"answer\":\"lo\"}\n\n")
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func TestChatMalformedChunk(t *testing.T) {
+	c, conv := newTestClient(t, malformedUpstream)
+	before := counterValue(t, malformedChunks)
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(string) {}})
+	if err != nil || answer != "Hello" {
+		t.Fatalf("skip policy: answer %q, %v; want Hello", answer, err)
+	}
+	if got := counterValue(t, malformedChunks) - before; got != 1 {
+		t.Errorf("malformed chunk counter rose by %v, want 1", got)
+	}
+
+	c.abortOnMalformed = true
+	answer, err = c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(string) {}})
+	if !errors.Is(err, errMalformedChunk) || answer != "Hel" {
+		t.Errorf("abort policy: answer %q, %v; want Hel and errMalformedChunk", answer, err)
+	}
+	if got := counterValue(t, malformedChunks) - before; got != 2 {
+		t.Errorf("malformed chunk counter rose by %v, want 2", got)
+	}
+}
+
+func TestChatClosesUpstreamAtAnswerCap(t *testing.T) {
+	gone := make(chan struct{})
+	c, conv := newTestClient(t, endlessUpstream(`{"answer":"abcd"}`, gone))
+	c.maxAnswerChars = 10
+
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(string) {}})
+	if !errors.Is(err, errAnswerLimit) {
+		t.Fatalf("Chat returned %v, want errAnswerLimit", err)
+	}
+	if answer != "abcdabcdab" {
+		t.Errorf("answer = %q, want the first 10 characters", answer)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream body was not closed at the answer cap")
+	}
+}
+
+func TestChatAnswerExactlyAtCap(t *testing.T) {
+	c, conv := newTestClient(t, answerUpstream("abcd", "efghij"))
+	c.maxAnswerChars = 10
+
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(string) {}})
+	if err != nil || answer != "abcdefghij" {
+		t.Errorf("Chat = %q, %v; want the whole 10-character answer and no error", answer, err)
+	}
+}
+
+func TestHistoryWindowPerMode(t *testing.T) {
+	history := turnsHistory(6)
+	for _, tc := range []struct {
+		normal, thinking, messages int
+		deepThinking               bool
+		want                       int
+	}{
+		{0, 0, 0, false, 12},
+		{4, 2, 0, false, 8},
+		{4, 2, 0, true, 4},
+		{4, 0, 0, true, 8},
+		{0, 1, 0, false, 12},
+		{0, 1, 0, true, 2},
+		{4, 3, 4, true, 4},
+	} {
+		c := &MiuiClient{maxHistoryTurns: tc.normal, thinkingHistoryTurns: tc.thinking, maxHistoryMessages: tc.messages}
+		got := c.historyWindow(history, tc.deepThinking)
+		if len(got) != tc.want || (len(got) > 0 && got[0].Source != "user") ||
+			(len(got) > 0 && got[len(got)-1] != history[len(history)-1]) {
+			t.Errorf("%+v: window of %d messages starting %v, want the last %d", tc, len(got), got[0], tc.want)
+		}
+	}
+}
+
+func TestChatRejectsHTMLResponse(t *testing.T) {
+	page := "<html><body>Access denied by WAF" + strings.Repeat(".", 500) + "</body></html>"
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	})
+
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(string) {}})
+	var ctErr *UnexpectedContentTypeError
+	if !errors.As(err, &ctErr) {
+		t.Fatalf("Chat returned %q, %v; want an UnexpectedContentTypeError", answer, err)
+	}
+	if ctErr.ContentType != "text/html; charset=utf-8" || !strings.HasPrefix(ctErr.Snippet, "<html><body>Access denied") ||
+		len(ctErr.Snippet) > contentTypeSnippetBytes {
+		t.Errorf("error %+v, want the content type and a bounded snippet", ctErr)
+	}
+}
+
+func TestChatPayloadSizeGuard(t *testing.T) {
+	sizes := make(chan int, 4)
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sizes <- len(body)
+		answerUpstream("ok")(w, r)
+	})
+	conv.History = turnsHistory(40)
+	for i := range conv.History {
+		// Distinct content keeps gzip from shrinking the history away.
+		conv.History[i].Content += fmt.Sprintf(" %x", sha256.Sum256([]byte(fmt.Sprint(i))))
+	}
+	chat := func(query string) error {
+		conv.mu.Lock()
+		defer conv.mu.Unlock()
+		_, err := c.Chat(context.Background(), conv, query, ChatOptions{OnChunk: func(string) {}})
+		return err
+	}
+
+	if err := chat("hi"); err != nil {
+		t.Fatal(err)
+	}
+	full := <-sizes
+
+	c.maxPayloadBytes = full / 2
+	var tooLarge *PayloadTooLargeError
+	if err := chat("hi"); !errors.As(err, &tooLarge) || tooLarge.Bytes != full || tooLarge.Limit != full/2 {
+		t.Fatalf("over the limit: %v, want a PayloadTooLargeError for %d bytes", err, full)
+	}
+	select {
+	case <-sizes:
+		t.Fatal("oversized payload was sent upstream")
+	default:
+	}
+
+	c.truncateOversized = true
+	if err := chat("hi"); err != nil {
+		t.Fatalf("with truncation: %v", err)
+	}
+	if size := <-sizes; size > full/2 {
+		t.Errorf("truncated payload is %d bytes, over the %d limit", size, full/2)
+	}
+	if err := chat(strings.Repeat("q", full)); !errors.As(err, &tooLarge) {
+		t.Errorf("oversized query with truncation: %v, want a PayloadTooLargeError", err)
+	}
+}
+
+func TestHistoryWindowByteCap(t *testing.T) {
+	const limit = 2048
+	raws := make(chan int, 1)
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		raws <- len(payload.RawLastQueryList)
+		answerUpstream("ok")(w, r)
+	})
+	c.maxHistoryMessages = 0
+	c.maxHistoryBytes = limit
+	history := turnsHistory(100)
+	for i := range history {
+		history[i].Content += fmt.Sprintf(" %x", sha256.Sum256([]byte(fmt.Sprint(i))))
+	}
+
+	window, raw, err := c.compressWindow(conv, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) > limit || len(window) == 0 || len(window) == len(history) {
+		t.Fatalf("window of %d messages compresses to %d bytes, want a trimmed window under %d", len(window), len(raw), limit)
+	}
+	if window[0].Source != "user" || len(window)%2 != 0 || window[len(window)-1] != history[len(history)-1] {
+		t.Errorf("window of %d messages splits a turn or drops the newest", len(window))
+	}
+
+	conv.History = history
+	if _, err := c.Chat(context.Background(), conv, "hi", ChatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-raws; n == 0 || n > limit {
+		t.Errorf("upstream rawLastQueryList is %d bytes, want at most %d", n, limit)
+	}
+}
+
+func TestChatDecodesGzipStream(t *testing.T) {
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		for _, chunk := range []string{"你好", "，", "world"} {
+			fmt.Fprintf(gz, "data: {\"answer\":%q}\n\n", chunk)
+			gz.Flush()
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(gz, "data: [DONE]\n\n")
+		gz.Close()
+	})
+
+	var chunks []string
+	answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{OnChunk: func(part string) {
+		chunks = append(chunks, part)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "你好，world" || len(chunks) != 3 {
+		t.Errorf("answer %q in %d chunks, want the decoded stream in 3", answer, len(chunks))
+	}
+}
+
+func TestChatCapturesUpstreamErrorBody(t *testing.T) {
+	c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"code":40001,"msg":"invalid rawLastQueryList","token":"tok-123","auth":"Bearer abc.def"}`)
+		fmt.Fprint(w, strings.Repeat(" padding", upstreamErrorBodyBytes))
+	})
+
+	_, err := c.Chat(context.Background(), conv, "hi", ChatOptions{})
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) {
+		t.Fatalf("Chat returned %v, want an UpstreamError", err)
+	}
+	if upErr.Status != http.StatusBadRequest || !strings.Contains(upErr.Body, "invalid rawLastQueryList") {
+		t.Errorf("error %d %q lacks the upstream explanation", upErr.Status, upErr.Body)
+	}
+	// Redaction markers may grow the text a little; the read itself stops
+	// at the cap.
+	if len(upErr.Body) > upstreamErrorBodyBytes+64 {
+		t.Errorf("captured %d bytes, past the %d byte cap", len(upErr.Body), upstreamErrorBodyBytes)
+	}
+	if strings.Contains(upErr.Body, "tok-123") || strings.Contains(upErr.Body, "abc.def") {
+		t.Errorf("credentials not redacted: %q", upErr.Body)
+	}
+	if !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "invalid rawLastQueryList") {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"sent Bearer sk.live-123 twice", "sent Bearer [REDACTED] twice"},
+		{`{"api_key":"k1","oaid":"o2"}`, `{"api_key":"[REDACTED]","oaid":"[REDACTED]"}`},
+		{"id=" + strings.Repeat("a", 40), "id=[REDACTED]"},
+		{"plain message", "plain message"},
+	} {
+		if got := redactSecrets(tc.in); got != tc.want {
+			t.Errorf("redactSecrets(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestChatDoneMarkerFormats(t *testing.T) {
+	for _, tc := range []struct {
+		markers string
+		body    string
+		want    string
+	}{
+		{"", "data: [DONE]\n\n", "ok"},
+		{"", "data:[done]\n\n", "ok"},
+		{"", "DATA:   [ DONE ]  \n\n", "ok"},
+		{"", "event: done\ndata: {}\n\n", "ok"},
+		{"", `data: {"answer":"!","end":true}` + "\n\n", "ok!"},
+		{"", `data: {"finished":true}` + "\n\n", "ok"},
+		{"", `data: {"intentionInfo":{"end":true}}` + "\n\n" + `data: {"answer":" more"}` + "\n\ndata: [DONE]\n\n", "ok more"},
+		{"[END], stop", "data: [end]\n\n", "ok"},
+		{"[END], stop", "event: STOP\n\n", "ok"},
+	} {
+		gone := make(chan struct{})
+		c, conv := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			defer close(gone)
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, `data: {"answer":"ok"}`+"\n\n"+tc.body+`data: {"answer":" after"}`+"\n\n")
+			w.(http.Flusher).Flush()
+			// Hold the stream open: only the marker can end the read.
+			<-r.Context().Done()
+		})
+		if tc.markers != "" {
+			c.doneMarkers = parseDoneMarkers(tc.markers)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		got, err := c.Chat(ctx, conv, "hi", ChatOptions{})
+		cancel()
+		if err != nil || got != tc.want {
+			t.Errorf("%q: Chat = %q, %v; want %q", tc.body, got, err, tc.want)
+		}
+		<-gone
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// openAIModerationCategories are always present in moderation results so
+// clients that index the categories map do not hit missing keys.
+var openAIModerationCategories = []string{
+	"harassment",
+	"harassment/threatening",
+	"hate",
+	"hate/threatening",
+	"illicit",
+	"illicit/violent",
+	"self-harm",
+	"self-harm/intent",
+	"self-harm/instructions",
+	"sexual",
+	"sexual/minors",
+	"violence",
+	"violence/graphic",
+}
+
+type ModerationRule struct {
+	Category string
+	Pattern  *regexp.Regexp
+}
+
+type Moderator struct {
+	rules      []ModerationRule
+	categories []string
+}
+
+type ModerationResult struct {
+	Flagged    bool
+	Categories map[string]bool
+	Scores     map[string]float64
+}
+
+// NewModerator loads rules from a JSON file mapping category names to lists of
+// regular expressions. An empty path yields a moderator with no rules.
+func NewModerator(path string) (*Moderator, error) {
+	m := &Moderator{}
+	raw := map[string][]string{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("moderation rules %s: %w", path, err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, category := range openAIModerationCategories {
+		seen[category] = true
+		m.categories = append(m.categories, category)
+	}
+
+	custom := make([]string, 0, len(raw))
+	for category := range raw {
+		custom = append(custom, category)
+	}
+	sort.Strings(custom)
+
+	for _, category := range custom {
+		if !seen[category] {
+			seen[category] = true
+			m.categories = append(m.categories, category)
+		}
+		for _, pattern := range raw[category] {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("moderation rule %s %q: %w", category, pattern, err)
+			}
+			m.rules = append(m.rules, ModerationRule{Category: category, Pattern: re})
+		}
+	}
+	return m, nil
+}
+
+// Check runs every rule over text. Without a classifier, scores are binary:
+// 1 for a category with a matching rule, 0 otherwise.
+func (m *Moderator) Check(text string) ModerationResult {
+	result := ModerationResult{
+		Categories: make(map[string]bool, len(m.categories)),
+		Scores:     make(map[string]float64, len(m.categories)),
+	}
+	for _, category := range m.categories {
+		result.Categories[category] = false
+		result.Scores[category] = 0
+	}
+	for _, rule := range m.rules {
+		if result.Categories[rule.Category] {
+			continue
+		}
+		if rule.Pattern.MatchString(text) {
+			result.Categories[rule.Category] = true
+			result.Scores[rule.Category] = 1
+			result.Flagged = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestModerator(t *testing.T, rules string) *Moderator {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewModerator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestModerationsEndpoint(t *testing.T) {
+	s := &Server{moderation: newTestModerator(t, `{"violence":["(?i)\\bkill\\b"],"spam":["buy now"]}`)}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/moderations",
+		strings.NewReader(`{"input":["I will kill the process","hello there","buy now!"]}`))
+	rec := httptest.NewRecorder()
+	s.handleModerations(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Results []struct {
+			Flagged        bool               `json:"flagged"`
+			Categories     map[string]bool    `json:"categories"`
+			CategoryScores map[string]float64 `json:"category_scores"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.ID, "modr") || resp.Model != "omni-moderation-latest" || len(resp.Results) != 3 {
+		t.Fatalf("unexpected response shape: %s", rec.Body)
+	}
+
+	categories := append([]string{"spam"}, openAIModerationCategories...)
+	for i, want := range []string{"violence", "", "spam"} {
+		result := resp.Results[i]
+		if result.Flagged != (want != "") {
+			t.Errorf("result %d flagged = %v", i, result.Flagged)
+		}
+		for _, category := range categories {
+			flagged, ok := result.Categories[category]
+			score, scored := result.CategoryScores[category]
+			if !ok || !scored {
+				t.Fatalf("result %d is missing category %q", i, category)
+			}
+			if flagged != (category == want) || score != map[bool]float64{true: 1}[flagged] {
+				t.Errorf("result %d category %q = %v/%v", i, category, flagged, score)
+			}
+		}
+	}
+}
+
+func TestModerationsRejectsMissingInput(t *testing.T) {
+	s := &Server{moderation: newTestModerator(t, `{}`)}
+	for _, body := range []string{`{}`, `{"input":""}`, `{"input":[]}`, `not json`} {
+		rec := httptest.NewRecorder()
+		s.handleModerations(rec, httptest.NewRequest(http.MethodPost, "/v1/moderations", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
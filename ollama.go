@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleOllamaChat serves Ollama's POST /api/chat. Streams are NDJSON, one
+// message object per line, ending with a done object carrying the timings;
+// unlike the OpenAI endpoints, streaming is on unless "stream" is false.
+func (s *Server) handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, err := readJSONBody(r)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+
+	systemParts, userText, transcript := extractMessages(body["messages"])
+	if userText == "" {
+		writeOllamaError(w, http.StatusBadRequest, "missing_user_message")
+		return
+	}
+
+	opts := s.parseRequestOptions(body, r)
+	opts.Transcript = transcript
+	if _, ok := body["stream"]; !ok {
+		opts.Stream = true
+	}
+	if options, ok := body["options"].(map[string]interface{}); ok {
+		if n := getInt(options, "num_predict"); n > 0 {
+			opts.MaxTokens = n
+		}
+		opts.Stop = append(opts.Stop, parseStopSequences(options)...)
+	}
+	model, _ := body["model"].(string)
+	if model == "" {
+		model = opts.Model
+	}
+	model = s.responseModel(model, model)
+
+	turn, ok := s.beginTurn(w, r, systemParts, userText, opts)
+	if !ok {
+		return
+	}
+	defer turn.done()
+
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
+		if !ok {
+			return
+		}
+		defer sw.Close()
+
+		onChunk := func(text string) {
+			sw.Data(newOllamaMessage(model, text, false))
+		}
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(_ turnResult, f chatFailure) {
+			sw.Data(f.withRetryAfter(map[string]interface{}{"error": f.message}))
+		})
+		if !ok {
+			return
+		}
+		sw.Data(markFallback(newOllamaDone(model, "", res.err, res.usage, start), res.fallback))
+		return
+	}
+
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
+		return
+	}
+	writeJSON(w, newOllamaDone(model, res.full, res.err, res.usage, start))
+}
+
+// handleOllamaTags lists the model variants in Ollama's GET /api/tags shape.
+func (s *Server) handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	modified := time.Now().UTC().Format(time.RFC3339)
+	names := s.miui.routes.Models()
+	models := make([]map[string]interface{}, 0, len(names)*len(modelVariantSuffixes))
+	for _, base := range names {
+		family := strings.ToLower(base)
+		for _, suffix := range modelVariantSuffixes {
+			name := base + suffix
+			sum := sha256.Sum256([]byte(name))
+			models = append(models, map[string]interface{}{
+				"name":        name,
+				"model":       name,
+				"modified_at": modified,
+				"size":        0,
+				"digest":      hex.EncodeToString(sum[:]),
+				"details": map[string]interface{}{
+					"format":             "",
+					"family":             family,
+					"families":           []string{family},
+					"parameter_size":     "",
+					"quantization_level": "",
+				},
+			})
+		}
+	}
+	writeJSON(w, map[string]interface{}{"models": models})
+}
+
+func newOllamaMessage(model, content string, done bool) map[string]interface{} {
+	return map[string]interface{}{
+		"model":      model,
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"message": map[string]interface{}{
+			"role":    "assistant",
+			"content": content,
+		},
+		"done": done,
+	}
+}
+
+// newOllamaDone builds the terminal object. Only the total duration is
+// measured; the upstream reports no separate prompt and generation phases.
+func newOllamaDone(model, content string, err error, usage Usage, start time.Time) map[string]interface{} {
+	done := newOllamaMessage(model, content, true)
+	done["done_reason"] = "stop"
+	if truncated(err) {
+		done["done_reason"] = "length"
+	}
+	total := time.Since(start).Nanoseconds()
+	done["total_duration"] = total
+	done["load_duration"] = 0
+	done["prompt_eval_count"] = usage.PromptTokens
+	done["prompt_eval_duration"] = 0
+	done["eval_count"] = usage.CompletionTokens
+	done["eval_duration"] = total
+	return done
+}
+
+func writeNDJSON(w http.ResponseWriter, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	writeSSELine(w, string(data)+"\n")
+}
+
+func writeOllamaError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	data, _ := json.Marshal(withResponseRequestID(w, map[string]interface{}{"error": msg}))
+	_, _ = w.Write(data)
+}
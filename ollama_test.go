@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOllamaChatStreamsNDJSON(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chat",
+		strings.NewReader(`{"model":"DOUBAO","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer ollama-user")
+	rec := httptest.NewRecorder()
+	s.handleOllamaChat(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	var content strings.Builder
+	var last map[string]interface{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, ":") {
+			t.Fatalf("non-NDJSON line %q", line)
+		}
+		last = nil
+		if err := json.Unmarshal([]byte(line), &last); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if msg, ok := last["message"].(map[string]interface{}); ok {
+			content.WriteString(msg["content"].(string))
+		}
+	}
+	if content.String() != "Hello" {
+		t.Errorf("content = %q, want Hello", content.String())
+	}
+	if last["done"] != true || last["done_reason"] != "stop" {
+		t.Errorf("final object = %v, want done with done_reason stop", last)
+	}
+}
+
+func TestOllamaStoreErrorReportsCorruptHistory(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"corrupt", &CorruptHistoryError{ConversationID: "c1"}, "c1"},
+		{"other", errors.New("disk I/O error"), "store_error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeStoreError(rec, httptest.NewRequest(http.MethodPost, "/api/chat", nil), tc.err)
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusInternalServerError || !strings.Contains(body["error"], tc.want) {
+				t.Errorf("got %d %v, want 500 mentioning %q", rec.Code, body, tc.want)
+			}
+		})
+	}
+}
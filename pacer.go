@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+)
+
+const pacerTick = 50 * time.Millisecond
+
+// streamPacer smooths bursty upstream output by releasing text at no more than
+// rate runes per second. Buffered text is always released before Close returns
+// unless the client has gone away.
+type streamPacer struct {
+	ctx  context.Context
+	rate int
+	emit func(string)
+	in   chan string
+	done chan struct{}
+}
+
+func newStreamPacer(ctx context.Context, rate int, emit func(string)) *streamPacer {
+	p := &streamPacer{
+		ctx:  ctx,
+		rate: rate,
+		emit: emit,
+		in:   make(chan string, 1024),
+		done: make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *streamPacer) Write(text string) {
+	p.in <- text
+}
+
+// Close waits until every buffered chunk has been emitted.
+func (p *streamPacer) Close() {
+	close(p.in)
+	<-p.done
+}
+
+func (p *streamPacer) loop() {
+	defer close(p.done)
+
+	step := max(1, p.rate*int(pacerTick)/int(time.Second))
+	for text := range p.in {
+		for text != "" {
+			if p.ctx.Err() != nil {
+				break
+			}
+			part, rest := splitRunes(text, step)
+			text = rest
+			p.emit(part)
+
+			wait := time.Duration(utf8.RuneCountInString(part)) * time.Second / time.Duration(p.rate)
+			select {
+			case <-p.ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// splitRunes returns the first n runes of text and the remainder.
+func splitRunes(text string, n int) (string, string) {
+	i := 0
+	for count := 0; i < len(text) && count < n; count++ {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+	}
+	return text[:i], text[i:]
+}
+
+// paceChunks wraps onChunk with the configured output pacer. The returned
+// drain function must run before any terminal events are written.
+func (s *Server) paceChunks(ctx context.Context, onChunk func(string)) (func(string), func()) {
+	if s.streamCharsPerSec <= 0 {
+		return onChunk, func() {}
+	}
+	pacer := newStreamPacer(ctx, s.streamCharsPerSec, onChunk)
+	return pacer.Write, pacer.Close
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestStreamPacerPacesBursts(t *testing.T) {
+	const rate = 400 // runes per second: 20 per tick
+	var parts []string
+	var at []time.Time
+	p := newStreamPacer(context.Background(), rate, func(part string) {
+		parts = append(parts, part)
+		at = append(at, time.Now())
+	})
+
+	burst := strings.Repeat("字", 200)
+	start := time.Now()
+	p.Write(burst)
+	p.Close()
+	elapsed := time.Since(start)
+
+	if got := strings.Join(parts, ""); got != burst {
+		t.Fatalf("emitted %d runes, want the whole burst", utf8.RuneCountInString(got))
+	}
+	for i, part := range parts {
+		if n := utf8.RuneCountInString(part); n > 20 {
+			t.Fatalf("part %d has %d runes, want at most one tick's worth", i, n)
+		}
+	}
+	// 200 runes at 400/s take 500ms; allow scheduling slack either way.
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("burst drained in %v, want about 500ms", elapsed)
+	}
+	if spread := at[len(at)-1].Sub(at[0]); spread < 350*time.Millisecond {
+		t.Errorf("parts emitted within %v, want them spread out", spread)
+	}
+}
+
+func TestStreamPacerStopsWhenClientGoes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	emitted := 0
+	p := newStreamPacer(ctx, 100, func(part string) {
+		emitted += utf8.RuneCountInString(part)
+		cancel()
+	})
+	p.Write(strings.Repeat("a", 1000))
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked after the client went away")
+	}
+	if emitted >= 1000 {
+		t.Error("pacer kept emitting after cancellation")
+	}
+}
+
+func TestSplitRunes(t *testing.T) {
+	for _, tc := range []struct {
+		text       string
+		n          int
+		head, tail string
+	}{
+		{"hello", 2, "he", "llo"},
+		{"你好世界", 3, "你好世", "界"},
+		{"ab", 5, "ab", ""},
+		{"", 3, "", ""},
+	} {
+		head, tail := splitRunes(tc.text, tc.n)
+		if head != tc.head || tail != tc.tail {
+			t.Errorf("splitRunes(%q, %d) = %q, %q; want %q, %q", tc.text, tc.n, head, tail, tc.head, tc.tail)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PromptTemplates holds default system instructions keyed by client model
+// name and by the -thinking/-search flags. Matching templates are prepended
+// to the client's own system prompt.
+type PromptTemplates struct {
+	models   map[string]string
+	thinking string
+	search   string
+}
+
+type promptTemplatesFile struct {
+	Models   map[string]string `json:"models"`
+	Thinking string            `json:"thinking"`
+	Search   string            `json:"search"`
+}
+
+// LoadPromptTemplates reads {"models": {name: prompt}, "thinking": prompt,
+// "search": prompt}. An empty path yields templates that never apply.
+func LoadPromptTemplates(path string) (*PromptTemplates, error) {
+	pt := &PromptTemplates{models: map[string]string{}}
+	if path == "" {
+		return pt, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw promptTemplatesFile
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("system prompt templates %s: %w", path, err)
+	}
+	for name, prompt := range raw.Models {
+		pt.models[strings.ToLower(name)] = strings.TrimSpace(prompt)
+	}
+	pt.thinking = strings.TrimSpace(raw.Thinking)
+	pt.search = strings.TrimSpace(raw.Search)
+	return pt, nil
+}
+
+// Apply prepends the model template, then the flag templates, to the
+// client's system prompt.
+func (pt *PromptTemplates) Apply(opts RequestOptions, systemPrompt string) string {
+	if pt == nil {
+		return systemPrompt
+	}
+	var parts []string
+	if prompt := pt.models[strings.ToLower(opts.RequestedModel)]; prompt != "" {
+		parts = append(parts, prompt)
+	}
+	if opts.DeepThinking && pt.thinking != "" {
+		parts = append(parts, pt.thinking)
+	}
+	if opts.OnlineSearch && pt.search != "" {
+		parts = append(parts, pt.search)
+	}
+	if len(parts) == 0 {
+		return systemPrompt
+	}
+	if systemPrompt != "" {
+		parts = append(parts, systemPrompt)
+	}
+	return strings.Join(parts, "\n\n")
+}
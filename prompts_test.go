@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPromptTemplatesApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.json")
+	if err := os.WriteFile(path, []byte(`{
+		"models": {"Coder": " You write code. "},
+		"thinking": "Think step by step.",
+		"search": "Cite sources."
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pt, err := LoadPromptTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		opts   RequestOptions
+		system string
+		want   string
+	}{
+		{"plain", RequestOptions{RequestedModel: "DOUBAO"}, "be brief", "be brief"},
+		{"model", RequestOptions{RequestedModel: "coder"}, "", "You write code."},
+		{"model and client", RequestOptions{RequestedModel: "CODER"}, "be brief", "You write code.\n\nbe brief"},
+		{"thinking", RequestOptions{RequestedModel: "DOUBAO", DeepThinking: true}, "", "Think step by step."},
+		{"all", RequestOptions{RequestedModel: "coder", DeepThinking: true, OnlineSearch: true}, "be brief",
+			"You write code.\n\nThink step by step.\n\nCite sources.\n\nbe brief"},
+	} {
+		if got := pt.Apply(tc.opts, tc.system); got != tc.want {
+			t.Errorf("%s: Apply = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	var none *PromptTemplates
+	if got := none.Apply(RequestOptions{DeepThinking: true}, "be brief"); got != "be brief" {
+		t.Errorf("nil templates changed the prompt to %q", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultQuerySeparator joins the system prompt and the user text in the
+// default query layout.
+const defaultQuerySeparator = "\n\n用户输入："
+
+// QueryTemplate renders the upstream query from QUERY_TEMPLATE_FILE, or in
+// buildFinalQuery's "system + separator + user" layout without one. The
+// separator is QUERY_SEPARATOR.
+type QueryTemplate struct {
+	tmpl      *template.Template
+	separator string
+}
+
+// queryContext is the data a query template is executed with.
+type queryContext struct {
+	User      string
+	Date      string
+	System    string
+	TurnCount int
+	History   []Message
+}
+
+// LoadQueryTemplate parses the template at path and test-renders it so
+// unknown fields fail at startup rather than on the first request. An empty
+// path keeps the default layout, joined with separator; \n and \t in the
+// separator stand for a newline and a tab, since environment values rarely
+// hold them literally. An empty separator keeps defaultQuerySeparator.
+func LoadQueryTemplate(path, separator string) (*QueryTemplate, error) {
+	separator = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(separator)
+	if path == "" {
+		return &QueryTemplate{separator: separator}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("query template %s: %w", path, err)
+	}
+	sample := queryContext{
+		User:    "hello",
+		Date:    time.Now().Format("2006-01-02"),
+		System:  "system",
+		History: []Message{{Source: "user", Content: "hi"}, {Source: "assistant", Content: "hello"}},
+	}
+	if err := tmpl.Execute(new(strings.Builder), sample); err != nil {
+		return nil, fmt.Errorf("query template %s: %w", path, err)
+	}
+	return &QueryTemplate{tmpl: tmpl, separator: separator}, nil
+}
+
+// Build renders the query for userText on conv. Without a template, or when
+// it fails to execute, it falls back to buildFinalQuery.
+func (qt *QueryTemplate) Build(conv *Conversation, systemPrompt, userText string) string {
+	if qt == nil || qt.tmpl == nil {
+		return buildFinalQuery(systemPrompt, qt.querySeparator(), userText)
+	}
+
+	conv.mu.Lock()
+	data := queryContext{
+		User:    userText,
+		Date:    time.Now().Format("2006-01-02"),
+		System:  systemPrompt,
+		History: append([]Message(nil), conv.History...),
+	}
+	conv.mu.Unlock()
+	for _, msg := range data.History {
+		if msg.Source == "user" {
+			data.TurnCount++
+		}
+	}
+
+	var out strings.Builder
+	if err := qt.tmpl.Execute(&out, data); err != nil {
+		log.Printf("query template for %s|%s: %v", conv.UserKey, conv.ConversationID, err)
+		return buildFinalQuery(systemPrompt, qt.querySeparator(), userText)
+	}
+	return out.String()
+}
+
+func (qt *QueryTemplate) querySeparator() string {
+	if qt == nil || qt.separator == "" {
+		return defaultQuerySeparator
+	}
+	return qt.separator
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeQueryTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "query.tmpl")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestQueryTemplateBuild(t *testing.T) {
+	qt, err := LoadQueryTemplate(writeQueryTemplate(t,
+		`[{{.Date}}] turn {{.TurnCount}}{{range .History}} {{.Source}}:{{.Content}}{{end}}
+{{.System}} | {{.User}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &Conversation{History: turnsHistory(2)[:3]}
+	got := qt.Build(conv, "be brief", "what now?")
+	want := "[" + time.Now().Format("2006-01-02") + "] turn 2" +
+		" user:" + conv.History[0].Content + " assistant:" + conv.History[1].Content + " user:" + conv.History[2].Content +
+		"\nbe brief | what now?"
+	if got != want {
+		t.Errorf("Build =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestQueryTemplateDefaultLayout(t *testing.T) {
+	conv := &Conversation{}
+	for _, tc := range []struct {
+		separator, system, want string
+	}{
+		{"", "be brief", "be brief" + defaultQuerySeparator + "hi"},
+		{`\n---\n`, "be brief", "be brief\n---\nhi"},
+		{`\n---\n`, "", "hi"},
+	} {
+		qt, err := LoadQueryTemplate("", tc.separator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := qt.Build(conv, tc.system, "hi"); got != tc.want {
+			t.Errorf("separator %q: Build = %q, want %q", tc.separator, got, tc.want)
+		}
+	}
+	var qt *QueryTemplate
+	if got := qt.Build(conv, "be brief", "hi"); got != "be brief"+defaultQuerySeparator+"hi" {
+		t.Errorf("nil template: Build = %q", got)
+	}
+}
+
+func TestLoadQueryTemplateValidates(t *testing.T) {
+	for _, text := range []string{`{{.User`, `{{.Unknown}}`, `{{index .History 5}}`} {
+		if _, err := LoadQueryTemplate(writeQueryTemplate(t, text), ""); err == nil || !strings.Contains(err.Error(), "query template") {
+			t.Errorf("%q: err = %v, want a load-time template error", text, err)
+		}
+	}
+	if _, err := LoadQueryTemplate(filepath.Join(t.TempDir(), "missing.tmpl"), ""); err == nil {
+		t.Error("missing template file loaded")
+	}
+}
+
+func TestQueryTemplateOutputIsCapped(t *testing.T) {
+	padding := strings.Repeat("Context line. ", 50)
+	qt, err := LoadQueryTemplate(writeQueryTemplate(t, padding+"{{.User}}"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	s.queryTemplate = qt
+
+	// The user text alone fits; the rendered query does not, so nothing may
+	// go upstream.
+	s.maxContextTokens = 50
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("template-user", "capped", "hi"))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "context_length_exceeded") {
+		t.Errorf("status %d: %s; want 400 context_length_exceeded", rec.Code, rec.Body)
+	}
+	select {
+	case q := <-queries:
+		t.Errorf("over-limit query went upstream: %q", q)
+	default:
+	}
+
+	s.maxContextTokens = 1000
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("template-user", "capped", "hi"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; q != padding+"hi" {
+		t.Errorf("upstream query %q, want the rendered template", q)
+	}
+}
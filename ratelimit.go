@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userRateLimiter is a token bucket per user (RATE_LIMIT_RPM). Buckets refill
+// continuously at rpm per minute up to a burst of rpm. Buckets that have
+// refilled completely hold no state worth keeping and are swept from the map
+// at most once a minute.
+type userRateLimiter struct {
+	mu        sync.Mutex
+	rpm       int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	proxies   trustedProxies
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const rateLimitSweepInterval = time.Minute
+
+func newUserRateLimiter(rpm int, proxies trustedProxies) *userRateLimiter {
+	return &userRateLimiter{
+		rpm:     rpm,
+		buckets: make(map[string]*tokenBucket),
+		proxies: proxies,
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token.
+func (l *userRateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.rpm), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		perToken := time.Minute / time.Duration(l.rpm)
+		return false, time.Duration(math.Ceil((1 - b.tokens) * float64(perToken)))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *userRateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Minutes()*float64(l.rpm)
+	return math.Min(tokens, float64(l.rpm))
+}
+
+// sweep drops full buckets; a new bucket would start full anyway.
+func (l *userRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.rpm) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Handler answers 429 with Retry-After in the caller's protocol once the
+// user is over the limit. Users are keyed like the conversation store keys
+// them; requests without credentials, which get a fresh user each time, are
+// keyed by client IP instead. Health, metrics and admin endpoints are exempt,
+// and a non-positive limit disables the check.
+func (l *userRateLimiter) Handler(next http.Handler) http.Handler {
+	if l.rpm <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/health" || path == "/metrics" || strings.HasPrefix(path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := presentedKey(r)
+		if key == "" {
+			key = "ip:" + l.proxies.clientIP(r)
+		}
+		ok, retryAfter := l.allow(key)
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeRetryAfter(w, retryAfter)
+		writeProtocolError(w, path, http.StatusTooManyRequests, "rate limit exceeded", "rate_limit_error", "rate_limit_exceeded")
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserRateLimitConcurrent(t *testing.T) {
+	const limit, n = 5, 20
+	handler := newUserRateLimiter(limit, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req.Header.Set("Authorization", "Bearer limited-user")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code == http.StatusTooManyRequests {
+				if secs, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || secs < 1 {
+					t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+				}
+			}
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if statuses[http.StatusOK] != limit || statuses[http.StatusTooManyRequests] != n-limit {
+		t.Errorf("statuses = %v, want %d OK and %d rejected", statuses, limit, n-limit)
+	}
+
+	// Another user has a bucket of their own, and admin paths are exempt.
+	for _, tc := range []struct{ path, key string }{
+		{"/v1/chat/completions", "Bearer other-user"},
+		{"/admin/cache", "Bearer limited-user"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		req.Header.Set("Authorization", tc.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s as %s: %d", tc.path, tc.key, rec.Code)
+		}
+	}
+}
+
+func TestUserRateLimitRefillAndSweep(t *testing.T) {
+	l := newUserRateLimiter(60, nil)
+	for i := 0; i < 60; i++ {
+		if ok, _ := l.allow("u"); !ok {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	ok, wait := l.allow("u")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("empty bucket: ok %v wait %v, want a refusal under a second", ok, wait)
+	}
+
+	l.mu.Lock()
+	l.buckets["u"].last = time.Now().Add(-2 * time.Minute)
+	l.lastSweep = time.Time{}
+	l.mu.Unlock()
+	if ok, _ := l.allow("v"); !ok {
+		t.Fatal("fresh user refused")
+	}
+	l.mu.Lock()
+	_, resident := l.buckets["u"]
+	l.mu.Unlock()
+	if resident {
+		t.Error("a refilled bucket survived the sweep")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	maxRequestIDLen        = 128
+)
+
+type requestIDKey struct{}
+
+// requestIDHeader is the header requestIDs.Handler sets on responses. Error
+// writers, which only see the ResponseWriter, read the ID back from it.
+var requestIDHeader = defaultRequestIDHeader
+
+// requestIDs reads a caller-supplied request ID, or mints one, and echoes it
+// back so a request can be followed from the client through the logs.
+type requestIDs struct {
+	header string
+}
+
+func newRequestIDs(header string) *requestIDs {
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	requestIDHeader = textproto.CanonicalMIMEHeaderKey(header)
+	return &requestIDs{header: requestIDHeader}
+}
+
+func (ids *requestIDs) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(ids.header)
+		if !validRequestID(id) {
+			id = newID("req")
+		}
+		w.Header().Set(ids.header, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts short printable ASCII IDs so a client cannot inject
+// newlines or arbitrary bytes into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID attached by requestIDs.Handler, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withResponseRequestID adds the request ID already set on w to an error
+// body as "request_id", so clients that only keep the body can quote it.
+func withResponseRequestID(w http.ResponseWriter, body map[string]interface{}) map[string]interface{} {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
+
+// logf is log.Printf prefixed with the request ID carried by ctx, if any.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		log.Printf("[%s] %s", id, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the standard logger into a buffer for the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestRequestIDEchoedAndLogged(t *testing.T) {
+	logs := captureLog(t)
+	handler := newRequestIDs("").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logf(r.Context(), "handling %s", r.URL.Path)
+	}))
+
+	for _, tc := range []struct {
+		sent     string
+		want     string
+		generate bool
+	}{
+		{"client-abc-123", "client-abc-123", false},
+		{"", "", true},
+		{"bad id\nwith newline", "", true},
+		{strings.Repeat("x", maxRequestIDLen+1), "", true},
+	} {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if tc.sent != "" {
+			req.Header.Set("X-Request-Id", tc.sent)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		id := rec.Header().Get("X-Request-Id")
+		if tc.generate && (!strings.HasPrefix(id, "req") || id == tc.sent) {
+			t.Errorf("sent %.20q: echoed %q, want a generated ID", tc.sent, id)
+		}
+		if !tc.generate && id != tc.want {
+			t.Errorf("sent %q: echoed %q", tc.sent, id)
+		}
+		if got := logs.String(); got != "["+id+"] handling /v1/models\n" {
+			t.Errorf("sent %.20q: log %q does not carry the echoed ID %q", tc.sent, got, id)
+		}
+	}
+}
+
+func TestRequestIDInErrorBodies(t *testing.T) {
+	s := newTestServer(t, failingUpstream)
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/v1/chat/completions", s.handleChatCompletions, `{"model":"DOUBAO","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages", s.handleClaudeMessages, `{"model":"DOUBAO","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/chat/completions", s.handleChatCompletions, `not json`},
+	} {
+		for _, sent := range []string{"support-ticket-42", ""} {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer request-id-user")
+			if sent != "" {
+				req.Header.Set("X-Request-Id", sent)
+			}
+			rec := httptest.NewRecorder()
+			newRequestIDs("").Handler(tc.handler).ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Request-Id")
+			if id == "" || (sent != "" && id != sent) {
+				t.Errorf("%s sent %q: header %q", tc.path, sent, id)
+			}
+			var body struct {
+				RequestID string `json:"request_id"`
+			}
+			if rec.Code < 400 || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.RequestID != id {
+				t.Errorf("%s %s: %d %s, want request_id %q in the error body", tc.path, tc.body, rec.Code, rec.Body, id)
+			}
+		}
+	}
+}
+
+func TestRequestIDCustomHeader(t *testing.T) {
+	t.Cleanup(func() { newRequestIDs("") })
+	handler := newRequestIDs("x-correlation-id").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeOpenAIError(w, http.StatusBadRequest, "bad")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("X-Correlation-Id", "corr-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Correlation-Id"); got != "corr-1" || !strings.Contains(rec.Body.String(), `"request_id":"corr-1"`) {
+		t.Errorf("header %q body %s", got, rec.Body)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "strings"
+
+// parseFieldMap parses comma-separated from=to pairs such as
+// "gpt-4o=gpt-4o-2024-08-06,chat.completion=chat.completion". Entries
+// without both sides are dropped.
+func parseFieldMap(val string) map[string]string {
+	out := make(map[string]string)
+	for _, item := range splitList(val) {
+		from, to, ok := strings.Cut(item, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			continue
+		}
+		out[from] = to
+	}
+	return out
+}
+
+// responseModel is the model name echoed to the client. MODEL_ALIASES maps
+// the requested name, compared case-insensitively, to the name to echo; a
+// "*" entry applies to every other request. Otherwise the requested name is
+// echoed verbatim, flag suffixes included, or def (the upstream model) when
+// the request named none or ECHO_REQUESTED_MODEL is off. The upstream route
+// is chosen from the request as before, so this only changes what clients
+// see.
+func (s *Server) responseModel(requested any, def string) string {
+	name, _ := requested.(string)
+	if alias, ok := s.modelAliases[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return alias
+	}
+	if alias, ok := s.modelAliases["*"]; ok {
+		return alias
+	}
+	if s.echoRequestedModel && name != "" {
+		return name
+	}
+	return def
+}
+
+// objectType returns the RESPONSE_OBJECT_TYPES override for a spec object
+// value such as "chat.completion.chunk", or the value itself.
+func (s *Server) objectType(object string) string {
+	if override, ok := s.objectTypes[object]; ok {
+		return override
+	}
+	return object
+}
+
+// withObjectType applies objectType to a payload's "object" field.
+func (s *Server) withObjectType(resp map[string]interface{}) map[string]interface{} {
+	if object, ok := resp["object"].(string); ok {
+		resp["object"] = s.objectType(object)
+	}
+	return resp
+}
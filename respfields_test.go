@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestModelAliasInResponse(t *testing.T) {
+	models := make(chan string, 4)
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		models <- payload.Model
+		answerUpstream("ok")(w, r)
+	})
+	send := func(stream bool) *httptest.ResponseRecorder {
+		req := chatRequest("alias-user", "alias", "hi")
+		if stream {
+			req = streamChatRequest("alias-user", "alias", "hi")
+		}
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	send(false)
+	canonical := <-models
+
+	s.modelAliases = map[string]string{"doubao": "gpt-4o-2024-08-06"}
+	s.objectTypes = map[string]string{"chat.completion": "chat.completion.v1"}
+	var resp struct {
+		Model  string `json:"model"`
+		Object string `json:"object"`
+	}
+	if err := json.Unmarshal(send(false).Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "gpt-4o-2024-08-06" || resp.Object != "chat.completion.v1" {
+		t.Errorf("response model %q object %q", resp.Model, resp.Object)
+	}
+	if got := <-models; got != canonical {
+		t.Errorf("upstream saw model %q with the alias, %q without", got, canonical)
+	}
+
+	for _, data := range sseData(send(true).Body.String()) {
+		if data == "[DONE]" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Model != "gpt-4o-2024-08-06" || resp.Object != "chat.completion.chunk" {
+			t.Errorf("stream chunk model %q object %q", resp.Model, resp.Object)
+		}
+	}
+	<-models
+}
+
+func TestParseFieldMap(t *testing.T) {
+	got := parseFieldMap(" gpt-4o = gpt-4o-2024-08-06 ,broken,=x,y=, *=house ")
+	if len(got) != 2 || got["gpt-4o"] != "gpt-4o-2024-08-06" || got["*"] != "house" {
+		t.Errorf("parseFieldMap = %v", got)
+	}
+	s := &Server{modelAliases: map[string]string{"*": "house"}, echoRequestedModel: true}
+	if got := s.responseModel("anything", "DOUBAO"); got != "house" {
+		t.Errorf("wildcard alias: %q", got)
+	}
+	if got := s.objectType("model"); got != "model" {
+		t.Error("object types changed without an override")
+	}
+}
+
+func TestEchoRequestedModel(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	const requested = "gpt-4o-thinking"
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/v1/chat/completions", s.handleChatCompletions, `{"model":"` + requested + `","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/chat/completions", s.handleChatCompletions, `{"model":"` + requested + `","stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/responses", s.handleResponses, `{"model":"` + requested + `","input":"hi"}`},
+		{"/v1/messages", s.handleClaudeMessages, `{"model":"` + requested + `","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`},
+	} {
+		for _, echo := range []bool{true, false} {
+			s.echoRequestedModel = echo
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer echo-user")
+			rec := httptest.NewRecorder()
+			tc.handler(rec, req)
+
+			want := requested
+			if !echo {
+				want = defaultUpstreamModel
+			}
+			frames := []string{rec.Body.String()}
+			if strings.Contains(tc.body, `"stream":true`) {
+				frames = sseData(rec.Body.String())
+			}
+			for _, frame := range frames {
+				if frame == "[DONE]" {
+					continue
+				}
+				var resp struct {
+					Model string `json:"model"`
+				}
+				if err := json.Unmarshal([]byte(frame), &resp); err != nil || resp.Model != want {
+					t.Errorf("%s echo=%v: model %q (%v), want %q in %.120s", tc.path, echo, resp.Model, err, want, frame)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const defaultUpstreamModel = "DOUBAO"
+
+// upstreamRoute is where a client-requested model is sent and which model
+// name the upstream payload carries.
+type upstreamRoute struct {
+	Endpoint string `json:"endpoint"`
+	Model    string `json:"model"`
+}
+
+// ModelRoutes maps client model names, without -thinking/-search suffixes and
+// compared case-insensitively, to upstream routes.
+type ModelRoutes struct {
+	fallback upstreamRoute
+	routes   map[string]upstreamRoute
+	// names are the configured model names as written, for listing.
+	names []string
+}
+
+// LoadModelRoutes reads a JSON object of model name to {endpoint, model}.
+// Omitted fields fall back to the default endpoint and MIUI_MODEL, itself
+// DOUBAO unless set.
+func LoadModelRoutes(path, defaultEndpoint string) (*ModelRoutes, error) {
+	model := strings.TrimSpace(os.Getenv("MIUI_MODEL"))
+	if model == "" {
+		model = defaultUpstreamModel
+	}
+	mr := &ModelRoutes{
+		fallback: upstreamRoute{Endpoint: defaultEndpoint, Model: model},
+		routes:   map[string]upstreamRoute{},
+	}
+	if path == "" {
+		return mr, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]upstreamRoute{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("model routes %s: %w", path, err)
+	}
+	for name, route := range raw {
+		if route.Endpoint == "" {
+			route.Endpoint = mr.fallback.Endpoint
+		}
+		if route.Model == "" {
+			route.Model = mr.fallback.Model
+		}
+		mr.routes[strings.ToLower(name)] = route
+		mr.names = append(mr.names, name)
+	}
+	sort.Strings(mr.names)
+	return mr, nil
+}
+
+// Models lists the model names clients may request: the default upstream
+// model, then the configured routes.
+func (mr *ModelRoutes) Models() []string {
+	models := []string{mr.fallback.Model}
+	for _, name := range mr.names {
+		if !strings.EqualFold(name, mr.fallback.Model) {
+			models = append(models, name)
+		}
+	}
+	return models
+}
+
+func (mr *ModelRoutes) Resolve(model string) upstreamRoute {
+	if route, ok := mr.routes[strings.ToLower(model)]; ok {
+		return route
+	}
+	return mr.fallback
+}
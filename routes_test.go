@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// payloadRecorder is an upstream that records the model of each payload it
+// receives and answers with its name.
+func payloadRecorder(t *testing.T, name string, models chan<- string) *httptest.Server {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		models <- payload.Model
+		answerUpstream(name)(w, r)
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func writeRoutesFile(t *testing.T, routes map[string]upstreamRoute) string {
+	t.Helper()
+	data, err := json.Marshal(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadModelRoutes(t *testing.T) {
+	path := writeRoutesFile(t, map[string]upstreamRoute{
+		"Fast":  {Endpoint: "http://fast.example", Model: "FAST-1"},
+		"Smart": {Model: "SMART-2"},
+	})
+	mr, err := LoadModelRoutes(path, "http://default.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		model string
+		want  upstreamRoute
+	}{
+		{"fast", upstreamRoute{Endpoint: "http://fast.example", Model: "FAST-1"}},
+		{"SMART", upstreamRoute{Endpoint: "http://default.example", Model: "SMART-2"}},
+		{"unknown", upstreamRoute{Endpoint: "http://default.example", Model: defaultUpstreamModel}},
+		{"", upstreamRoute{Endpoint: "http://default.example", Model: defaultUpstreamModel}},
+	} {
+		if got := mr.Resolve(tc.model); got != tc.want {
+			t.Errorf("Resolve(%q) = %+v, want %+v", tc.model, got, tc.want)
+		}
+	}
+	if got, want := mr.Models(), []string{defaultUpstreamModel, "Fast", "Smart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Models() = %v, want %v", got, want)
+	}
+}
+
+func TestChatRoutesByModel(t *testing.T) {
+	models := make(chan string, 2)
+	fast := payloadRecorder(t, "fast", models)
+	smart := payloadRecorder(t, "smart", models)
+	routes, err := LoadModelRoutes(writeRoutesFile(t, map[string]upstreamRoute{
+		"fast":  {Endpoint: fast.URL, Model: "FAST-1"},
+		"smart": {Endpoint: smart.URL, Model: "SMART-2"},
+	}), "http://unused.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewMiuiClient(routes)
+	conv, err := newTestStore(t).GetConversation(context.Background(), "route-user", "routed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ model, endpoint, upstreamModel string }{
+		{"fast", "fast", "FAST-1"},
+		{"Smart", "smart", "SMART-2"},
+	} {
+		answer, err := c.Chat(context.Background(), conv, "hi", ChatOptions{Model: tc.model})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer != tc.endpoint {
+			t.Errorf("model %q answered by %q, want %q", tc.model, answer, tc.endpoint)
+		}
+		if got := <-models; got != tc.upstreamModel {
+			t.Errorf("model %q sent payload model %q, want %q", tc.model, got, tc.upstreamModel)
+		}
+	}
+}
+
+func TestBaseModelName(t *testing.T) {
+	for model, want := range map[string]string{
+		"DOUBAO":               "DOUBAO",
+		"fast-thinking":        "fast",
+		"fast-Search":          "fast",
+		"fast-thinking-search": "fast",
+		"fast-SEARCH-thinking": "fast",
+		"my-thinking-model":    "my-thinking-model",
+		"":                     "",
+	} {
+		if got := baseModelName(model); got != want {
+			t.Errorf("baseModelName(%q) = %q, want %q", model, got, want)
+		}
+	}
+	if got := baseModelName(nil); got != "" {
+		t.Errorf("baseModelName(nil) = %q", got)
+	}
+}
+
+func TestModelPassthrough(t *testing.T) {
+	t.Setenv("MIUI_MODEL", "CUSTOM-DEFAULT")
+	models := make(chan string, 2)
+	up := payloadRecorder(t, "answer", models)
+	s := newTestServer(t, answerUpstream("unused"))
+	routes, err := LoadModelRoutes(writeRoutesFile(t, map[string]upstreamRoute{
+		"fast": {Endpoint: up.URL, Model: "FAST-1"},
+	}), up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.miui.routes = routes
+
+	for _, tc := range []struct{ model, upstream string }{
+		{"fast-thinking-search", "FAST-1"},
+		{"unlisted", "CUSTOM-DEFAULT"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+			`{"model":"`+tc.model+`","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer passthrough-user")
+		req.Header.Set("ConversationId", tc.model)
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tc.model, rec.Code, rec.Body)
+		}
+		if got := <-models; got != tc.upstream {
+			t.Errorf("%s: upstream model %q, want %q", tc.model, got, tc.upstream)
+		}
+		var resp struct {
+			Model string `json:"model"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Model != tc.model {
+			t.Errorf("%s: response echoes %q (%v)", tc.model, resp.Model, err)
+		}
+	}
+}
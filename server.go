@@ -2,17 +2,155 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+const (
+	defaultMaxStreamDuration = 10 * time.Minute
+	defaultUpstreamTimeout   = 120 * time.Second
+)
+
+const (
+	defaultMaxSystemMessages = 64
+	defaultMaxSystemChars    = 65536
+)
+
+var (
+	errStreamDurationExceeded = errors.New("stream duration exceeded")
+	errUpstreamTimeout        = errors.New("upstream timeout")
+)
+
+// truncated reports whether err means the answer was cut short by a limit
+// rather than lost; the partial answer is kept and sent as a normal reply.
+func truncated(err error) bool {
+	return errors.Is(err, errStreamDurationExceeded) || errors.Is(err, errAnswerLimit) || errors.Is(err, errUpstreamTimeout) ||
+		errors.Is(err, errTranslationCut)
+}
+
+// ContextLengthError reports an assembled upstream context over maxContextTokens.
+type ContextLengthError struct {
+	Tokens int
+	Limit  int
+}
+
+func (e *ContextLengthError) Error() string {
+	return fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens.", e.Limit, e.Tokens)
+}
+
+// SystemPromptLengthError reports an assembled system prompt over
+// maxSystemChars.
+type SystemPromptLengthError struct {
+	Chars int
+	Limit int
+}
+
+func (e *SystemPromptLengthError) Error() string {
+	return fmt.Sprintf("system prompt is too long: %d characters > %d maximum", e.Chars, e.Limit)
+}
+
 type Server struct {
-	store *Store
-	miui  *MiuiClient
+	store      *Store
+	miui       *MiuiClient
+	moderation *Moderator
+	prompts    *PromptTemplates
+	// queryTemplate holds QUERY_TEMPLATE_FILE, which replaces
+	// buildFinalQuery's layout, and QUERY_SEPARATOR.
+	queryTemplate *QueryTemplate
+	// ssePadding is the size of the comment sent ahead of the first event.
+	ssePadding int
+	// sseKeepAlive spaces keepalive comments on idle SSE streams; zero
+	// disables them.
+	sseKeepAlive time.Duration
+	// streamFallback answers stream requests with a single JSON response
+	// when the writer cannot flush (STREAM_FALLBACK).
+	streamFallback bool
+	// ndjsonStreams makes newline-delimited JSON the default stream framing
+	// (STREAM_FORMAT=ndjson).
+	ndjsonStreams bool
+	// rawQuery sends the user text upstream as-is (RAW_QUERY_MODE).
+	rawQuery bool
+
+	maxStreamDuration time.Duration
+	// upstreamTimeout bounds non-streaming upstream calls, which have no
+	// stream duration cap.
+	upstreamTimeout   time.Duration
+	streamCharsPerSec int
+	// queuePosition emits SSE comments with the queue position while a
+	// stream waits for an upstream slot.
+	queuePosition bool
+	// claudePingInterval spaces Anthropic ping events on /v1/messages
+	// streams; zero disables them.
+	claudePingInterval time.Duration
+
+	contextSummary      bool
+	summaryKeepMessages int
+	// summaryRefreshMessages is how far past the keep window the history
+	// may grow before the summary is refreshed.
+	summaryRefreshMessages int
+
+	maxContextTokens int
+	autoSummarize    bool
+
+	fallbackResponse string
+
+	// answerPrefix and answerSuffix wrap every answer shown to clients but
+	// are never stored in history.
+	answerPrefix string
+	answerSuffix string
+
+	// translateTo names the language answers are translated into; empty
+	// disables post-translation.
+	translateTo string
+
+	// leanFields are top-level response fields dropped in lean mode.
+	leanFields []string
+
+	// modelAliases maps lower-cased requested model names to the name
+	// echoed in responses; objectTypes overrides response "object" values.
+	modelAliases map[string]string
+	objectTypes  map[string]string
+	// echoRequestedModel reports the client's model name verbatim rather
+	// than the upstream model (ECHO_REQUESTED_MODEL).
+	echoRequestedModel bool
+
+	// roleWithContent sends delta.role in the first content chunk instead
+	// of a separate role-only chunk.
+	roleWithContent bool
+
+	persistSystemPrompt bool
+
+	adminToken     string
+	replayMaxTurns int
+
+	// debugHeaders exposes internal identifiers such as the upstream
+	// conversation id in X-Debug-* response headers (DEBUG_HEADERS).
+	debugHeaders bool
+
+	// maxStreamsPerConv caps concurrent streams on one conversation; zero
+	// disables the cap.
+	maxStreamsPerConv int
+	// rejectBusy answers 409 to a request on a conversation that is already
+	// answering one (CONVERSATION_BUSY_POLICY=reject) instead of queueing it.
+	rejectBusy bool
+
+	// maxSystemMessages keeps only the first system messages of a request;
+	// maxSystemChars rejects assembled system prompts above it. Zero
+	// disables either bound.
+	maxSystemMessages int
+	maxSystemChars    int
 }
 
 type RequestOptions struct {
@@ -20,106 +158,324 @@ type RequestOptions struct {
 	DeepThinking bool
 	OnlineSearch bool
 	Model        string
+	// RequestedModel is the client's model name without flag suffixes,
+	// used to pick the upstream route.
+	RequestedModel string
+	// OnQueued, when set, is told the queue position while the request
+	// waits for an upstream slot.
+	OnQueued func(position int)
+	// IncludeUsage is stream_options.include_usage: append a usage chunk
+	// to Chat Completions streams.
+	IncludeUsage bool
+	// Transcript holds the user/assistant turns the client sent before its
+	// final message; when it diverges from the stored history it wins.
+	Transcript []Message
+	// MaxTokens is the client's max_tokens / max_output_tokens; the answer
+	// is cut once its estimated tokens reach it. Zero means no cap.
+	MaxTokens int
+	// OnReasoning receives deep-thinking reasoning text as it arrives.
+	OnReasoning func(string)
+	// Stop holds the client's stop sequences; the answer ends before the
+	// first one found.
+	Stop []string
+	// OnStopSequence is told which stop sequence ended the answer.
+	OnStopSequence func(string)
+	// UserText is the client's own message. History records it instead of
+	// the built query, so the system prompt and query template text are
+	// not baked into, and repeated by, every stored user turn.
+	UserText string
+	// SearchDepth and SearchResults tune online search breadth; they are
+	// only sent upstream when online search is on.
+	SearchDepth   string
+	SearchResults int
+	// Citations appends online-search sources to the answer as a
+	// footnote block; X-Disable-Citations turns it off.
+	Citations bool
 }
 
-func NewServer(store *Store, miui *MiuiClient) *Server {
-	return &Server{store: store, miui: miui}
+func NewServer(store *Store, miui *MiuiClient, moderation *Moderator, prompts *PromptTemplates, queryTemplate *QueryTemplate) *Server {
+	server := &Server{
+		store:             store,
+		miui:              miui,
+		moderation:        moderation,
+		prompts:           prompts,
+		queryTemplate:     queryTemplate,
+		rawQuery:          envBool("RAW_QUERY_MODE", false),
+		ssePadding:        envInt("SSE_INITIAL_PADDING", 0),
+		sseKeepAlive:      envDuration("SSE_KEEPALIVE", defaultSSEKeepAlive),
+		streamFallback:    envBool("STREAM_FALLBACK", false),
+		ndjsonStreams:     strings.EqualFold(strings.TrimSpace(os.Getenv("STREAM_FORMAT")), "ndjson"),
+		maxStreamDuration: envDuration("MAX_STREAM_DURATION", defaultMaxStreamDuration),
+		upstreamTimeout:   envDuration("UPSTREAM_TIMEOUT", defaultUpstreamTimeout),
+		streamCharsPerSec: envInt("STREAM_MAX_CHARS_PER_SEC", 0),
+		queuePosition:     envBool("STREAM_QUEUE_POSITION", false),
+
+		claudePingInterval: envDuration("CLAUDE_PING_INTERVAL", 0),
+
+		contextSummary:         envBool("CONTEXT_SUMMARY", false),
+		summaryKeepMessages:    envInt("CONTEXT_SUMMARY_KEEP_MESSAGES", defaultSummaryKeepMessages),
+		summaryRefreshMessages: envInt("CONTEXT_SUMMARY_REFRESH_MESSAGES", defaultSummaryRefreshMessages),
+
+		maxContextTokens: envInt("MAX_CONTEXT_TOKENS", 0),
+		autoSummarize:    envBool("AUTO_SUMMARIZE_ON_OVERFLOW", false),
+
+		fallbackResponse: os.Getenv("FALLBACK_RESPONSE"),
+
+		answerPrefix: os.Getenv("ANSWER_PREFIX"),
+		answerSuffix: os.Getenv("ANSWER_SUFFIX"),
+
+		translateTo: strings.TrimSpace(os.Getenv("TRANSLATE_TO")),
+
+		roleWithContent: envBool("STREAM_ROLE_WITH_CONTENT", false),
+
+		persistSystemPrompt: envBool("PERSIST_SYSTEM_PROMPT", false),
+
+		adminToken:     strings.TrimSpace(os.Getenv("ADMIN_TOKEN")),
+		replayMaxTurns: envInt("REPLAY_MAX_TURNS", defaultReplayMaxTurns),
+
+		debugHeaders: envBool("DEBUG_HEADERS", false),
+
+		maxStreamsPerConv: envInt("MAX_STREAMS_PER_CONV", 0),
+		rejectBusy:        strings.EqualFold(strings.TrimSpace(os.Getenv("CONVERSATION_BUSY_POLICY")), "reject"),
+
+		maxSystemMessages: envInt("MAX_SYSTEM_MESSAGES", defaultMaxSystemMessages),
+		maxSystemChars:    envInt("MAX_SYSTEM_PROMPT_CHARS", defaultMaxSystemChars),
+
+		modelAliases:       make(map[string]string),
+		objectTypes:        parseFieldMap(os.Getenv("RESPONSE_OBJECT_TYPES")),
+		echoRequestedModel: envBool("ECHO_REQUESTED_MODEL", true),
+	}
+	for from, to := range parseFieldMap(os.Getenv("MODEL_ALIASES")) {
+		server.modelAliases[strings.ToLower(from)] = to
+	}
+	if envBool("LEAN_RESPONSES", false) {
+		server.leanFields = splitList(os.Getenv("LEAN_RESPONSE_FIELDS"))
+		if len(server.leanFields) == 0 {
+			server.leanFields = []string{"usage"}
+		}
+	}
+	return server
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(`{"status":"ok"}`))
+	writeJSON(w, map[string]interface{}{
+		"status":   "ok",
+		"upstream": s.miui.health.snapshot(),
+	})
 }
 
+// modelVariantSuffixes are the flag suffixes parseRequestOptions understands;
+// each is listed as its own model so clients that enumerate models can pick it.
+var modelVariantSuffixes = []string{"", "-thinking", "-search", "-thinking-search"}
+
 func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]interface{}{
-		"object": "list",
-		"data": []map[string]interface{}{
-			{
-				"id":       "DOUBAO",
+	created := time.Now().Unix()
+	names := s.miui.routes.Models()
+	data := make([]map[string]interface{}, 0, len(names)*len(modelVariantSuffixes))
+	for _, name := range names {
+		for _, suffix := range modelVariantSuffixes {
+			data = append(data, map[string]interface{}{
+				"id":       name + suffix,
 				"object":   "model",
-				"created":  time.Now().Unix(),
+				"created":  created,
 				"owned_by": "miui",
-			},
-		},
+			})
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"object": "list",
+		"data":   data,
 	})
 }
 
-func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+// handleWhoami reports the identity the presented credentials resolve to,
+// with identifiers hashed or masked.
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimSpace(r.Header.Get("Authorization")) == "" {
+		writeJSON(w, map[string]interface{}{
+			"object":    "user",
+			"anonymous": true,
+		})
+		return
+	}
+
+	userKey := extractUserKey(r)
+	user, conversations, err := s.store.UserInfo(r.Context(), userKey)
+	if errors.Is(err, errUnknownUser) {
+		writeOpenAIErrorCode(w, http.StatusNotFound, err.Error(), "unknown_key")
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(userKey))
+	writeJSON(w, map[string]interface{}{
+		"object":        "user",
+		"anonymous":     false,
+		"user_key_hash": hex.EncodeToString(sum[:])[:16],
+		"oaid":          maskIdentifier(user.OAID),
+		"mi_id":         maskIdentifier(user.MiID),
+		"fingerprint":   user.Fingerprint,
+		"conversations": conversations,
+	})
+}
+
+func (s *Server) handleModerations(w http.ResponseWriter, r *http.Request) {
 	body, err := readJSONBody(r)
 	if err != nil {
 		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
 		return
 	}
 
-	systemPrompt, userText := extractMessages(body["messages"])
-	if userText == "" {
-		writeOpenAIError(w, http.StatusBadRequest, "missing_user_message")
+	inputs := extractModerationInputs(body["input"])
+	if len(inputs) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "missing_input")
 		return
 	}
 
-	opts := parseRequestOptions(body, r)
+	model, _ := body["model"].(string)
+	if model == "" {
+		model = "omni-moderation-latest"
+	}
 
-	userKey := extractUserKey(r)
-	conversationID := r.Header.Get("ConversationId")
+	results := make([]map[string]interface{}, 0, len(inputs))
+	for _, input := range inputs {
+		result := s.moderation.Check(input)
+		results = append(results, map[string]interface{}{
+			"flagged":         result.Flagged,
+			"categories":      result.Categories,
+			"category_scores": result.Scores,
+		})
+	}
 
-	conv, err := s.store.GetConversation(userKey, conversationID)
+	writeJSON(w, map[string]interface{}{
+		"id":      newID("modr"),
+		"model":   model,
+		"results": results,
+	})
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	body, err := readJSONBody(r)
 	if err != nil {
-		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	if err := validatePrediction(body["prediction"]); err != nil {
+		writeOpenAIErrorCode(w, http.StatusBadRequest, err.Error(), "invalid_prediction")
 		return
 	}
 
-	finalQuery := buildFinalQuery(systemPrompt, userText)
-	model := opts.Model
+	systemParts, userText, transcript := extractMessages(body["messages"])
+	if len(systemParts) == 0 {
+		// Claude-style clients put the system prompt at the top level;
+		// system-role messages take precedence when both are sent.
+		if system := extractContent(body["system"]); system != "" {
+			systemParts = []string{system}
+		}
+	}
+	if userText == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "missing_user_message")
+		return
+	}
 
-	if opts.Stream {
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		flusher, ok := w.(http.Flusher)
+	opts := s.parseRequestOptions(body, r)
+	opts.Transcript = transcript
+	turn, ok := s.beginTurn(w, r, systemParts, userText, opts)
+	if !ok {
+		return
+	}
+	defer turn.done()
+	model := s.responseModel(body["model"], turn.opts.Model)
+
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
 		if !ok {
-			writeOpenAIError(w, http.StatusInternalServerError, "stream_unsupported")
 			return
 		}
+		defer sw.Close()
 
 		id := newID("chatcmpl")
 		created := time.Now().Unix()
 		sentRole := false
+		chunkFor := func(content string, includeRole bool) chatChunk {
+			chunk := newChatChunk(id, created, model, content, includeRole)
+			chunk.Object = s.objectType(chunk.Object)
+			return chunk
+		}
 
-		onChunk := func(text string) {
-			if !sentRole {
-				chunk := newChatChunk(id, created, model, "", true)
+		emit := func(text string, reasoning bool) {
+			sw.Batch(func(w http.ResponseWriter) {
+				includeRole := false
+				if !sentRole {
+					if s.roleWithContent {
+						includeRole = true
+					} else {
+						writeSSEData(w, chunkFor("", true))
+					}
+					sentRole = true
+				}
+				if !reasoning {
+					writeSSEData(w, chunkFor(text, includeRole))
+					return
+				}
+				chunk := chunkFor("", includeRole)
+				chunk.Choices[0].Delta.ReasoningContent = text
 				writeSSEData(w, chunk)
-				sentRole = true
-			}
-			chunk := newChatChunk(id, created, model, text, false)
-			writeSSEData(w, chunk)
-			flusher.Flush()
+			})
 		}
-
-		full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, onChunk)
-		if err != nil {
+		onChunk := func(text string) { emit(text, false) }
+		turn.opts.OnReasoning = func(text string) { emit(text, true) }
+
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(_ turnResult, f chatFailure) {
+			sw.Batch(func(w http.ResponseWriter) {
+				writeSSEData(w, newOpenAIStreamFailure(f))
+				writeSSELine(w, "data: [DONE]\n\n")
+			})
+		})
+		if !ok {
 			return
 		}
-
-		finishChunk := newChatChunk(id, created, model, "", false)
 		finishReason := "stop"
-		finishChunk.Choices[0].FinishReason = &finishReason
-		writeSSEData(w, finishChunk)
-		writeSSELine(w, "data: [DONE]\n\n")
-		flusher.Flush()
-		_ = full
+		if truncated(res.err) {
+			finishReason = "length"
+		}
+
+		sw.Batch(func(w http.ResponseWriter) {
+			finishChunk := chunkFor("", false)
+			finishChunk.Choices[0].FinishReason = &finishReason
+			finishChunk.Fallback = res.fallback
+			writeSSEData(w, finishChunk)
+			if turn.opts.IncludeUsage {
+				// OpenAI sends usage in a trailing chunk with no choices.
+				usageChunk := chunkFor("", false)
+				usageChunk.Choices = usageChunk.Choices[:0]
+				usageChunk.Usage = res.usage.openAI()
+				writeSSEData(w, usageChunk)
+			}
+			writeSSELine(w, "data: [DONE]\n\n")
+		})
 		return
 	}
 
-	full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, nil)
-	if err != nil {
-		writeOpenAIError(w, http.StatusBadGateway, "upstream_error")
+	var reasoning strings.Builder
+	turn.opts.OnReasoning = func(text string) { reasoning.WriteString(text) }
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
 		return
 	}
 
-	resp := newChatCompletionResponse(model, full)
-	writeJSON(w, resp)
+	resp := newChatCompletionResponse(model, res.full, res.usage)
+	choice := resp["choices"].([]map[string]interface{})[0]
+	if truncated(res.err) {
+		choice["finish_reason"] = "length"
+	}
+	if reasoning.Len() > 0 {
+		choice["message"].(map[string]interface{})["reasoning_content"] = reasoning.String()
+	}
+	writeJSON(w, s.shapeResponse(resp))
 }
 
 func (s *Server) handleResponses(w http.ResponseWriter, r *http.Request) {
@@ -129,73 +485,103 @@ func (s *Server) handleResponses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	systemPrompt, userText := extractResponsesInput(body["input"])
+	systemParts, userText, transcript := extractResponsesInput(body["input"])
 	if userText == "" {
 		writeOpenAIError(w, http.StatusBadRequest, "missing_input")
 		return
 	}
 
-	opts := parseRequestOptions(body, r)
-
-	userKey := extractUserKey(r)
-	conversationID := r.Header.Get("ConversationId")
-	conv, err := s.store.GetConversation(userKey, conversationID)
-	if err != nil {
-		writeOpenAIError(w, http.StatusInternalServerError, "store_error")
+	opts := s.parseRequestOptions(body, r)
+	opts.Transcript = transcript
+	turn, ok := s.beginTurn(w, r, systemParts, userText, opts)
+	if !ok {
 		return
 	}
+	defer turn.done()
+	model := s.responseModel(body["model"], turn.opts.Model)
 
-	finalQuery := buildFinalQuery(systemPrompt, userText)
-	model := opts.Model
-
-	if opts.Stream {
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		flusher, ok := w.(http.Flusher)
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
 		if !ok {
-			writeOpenAIError(w, http.StatusInternalServerError, "stream_unsupported")
 			return
 		}
+		defer sw.Close()
 
 		respID := newID("resp")
 		msgID := newID("msg")
 		created := time.Now().Unix()
-		base := newResponsesBase(respID, msgID, model, created)
-		writeSSEEvent(w, "response.created", base)
-		flusher.Flush()
+		// The output message and its single text part are announced up
+		// front, as SDKs that assemble the output from events expect.
+		base := s.withObjectType(newResponsesBase(respID, msgID, model, created))
+		added := responseMessageItem(msgID, "", "in_progress")
+		added["content"] = []interface{}{}
+		sw.Batch(func(w http.ResponseWriter) {
+			writeSSEEvent(w, "response.created", map[string]interface{}{
+				"type":     "response.created",
+				"response": base,
+			})
+			writeSSEEvent(w, "response.in_progress", map[string]interface{}{
+				"type":     "response.in_progress",
+				"response": base,
+			})
+			writeSSEEvent(w, "response.output_item.added", responseItemEvent("response.output_item.added", added))
+			writeSSEEvent(w, "response.content_part.added", responsePartEvent("response.content_part.added", msgID, ""))
+		})
 
 		onChunk := func(text string) {
-			delta := responseDeltaEvent(msgID, text)
-			writeSSEEvent(w, "response.output_text.delta", delta)
-			flusher.Flush()
+			sw.Event("response.output_text.delta", responseDeltaEvent(msgID, text))
 		}
 
-		full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, onChunk)
-		if err != nil {
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(res turnResult, f chatFailure) {
+			// response.failed carries whatever text arrived before the
+			// failure, like response.completed does on success.
+			failed := s.withObjectType(newResponsesFinal(respID, msgID, model, created, res.full, res.usage))
+			failed["status"] = "failed"
+			code := f.code
+			if code == nil {
+				code = "server_error"
+			}
+			failed["error"] = f.withRetryAfter(map[string]interface{}{
+				"code":    code,
+				"message": f.message,
+			})
+			sw.Event("response.failed", map[string]interface{}{
+				"type":     "response.failed",
+				"response": failed,
+			})
+		})
+		if !ok {
 			return
 		}
 
-		done := responseDoneEvent(msgID, full)
-		writeSSEEvent(w, "response.output_text.done", done)
-
-		final := newResponsesFinal(respID, msgID, model, created, full)
-		writeSSEEvent(w, "response.completed", map[string]interface{}{
-			"type":     "response.completed",
-			"response": final,
+		final := newResponsesFinal(respID, msgID, model, created, res.full, res.usage)
+		if truncated(res.err) {
+			markIncomplete(final)
+		}
+		item := final["output"].([]map[string]interface{})[0]
+		final = s.shapeResponse(final)
+		sw.Batch(func(w http.ResponseWriter) {
+			writeSSEEvent(w, "response.output_text.done", responseDoneEvent(msgID, res.full))
+			writeSSEEvent(w, "response.content_part.done", responsePartEvent("response.content_part.done", msgID, res.full))
+			writeSSEEvent(w, "response.output_item.done", responseItemEvent("response.output_item.done", item))
+			writeSSEEvent(w, "response.completed", markFallback(map[string]interface{}{
+				"type":     "response.completed",
+				"response": final,
+			}, res.fallback))
 		})
-		flusher.Flush()
 		return
 	}
 
-	full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, nil)
-	if err != nil {
-		writeOpenAIError(w, http.StatusBadGateway, "upstream_error")
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
 		return
 	}
 
-	resp := newResponsesFinal(newID("resp"), newID("msg"), model, time.Now().Unix(), full)
-	writeJSON(w, resp)
+	resp := newResponsesFinal(newID("resp"), newID("msg"), model, time.Now().Unix(), res.full, res.usage)
+	if truncated(res.err) {
+		markIncomplete(resp)
+	}
+	writeJSON(w, s.shapeResponse(resp))
 }
 
 func (s *Server) handleClaudeMessages(w http.ResponseWriter, r *http.Request) {
@@ -205,85 +591,424 @@ func (s *Server) handleClaudeMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	systemPrompt, userText := extractClaudeMessages(body)
+	systemParts, userText, transcript := extractClaudeMessages(body)
 	if userText == "" {
 		writeClaudeError(w, http.StatusBadRequest, "missing_user_message")
 		return
 	}
 
-	opts := parseRequestOptions(body, r)
-
-	userKey := extractUserKey(r)
-	conversationID := r.Header.Get("ConversationId")
-	conv, err := s.store.GetConversation(userKey, conversationID)
-	if err != nil {
-		writeClaudeError(w, http.StatusInternalServerError, "store_error")
+	opts := s.parseRequestOptions(body, r)
+	opts.Transcript = transcript
+	turn, ok := s.beginTurn(w, r, systemParts, userText, opts)
+	if !ok {
 		return
 	}
+	defer turn.done()
+	model := s.responseModel(body["model"], turn.opts.Model)
 
-	finalQuery := buildFinalQuery(systemPrompt, userText)
-	model := opts.Model
+	var stopSequence string
+	turn.opts.OnStopSequence = func(seq string) { stopSequence = seq }
 
-	if opts.Stream {
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		flusher, ok := w.(http.Flusher)
+	if turn.opts.Stream {
+		sw, ok := s.startStream(w, r)
 		if !ok {
-			writeClaudeError(w, http.StatusInternalServerError, "stream_unsupported")
 			return
 		}
+		defer sw.Close()
 
 		msgID := newID("msg")
-		messageStart := newClaudeMessageStart(msgID, model)
-		writeSSEEvent(w, "message_start", messageStart)
-		writeSSEEvent(w, "content_block_start", newClaudeContentStart())
-		flusher.Flush()
+		turn.conv.mu.Lock()
+		inputTokens := contextTokens(turn.conv, turn.query)
+		turn.conv.mu.Unlock()
+		// Deep-thinking streams open a thinking block when reasoning
+		// arrives, so the text block is started lazily for them.
+		var blocks claudeBlocks
+		sw.Batch(func(w http.ResponseWriter) {
+			writeSSEEvent(w, "message_start", newClaudeMessageStart(msgID, model, inputTokens))
+			if !turn.opts.DeepThinking {
+				blocks.open(w, "text")
+			}
+		})
 
 		onChunk := func(text string) {
-			writeSSEEvent(w, "content_block_delta", newClaudeContentDelta(text))
-			flusher.Flush()
+			sw.Batch(func(w http.ResponseWriter) {
+				blocks.open(w, "text")
+				writeSSEEvent(w, "content_block_delta", newClaudeContentDelta(blocks.index, text))
+			})
+		}
+		turn.opts.OnReasoning = func(text string) {
+			sw.Batch(func(w http.ResponseWriter) {
+				blocks.open(w, "thinking")
+				writeSSEEvent(w, "content_block_delta", newClaudeThinkingDelta(blocks.index, text))
+			})
 		}
 
-		full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, onChunk)
-		if err != nil {
+		stopPings := s.startClaudePings(r.Context(), sw)
+		defer stopPings()
+		res, ok := s.streamTurn(r, sw, turn, onChunk, func(_ turnResult, f chatFailure) {
+			stopPings()
+			sw.Batch(func(w http.ResponseWriter) {
+				writeSSEEvent(w, "error", newClaudeStreamFailure(f))
+				writeSSEEvent(w, "message_stop", map[string]interface{}{"type": "message_stop"})
+			})
+		})
+		stopPings()
+		if !ok {
 			return
 		}
+		stopReason := "end_turn"
+		if truncated(res.err) {
+			stopReason = "max_tokens"
+		} else if stopSequence != "" {
+			stopReason = "stop_sequence"
+		}
 
-		writeSSEEvent(w, "content_block_stop", newClaudeContentStop())
-		writeSSEEvent(w, "message_delta", newClaudeMessageDelta())
-		writeSSEEvent(w, "message_stop", map[string]interface{}{"type": "message_stop"})
-		flusher.Flush()
-		_ = full
+		sw.Batch(func(w http.ResponseWriter) {
+			blocks.open(w, "text")
+			writeSSEEvent(w, "content_block_stop", newClaudeContentStop(blocks.index))
+			writeSSEEvent(w, "message_delta", markFallback(newClaudeMessageDelta(stopReason, stopSequence, res.usage), res.fallback))
+			writeSSEEvent(w, "message_stop", map[string]interface{}{"type": "message_stop"})
+		})
 		return
 	}
 
-	full, err := s.performChat(r.Context(), conv, finalQuery, opts.DeepThinking, opts.OnlineSearch, nil)
-	if err != nil {
-		writeClaudeError(w, http.StatusBadGateway, "upstream_error")
+	var reasoning strings.Builder
+	turn.opts.OnReasoning = func(text string) { reasoning.WriteString(text) }
+	res, ok := s.bufferTurn(w, r, turn)
+	if !ok {
+		return
+	}
+
+	resp := newClaudeMessage(res.full, model, res.usage)
+	if reasoning.Len() > 0 {
+		resp["content"] = append([]map[string]interface{}{
+			{"type": "thinking", "thinking": reasoning.String()},
+		}, resp["content"].([]map[string]interface{})...)
+	}
+	if truncated(res.err) {
+		resp["stop_reason"] = "max_tokens"
+	} else if stopSequence != "" {
+		resp["stop_reason"] = "stop_sequence"
+		resp["stop_sequence"] = stopSequence
+	}
+	writeJSON(w, s.shapeResponse(resp))
+}
+
+// writeDebugHeaders reports the internal upstream conversation id so turns
+// can be correlated with upstream behavior. It is a no-op unless
+// DEBUG_HEADERS is on.
+func (s *Server) writeDebugHeaders(w http.ResponseWriter, conv *Conversation) {
+	if !s.debugHeaders {
 		return
 	}
+	w.Header().Set("X-Debug-Internal-Conv-Id", conv.InternalID)
+}
+
+// bufferStream reports whether a stream request must be answered without
+// streaming: STREAM_FALLBACK is on and nothing behind w can flush. Without
+// the option such requests fail with stream_unsupported.
+func (s *Server) bufferStream(w http.ResponseWriter) bool {
+	if !s.streamFallback {
+		return false
+	}
+	_, ok := flusherOf(w)
+	return !ok
+}
+
+// admitRequest claims the conversation and, for a stream, one of its stream
+// slots. A stream nothing can flush is first downgraded to a buffered
+// response when STREAM_FALLBACK allows. When the request may not proceed it
+// is answered in the caller's protocol and false is returned; otherwise the
+// caller must call done once it has finished with the conversation.
+func (s *Server) admitRequest(w http.ResponseWriter, r *http.Request, conv *Conversation, opts *RequestOptions) (done func(), ok bool) {
+	leave, ok := s.claimConversation(w, r, conv)
+	if !ok {
+		return nil, false
+	}
+	if opts.Stream && s.bufferStream(w) {
+		opts.Stream = false
+	}
+	if !opts.Stream {
+		return leave, true
+	}
+	release, ok := s.admitStream(w, r, conv)
+	if !ok {
+		leave()
+		return nil, false
+	}
+	return func() {
+		release()
+		leave()
+	}, true
+}
+
+// admitStream reserves one of the conversation's MAX_STREAMS_PER_CONV stream
+// slots. When none is free it answers 429 in the caller's protocol and
+// returns false; otherwise the caller must call release when the stream ends.
+// It is checked before anything waits on the conversation, so queued streams
+// count against the cap too.
+func (s *Server) admitStream(w http.ResponseWriter, r *http.Request, conv *Conversation) (release func(), ok bool) {
+	if s.maxStreamsPerConv <= 0 {
+		return func() {}, true
+	}
+	for {
+		n := atomic.LoadInt32(&conv.Streams)
+		if int(n) >= s.maxStreamsPerConv {
+			writeProtocolError(w, r.URL.Path, http.StatusTooManyRequests,
+				"too many concurrent streams on this conversation", "rate_limit_error", "too_many_streams")
+			return nil, false
+		}
+		if atomic.CompareAndSwapInt32(&conv.Streams, n, n+1) {
+			return func() { atomic.AddInt32(&conv.Streams, -1) }, true
+		}
+	}
+}
+
+// claimConversation enforces one request at a time per conversation. The
+// upstream threads turns by the shared conversation id, so requests on one
+// conversation are always answered one after another: by default a request
+// waits for the one in flight, however long its stream runs. With
+// CONVERSATION_BUSY_POLICY=reject it is instead answered 409 in the caller's
+// protocol and false is returned. Otherwise the caller must call leave once
+// it is done with the conversation.
+func (s *Server) claimConversation(w http.ResponseWriter, r *http.Request, conv *Conversation) (leave func(), ok bool) {
+	if !s.rejectBusy {
+		return func() {}, true
+	}
+	if !atomic.CompareAndSwapInt32(&conv.Busy, 0, 1) {
+		writeProtocolError(w, r.URL.Path, http.StatusConflict,
+			"conversation busy: another request on this conversation is in progress", "invalid_request_error", "conversation_busy")
+		return nil, false
+	}
+	return func() { atomic.StoreInt32(&conv.Busy, 0) }, true
+}
+
+// shapeResponse applies the configured object type override and drops the
+// configured fields from a response payload. The default full shape is kept
+// unless LEAN_RESPONSES is on.
+func (s *Server) shapeResponse(resp map[string]interface{}) map[string]interface{} {
+	s.withObjectType(resp)
+	for _, field := range s.leanFields {
+		delete(resp, field)
+	}
+	return resp
+}
+
+// markFallback flags the terminal payload of a stream that carried the
+// fallback answer with "fallback": true. A stream's headers may already have
+// been flushed by padding, keepalives or queue positions when the upstream
+// fails, so X-Fallback is only set on buffered responses.
+func markFallback(payload map[string]interface{}, fallback bool) map[string]interface{} {
+	if fallback {
+		payload["fallback"] = true
+	}
+	return payload
+}
 
-	resp := newClaudeMessage(full, model)
-	writeJSON(w, resp)
+// fallbackFor returns the configured fallback answer to show instead of an
+// upstream failure. Fallback text is presentation only and never reaches the
+// conversation history, since performChat only records successful turns.
+func (s *Server) fallbackFor(r *http.Request, err error) (string, bool) {
+	if s.fallbackResponse == "" || r.Context().Err() != nil {
+		return "", false
+	}
+	var ctxErr *ContextLengthError
+	var payloadErr *PayloadTooLargeError
+	var rateErr *RateLimitError
+	if errors.As(err, &ctxErr) || errors.As(err, &payloadErr) || errors.As(err, &rateErr) {
+		return "", false
+	}
+	fallbackResponses.Inc()
+	return s.fallbackResponse, true
+}
+
+// checkContextLength rejects a request whose estimated upstream context
+// (summary, history window and query) exceeds maxContextTokens. With
+// AUTO_SUMMARIZE_ON_OVERFLOW the oldest history is summarized first.
+func (s *Server) checkContextLength(ctx context.Context, conv *Conversation, query string) error {
+	if s.maxContextTokens <= 0 {
+		return nil
+	}
+	conv.mu.Lock()
+	tokens := contextTokens(conv, query)
+	if tokens > s.maxContextTokens && s.autoSummarize {
+		tokens = s.compactToFit(ctx, conv, query, s.maxContextTokens)
+	}
+	conv.mu.Unlock()
+	if tokens > s.maxContextTokens {
+		return &ContextLengthError{Tokens: tokens, Limit: s.maxContextTokens}
+	}
+	return nil
 }
 
-func (s *Server) performChat(ctx context.Context, conv *Conversation, query string, deepThinking, onlineSearch bool, onChunk func(string)) (string, error) {
+// streamContext bounds the total duration of a streaming response so a
+// never-ending upstream cannot pin the connection indefinitely.
+func (s *Server) streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.maxStreamDuration <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeoutCause(r.Context(), s.maxStreamDuration, errStreamDurationExceeded)
+}
+
+// upstreamContext bounds a non-streaming upstream call by UPSTREAM_TIMEOUT
+// so a stalled upstream cannot hold the connection indefinitely.
+func (s *Server) upstreamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.upstreamTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeoutCause(r.Context(), s.upstreamTimeout, errUpstreamTimeout)
+}
+
+func (s *Server) performChat(ctx context.Context, conv *Conversation, query string, opts RequestOptions, onChunk func(string)) (string, Usage, error) {
 	atomic.AddInt32(&conv.InUse, 1)
 	defer atomic.AddInt32(&conv.InUse, -1)
 
 	conv.mu.Lock()
 	conv.LastActive = time.Now()
-	full, err := s.miui.Chat(ctx, conv, query, deepThinking, onlineSearch, onChunk)
-	if err == nil && strings.TrimSpace(full) != "" {
-		conv.History = append(conv.History, Message{Source: "user", Content: query})
+	conv.adoptTranscript(s.undecorate(opts.Transcript))
+	s.refreshContextSummary(ctx, conv)
+	promptTokens := contextTokens(conv, query)
+	// A persisted system prompt reused on a later turn is the closest thing
+	// to a prompt cache hit this upstream has.
+	cachedTokens := 0
+	if conv.SystemPrompt != "" && len(conv.History) > 0 {
+		cachedTokens = min(estimateTokens(conv.SystemPrompt), promptTokens)
+	}
+	reasoningTokens := 0
+	onReasoning := opts.OnReasoning
+	opts.OnReasoning = func(text string) {
+		reasoningTokens += estimateTokens(text)
+		if onReasoning != nil {
+			onReasoning(text)
+		}
+	}
+	// ANSWER_PREFIX goes out as the first delta, ahead of the answer.
+	prefixSent := false
+	if emit := onChunk; emit != nil && s.answerPrefix != "" {
+		onChunk = func(text string) {
+			if !prefixSent {
+				prefixSent = true
+				emit(s.answerPrefix)
+			}
+			emit(text)
+		}
+	}
+	// With TRANSLATE_TO the answer is buffered so a translation can replace
+	// it; streams then receive the translated text only.
+	answerChunk := onChunk
+	if s.translateTo != "" {
+		answerChunk = nil
+	}
+	var stop *stopFilter
+	if len(opts.Stop) > 0 {
+		var cancelStop context.CancelCauseFunc
+		ctx, cancelStop = context.WithCancelCause(ctx)
+		defer cancelStop(nil)
+		stop = newStopFilter(opts.Stop, answerChunk, func() { cancelStop(errStopSequence) })
+		answerChunk = stop.Write
+	}
+	var citations citationList
+	var onCitations func([]Citation)
+	if opts.OnlineSearch && opts.Citations {
+		onCitations = citations.add
+	}
+	full, err := s.miui.Chat(ctx, conv, withContextSummary(conv, query), ChatOptions{
+		Model:        opts.RequestedModel,
+		DeepThinking: opts.DeepThinking,
+		OnlineSearch: opts.OnlineSearch,
+		OnChunk:      answerChunk,
+		OnQueued:     opts.OnQueued,
+		MaxTokens:    opts.MaxTokens,
+		OnReasoning:  opts.OnReasoning,
+
+		SearchDepth:   opts.SearchDepth,
+		SearchResults: opts.SearchResults,
+		OnCitations:   onCitations,
+	})
+	if stop != nil {
+		stop.Flush()
+		full = stop.Text()
+		if stop.Matched() != "" {
+			// The upstream was cancelled on purpose; the answer is complete.
+			if errors.Is(context.Cause(ctx), errStopSequence) {
+				err = nil
+			}
+			if opts.OnStopSequence != nil {
+				opts.OnStopSequence(stop.Matched())
+			}
+		}
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		// Clients only see upstream_error; the body explains the rejection.
+		logf(ctx, "%v", upErr)
+	}
+	if s.translateTo != "" && (err == nil || truncated(err)) && strings.TrimSpace(full) != "" {
+		var cut error
+		full, cut = s.translateAnswer(ctx, conv, full, onChunk)
+		if err == nil {
+			err = cut
+		}
+	}
+	if err != nil && errors.Is(context.Cause(ctx), errStreamDurationExceeded) {
+		// The cap ends the answer early; keep what was streamed.
+		err = errStreamDurationExceeded
+	}
+	if err != nil && errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+		// Unlike a client that went away, a timed-out request still has
+		// someone to answer: a partial answer is kept and returned as cut
+		// short, and no answer at all is a gateway timeout.
+		if strings.TrimSpace(full) != "" {
+			err = errUpstreamTimeout
+		} else {
+			err = fmt.Errorf("miui upstream sent no answer within %s: %w", s.upstreamTimeout, context.DeadlineExceeded)
+		}
+	}
+	if (err == nil || truncated(err)) && strings.TrimSpace(full) != "" {
+		conv.PromptTokens += promptTokens
+		conv.CompletionTokens += estimateTokens(full)
+		asked := query
+		if opts.UserText != "" {
+			asked = opts.UserText
+		}
+		conv.History = append(conv.History, Message{Source: "user", Content: asked})
 		conv.History = append(conv.History, Message{Source: "assistant", Content: full})
 		conv.Dirty = true
 	}
 	conv.LastActive = time.Now()
 	conv.mu.Unlock()
 
-	return full, err
+	usage := Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: estimateTokens(full),
+		ReasoningTokens:  reasoningTokens,
+		CachedTokens:     cachedTokens,
+	}
+	if (err == nil || truncated(err)) && strings.TrimSpace(full) != "" {
+		// The prefix, citations and suffix are presentation only: the
+		// history above holds the bare answer.
+		trailer := citations.footnotes() + s.answerSuffix
+		if onChunk != nil && trailer != "" {
+			onChunk(trailer)
+		}
+		full = s.answerPrefix + full + trailer
+	}
+	return full, usage, err
+}
+
+// undecorate strips ANSWER_PREFIX, ANSWER_SUFFIX and citation footnotes from
+// the assistant turns a client sends back, so they match the stored history
+// and never enter it.
+func (s *Server) undecorate(transcript []Message) []Message {
+	out := make([]Message, len(transcript))
+	for i, msg := range transcript {
+		if msg.Source == "assistant" {
+			content := strings.TrimSuffix(strings.TrimPrefix(msg.Content, s.answerPrefix), s.answerSuffix)
+			msg.Content = stripCitations(content)
+		}
+		out[i] = msg
+	}
+	return out
 }
 
 func readJSONBody(r *http.Request) (map[string]interface{}, error) {
@@ -302,10 +1027,18 @@ func readJSONBody(r *http.Request) (map[string]interface{}, error) {
 	return body, nil
 }
 
-func parseRequestOptions(body map[string]interface{}, r *http.Request) RequestOptions {
+func (s *Server) parseRequestOptions(body map[string]interface{}, r *http.Request) RequestOptions {
+	streamOptions, _ := body["stream_options"].(map[string]interface{})
 	opts := RequestOptions{
-		Stream: getBool(body, "stream"),
-		Model:  normalizeModel(body["model"]),
+		Stream:         getBool(body, "stream"),
+		IncludeUsage:   getBool(streamOptions, "include_usage"),
+		Model:          s.miui.routes.Resolve(baseModelName(body["model"])).Model,
+		RequestedModel: baseModelName(body["model"]),
+		MaxTokens:      getInt(body, "max_tokens", "max_completion_tokens", "max_output_tokens"),
+		Stop:           parseStopSequences(body),
+		SearchDepth:    getString(body, "search_depth", "searchDepth"),
+		SearchResults:  getInt(body, "search_results", "searchResults"),
+		Citations:      !headerBool(r, "X-Disable-Citations"),
 	}
 
 	deepThinking, ok := getBoolOptional(body, "deep_thinking", "deepThinking", "isDeepThinking")
@@ -346,6 +1079,42 @@ func parseRequestOptions(body map[string]interface{}, r *http.Request) RequestOp
 	return opts
 }
 
+// validatePrediction checks the shape of an OpenAI predicted-outputs hint:
+// {"type": "content", "content": string or [{"type": "text", "text": ...}]}.
+// The upstream cannot use it, so a valid prediction is otherwise ignored.
+func validatePrediction(raw interface{}) error {
+	if raw == nil {
+		return nil
+	}
+	prediction, ok := raw.(map[string]interface{})
+	if !ok {
+		return errors.New("prediction must be an object")
+	}
+	if kind, _ := prediction["type"].(string); kind != "content" {
+		return errors.New("prediction.type must be \"content\"")
+	}
+	switch content := prediction["content"].(type) {
+	case string:
+		return nil
+	case []interface{}:
+		for i, item := range content {
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("prediction.content[%d] must be an object", i)
+			}
+			if kind, _ := part["type"].(string); kind != "text" {
+				return fmt.Errorf("prediction.content[%d].type must be \"text\"", i)
+			}
+			if _, ok := part["text"].(string); !ok {
+				return fmt.Errorf("prediction.content[%d].text must be a string", i)
+			}
+		}
+		return nil
+	default:
+		return errors.New("prediction.content must be a string or an array of text parts")
+	}
+}
+
 func extractUserKey(r *http.Request) string {
 	auth := strings.TrimSpace(r.Header.Get("Authorization"))
 	if auth == "" {
@@ -358,12 +1127,20 @@ func extractUserKey(r *http.Request) string {
 	return auth
 }
 
-func normalizeModel(model any) string {
+// baseModelName strips trailing -thinking/-search flag suffixes.
+func baseModelName(model any) string {
 	modelStr, _ := model.(string)
-	if modelStr == "" {
-		return "DOUBAO"
+	for {
+		lower := strings.ToLower(modelStr)
+		switch {
+		case strings.HasSuffix(lower, "-thinking"):
+			modelStr = modelStr[:len(modelStr)-len("-thinking")]
+		case strings.HasSuffix(lower, "-search"):
+			modelStr = modelStr[:len(modelStr)-len("-search")]
+		default:
+			return modelStr
+		}
 	}
-	return "DOUBAO"
 }
 
 func parseModelFlags(model any) (bool, bool, bool) {
@@ -377,13 +1154,42 @@ func parseModelFlags(model any) (bool, bool, bool) {
 	return deep, search, deep || search
 }
 
-func buildFinalQuery(systemPrompt, userText string) string {
+// buildQuery assembles the upstream query from the system prompt, prompt
+// templates and user text. RAW_QUERY_MODE skips all of it.
+func (s *Server) buildQuery(conv *Conversation, opts RequestOptions, systemPrompt, userText string) string {
+	if s.rawQuery {
+		return userText
+	}
+	return s.queryTemplate.Build(conv, s.prompts.Apply(opts, systemPrompt), userText)
+}
+
+func buildFinalQuery(systemPrompt, separator, userText string) string {
 	if systemPrompt != "" {
-		return systemPrompt + "\n\n用户输入：" + userText
+		return systemPrompt + separator + userText
 	}
 	return userText
 }
 
+// getInt returns the first positive integer found under keys, or 0.
+func getInt(body map[string]interface{}, keys ...string) int {
+	for _, key := range keys {
+		if n, ok := body[key].(float64); ok && n > 0 {
+			return int(n)
+		}
+	}
+	return 0
+}
+
+// getString returns the first non-empty string found under keys, or "".
+func getString(body map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := body[key].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
 func getBool(body map[string]interface{}, keys ...string) bool {
 	val, _ := getBoolOptional(body, keys...)
 	return val
@@ -409,14 +1215,19 @@ func headerBool(r *http.Request, key string) bool {
 	return val == "1" || val == "true" || val == "yes" || val == "on"
 }
 
-func extractMessages(raw interface{}) (string, string) {
+// extractMessages returns the joined system prompt, the final user message
+// and the turns that precede it. Assistant tool calls and tool results are
+// kept as labeled text; those that follow the final user message are part of
+// the query, since the client expects the answer to build on them.
+func extractMessages(raw interface{}) ([]string, string, []Message) {
 	msgs, ok := raw.([]interface{})
 	if !ok {
-		return "", ""
+		return nil, "", nil
 	}
 
 	var systemParts []string
-	var userText string
+	var turns []Message
+	last := -1
 	for _, item := range msgs {
 		m, ok := item.(map[string]interface{})
 		if !ok {
@@ -431,65 +1242,153 @@ func extractMessages(raw interface{}) (string, string) {
 			}
 		case "user":
 			if content != "" {
-				userText = content
+				last = len(turns)
+				turns = append(turns, Message{Source: role, Content: content})
 			}
+		case "assistant":
+			content += toolCallsText(m["tool_calls"])
+			if content != "" {
+				turns = append(turns, Message{Source: role, Content: content})
+			}
+		case "tool":
+			id, _ := m["tool_call_id"].(string)
+			turns = append(turns, Message{
+				Source:     role,
+				Content:    toolResultText(map[string]interface{}{"tool_use_id": id, "content": m["content"]}),
+				ToolCallID: id,
+			})
+		}
+	}
+	if last < 0 {
+		return systemParts, "", nil
+	}
+	query := turns[last].Content
+	for _, msg := range turns[last+1:] {
+		query += "\n\n" + msg.Content
+	}
+	return systemParts, query, turns[:last]
+}
+
+// toolCallsText renders OpenAI assistant tool_calls as labeled text for the
+// upstream, which has no notion of function calling.
+func toolCallsText(raw interface{}) string {
+	calls, _ := raw.([]interface{})
+	var b strings.Builder
+	for _, item := range calls {
+		call, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fn, _ := call["function"].(map[string]interface{})
+		name, _ := fn["name"].(string)
+		args, _ := fn["arguments"].(string)
+		label := "工具调用"
+		if id, _ := call["id"].(string); id != "" {
+			label += " " + id
+		}
+		b.WriteString("\n[" + label + "] " + name + "(" + args + ")")
+	}
+	return strings.TrimPrefix(b.String(), "\n")
+}
+
+// assembleSystemPrompt joins the system messages of a request. Messages past
+// maxSystemMessages are dropped; a result longer than maxSystemChars is
+// rejected rather than cut, since a truncated instruction can change meaning.
+func (s *Server) assembleSystemPrompt(parts []string) (string, error) {
+	if s.maxSystemMessages > 0 && len(parts) > s.maxSystemMessages {
+		parts = parts[:s.maxSystemMessages]
+	}
+	prompt := strings.Join(parts, "\n")
+	if s.maxSystemChars > 0 {
+		if n := utf8.RuneCountInString(prompt); n > s.maxSystemChars {
+			return "", &SystemPromptLengthError{Chars: n, Limit: s.maxSystemChars}
 		}
 	}
-	return strings.Join(systemParts, "\n"), userText
+	return prompt, nil
 }
 
-func extractResponsesInput(raw interface{}) (string, string) {
+func extractResponsesInput(raw interface{}) ([]string, string, []Message) {
 	switch v := raw.(type) {
 	case string:
-		return "", v
+		return nil, v, nil
 	case []interface{}:
 		if len(v) == 0 {
-			return "", ""
+			return nil, "", nil
 		}
 		if msg, ok := v[0].(map[string]interface{}); ok {
 			if _, hasRole := msg["role"]; hasRole {
 				return extractMessages(v)
 			}
 		}
-		return "", extractContent(v)
+		return nil, extractContent(v), nil
 	default:
-		return "", ""
+		return nil, "", nil
 	}
 }
 
-func extractClaudeMessages(body map[string]interface{}) (string, string) {
-	systemPrompt := extractContent(body["system"])
-	systemParts := []string{}
-	if systemPrompt != "" {
-		systemParts = append(systemParts, systemPrompt)
+func extractModerationInputs(raw interface{}) []string {
+	switch v := raw.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		inputs := make([]string, 0, len(v))
+		for _, item := range v {
+			if text := extractContent(item); text != "" {
+				inputs = append(inputs, text)
+			}
+		}
+		return inputs
+	default:
+		return nil
 	}
+}
 
-	msgsRaw, ok := body["messages"]
-	if !ok {
-		return strings.Join(systemParts, "\n"), ""
-	}
-	msgs, ok := msgsRaw.([]interface{})
-	if !ok {
-		return strings.Join(systemParts, "\n"), ""
+// extractClaudeMessages is extractMessages for a Claude request. The
+// top-level system prompt is used when set; system-role messages are not
+// valid Claude input, but OpenAI-style clients send them, so they are used
+// otherwise.
+func extractClaudeMessages(body map[string]interface{}) ([]string, string, []Message) {
+	roleSystemParts, userText, transcript := extractMessages(claudeMessages(body["messages"]))
+	if system := extractContent(body["system"]); system != "" {
+		return []string{system}, userText, transcript
 	}
+	return roleSystemParts, userText, transcript
+}
 
-	var userText string
+// claudeMessages converts Claude messages to chat messages for
+// extractMessages: an assistant's tool_use blocks become its tool_calls.
+// tool_result blocks stay in their user message, where extractContent
+// renders them.
+func claudeMessages(raw interface{}) interface{} {
+	msgs, _ := raw.([]interface{})
+	out := make([]interface{}, 0, len(msgs))
 	for _, item := range msgs {
 		m, ok := item.(map[string]interface{})
 		if !ok {
 			continue
 		}
-		role, _ := m["role"].(string)
-		if role != "user" {
-			continue
+		blocks, _ := m["content"].([]interface{})
+		var calls []interface{}
+		for _, b := range blocks {
+			block, ok := b.(map[string]interface{})
+			if !ok || block["type"] != "tool_use" {
+				continue
+			}
+			args, _ := json.Marshal(block["input"])
+			calls = append(calls, map[string]interface{}{
+				"id":       block["id"],
+				"function": map[string]interface{}{"name": block["name"], "arguments": string(args)},
+			})
 		}
-		content := extractContent(m["content"])
-		if content != "" {
-			userText = content
+		if len(calls) > 0 {
+			m = map[string]interface{}{"role": m["role"], "content": m["content"], "tool_calls": calls}
 		}
+		out = append(out, m)
 	}
-
-	return strings.Join(systemParts, "\n"), userText
+	return out
 }
 
 func extractContent(raw interface{}) string {
@@ -506,18 +1405,63 @@ func extractContent(raw interface{}) string {
 		}
 		return strings.Join(parts, "")
 	case map[string]interface{}:
+		if v["type"] == "tool_result" {
+			return toolResultText(v)
+		}
 		if text, ok := v["text"].(string); ok {
 			return text
 		}
 		if content, ok := v["content"]; ok {
 			return extractContent(content)
 		}
+		if placeholder, ok := imagePlaceholder(v); ok {
+			return placeholder
+		}
 		return ""
 	default:
 		return ""
 	}
 }
 
+// toolResultText labels a Claude tool_result block so the upstream can tell
+// tool output apart from what the user typed.
+func toolResultText(block map[string]interface{}) string {
+	label := "工具结果"
+	if id, _ := block["tool_use_id"].(string); id != "" {
+		label += " " + id
+	}
+	if isError, _ := block["is_error"].(bool); isError {
+		label += "（错误）"
+	}
+	return "[" + label + "]\n" + extractContent(block["content"]) + "\n[/工具结果]\n"
+}
+
+// imagePlaceholder describes an image content part as text, since the
+// upstream only takes a text query: OpenAI image_url, Responses input_image,
+// or Claude image. Inline data URLs and base64 sources are not echoed.
+func imagePlaceholder(part map[string]interface{}) (string, bool) {
+	var url string
+	switch part["type"] {
+	case "image_url", "input_image":
+		switch ref := part["image_url"].(type) {
+		case string:
+			url = ref
+		case map[string]interface{}:
+			url, _ = ref["url"].(string)
+		}
+	case "image":
+		if source, ok := part["source"].(map[string]interface{}); ok {
+			url, _ = source["url"].(string)
+		}
+	default:
+		return "", false
+	}
+	if url == "" || strings.HasPrefix(url, "data:") {
+		return "[图片]", true
+	}
+	return "[图片：" + url + "]", true
+}
+
 func writeJSON(w http.ResponseWriter, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	data, _ := json.Marshal(payload)
@@ -525,6 +1469,10 @@ func writeJSON(w http.ResponseWriter, payload interface{}) {
 }
 
 func writeOpenAIError(w http.ResponseWriter, status int, msg string) {
+	writeOpenAIErrorCode(w, status, msg, nil)
+}
+
+func writeOpenAIErrorCode(w http.ResponseWriter, status int, msg string, code interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	resp := map[string]interface{}{
@@ -532,27 +1480,178 @@ func writeOpenAIError(w http.ResponseWriter, status int, msg string) {
 			"message": msg,
 			"type":    "invalid_request_error",
 			"param":   nil,
-			"code":    nil,
+			"code":    code,
 		},
 	}
-	data, _ := json.Marshal(resp)
+	data, _ := json.Marshal(withResponseRequestID(w, resp))
 	_, _ = w.Write(data)
 }
 
+// chatFailure is an error from the chat path classified once for every
+// protocol: the HTTP status and message, the OpenAI code and Claude error
+// type, and how long a rate-limited client should wait.
+type chatFailure struct {
+	status  int
+	message string
+	// claudeMessage replaces message for Claude clients, which expect
+	// Anthropic's wording for oversized prompts.
+	claudeMessage string
+	code          interface{}
+	claudeType    string
+	retryAfter    time.Duration
+}
+
+func classifyChatError(err error) chatFailure {
+	var ctxErr *ContextLengthError
+	var sysErr *SystemPromptLengthError
+	var payloadErr *PayloadTooLargeError
+	var rateErr *RateLimitError
+	switch {
+	case errors.As(err, &rateErr):
+		return chatFailure{status: http.StatusTooManyRequests, message: rateErr.Error(),
+			code: "rate_limit_exceeded", claudeType: "rate_limit_error", retryAfter: rateErr.RetryAfter}
+	case errors.As(err, &ctxErr):
+		return chatFailure{status: http.StatusBadRequest, message: ctxErr.Error(),
+			claudeMessage: fmt.Sprintf("prompt is too long: %d tokens > %d maximum", ctxErr.Tokens, ctxErr.Limit),
+			code:          "context_length_exceeded", claudeType: "invalid_request_error"}
+	case errors.As(err, &sysErr):
+		return chatFailure{status: http.StatusBadRequest, message: sysErr.Error(),
+			code: "system_prompt_too_long", claudeType: "invalid_request_error"}
+	case errors.As(err, &payloadErr):
+		return chatFailure{status: http.StatusBadRequest, message: payloadErr.Error(),
+			claudeMessage: fmt.Sprintf("prompt is too long: %d bytes > %d maximum", payloadErr.Bytes, payloadErr.Limit),
+			code:          "context_length_exceeded", claudeType: "invalid_request_error"}
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errThinkingTimeout):
+		return chatFailure{status: http.StatusGatewayTimeout, message: "upstream_timeout",
+			code: "upstream_timeout", claudeType: "timeout_error"}
+	default:
+		return chatFailure{status: http.StatusBadGateway, message: "upstream_error", claudeType: "invalid_request_error"}
+	}
+}
+
+// streamFailure classifies an error that ends a stream already under way.
+// Its status can no longer be sent, so only a rate limit, whose retry_after
+// tells the client when to try again, is reported as itself; anything else
+// is upstream_error.
+func streamFailure(err error) chatFailure {
+	if f := classifyChatError(err); f.status == http.StatusTooManyRequests {
+		return f
+	}
+	return chatFailure{status: http.StatusBadGateway, message: "upstream_error", claudeType: "api_error"}
+}
+
+// withRetryAfter adds the failure's retry delay to a stream error object as
+// retry_after, in the whole seconds Retry-After would carry.
+func (f chatFailure) withRetryAfter(obj map[string]interface{}) map[string]interface{} {
+	if f.retryAfter > 0 {
+		obj["retry_after"] = retryAfterSeconds(f.retryAfter)
+	}
+	return obj
+}
+
+// classifyStoreError classifies a failure to load the conversation.
+func classifyStoreError(err error) chatFailure {
+	var corrupt *CorruptHistoryError
+	if errors.As(err, &corrupt) {
+		return chatFailure{status: http.StatusInternalServerError, message: corrupt.Error(),
+			code: "corrupt_history", claudeType: "invalid_request_error"}
+	}
+	return chatFailure{status: http.StatusInternalServerError, message: "store_error", claudeType: "invalid_request_error"}
+}
+
+// writeChatError answers with an error from the chat path in the shape of
+// the protocol r's path belongs to.
+func writeChatError(w http.ResponseWriter, r *http.Request, err error) {
+	writeFailure(w, r.URL.Path, classifyChatError(err))
+}
+
+// writeStoreError is writeChatError for a failure to load the conversation.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	writeFailure(w, r.URL.Path, classifyStoreError(err))
+}
+
+func writeFailure(w http.ResponseWriter, path string, f chatFailure) {
+	writeRetryAfter(w, f.retryAfter)
+	msg := f.message
+	if isClaudePath(path) && f.claudeMessage != "" {
+		msg = f.claudeMessage
+	}
+	writeProtocolError(w, path, f.status, msg, f.claudeType, f.code)
+}
+
+// writeRetryAfter sets Retry-After in whole seconds.
+func writeRetryAfter(w http.ResponseWriter, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(d), 10))
+}
+
+// retryAfterSeconds is d in whole seconds, rounding up so clients never
+// retry early.
+func retryAfterSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
 func writeClaudeError(w http.ResponseWriter, status int, msg string) {
+	writeClaudeErrorType(w, status, "invalid_request_error", msg)
+}
+
+func writeClaudeErrorType(w http.ResponseWriter, status int, errType, msg string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	resp := map[string]interface{}{
 		"type": "error",
 		"error": map[string]interface{}{
-			"type":    "invalid_request_error",
+			"type":    errType,
 			"message": msg,
 		},
 	}
-	data, _ := json.Marshal(resp)
+	data, _ := json.Marshal(withResponseRequestID(w, resp))
 	_, _ = w.Write(data)
 }
 
+func newOpenAIStreamError(msg string) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": msg,
+			"type":    "server_error",
+			"param":   nil,
+			"code":    nil,
+		},
+	}
+}
+
+// newOpenAIStreamFailure is the error chunk that ends a failed OpenAI
+// stream.
+func newOpenAIStreamFailure(f chatFailure) map[string]interface{} {
+	payload := newOpenAIStreamError(f.message)
+	obj := payload["error"].(map[string]interface{})
+	obj["code"] = f.code
+	f.withRetryAfter(obj)
+	return payload
+}
+
+func newClaudeStreamError(msg string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    "api_error",
+			"message": msg,
+		},
+	}
+}
+
+// newClaudeStreamFailure is the error event that ends a failed Claude
+// stream.
+func newClaudeStreamFailure(f chatFailure) map[string]interface{} {
+	payload := newClaudeStreamError(f.message)
+	obj := payload["error"].(map[string]interface{})
+	obj["type"] = f.claudeType
+	f.withRetryAfter(obj)
+	return payload
+}
+
 func writeSSEData(w http.ResponseWriter, payload interface{}) {
 	data, _ := json.Marshal(payload)
 	writeSSELine(w, "data: "+string(data)+"\n\n")
@@ -568,7 +1667,55 @@ func writeSSELine(w http.ResponseWriter, line string) {
 	_, _ = w.Write([]byte(line))
 }
 
-func newChatCompletionResponse(model, content string) map[string]interface{} {
+// startClaudePings writes an Anthropic ping event immediately and then every
+// claudePingInterval until the returned stop function is called.
+func (s *Server) startClaudePings(ctx context.Context, sw *sseWriter) func() {
+	if s.claudePingInterval <= 0 {
+		return func() {}
+	}
+	ping := func() {
+		sw.Event("ping", map[string]interface{}{"type": "ping"})
+	}
+	ping()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.claudePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				ping()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// queuePositionReporter returns an OnQueued callback that writes the queue
+// position as an SSE comment, or nil when STREAM_QUEUE_POSITION is off.
+func (s *Server) queuePositionReporter(sw *sseWriter) func(int) {
+	if !s.queuePosition {
+		return nil
+	}
+	return func(position int) {
+		sw.Line(fmt.Sprintf(": queue position %d\n\n", position))
+	}
+}
+
+func newChatCompletionResponse(model, content string, usage Usage) map[string]interface{} {
 	return map[string]interface{}{
 		"id":      newID("chatcmpl"),
 		"object":  "chat.completion",
@@ -584,27 +1731,30 @@ func newChatCompletionResponse(model, content string) map[string]interface{} {
 				"finish_reason": "stop",
 			},
 		},
-		"usage": map[string]interface{}{
-			"prompt_tokens":     0,
-			"completion_tokens": 0,
-			"total_tokens":      0,
-		},
+		"usage": usage.openAI(),
 	}
 }
 
 type chatChunk struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index int `json:"index"`
-		Delta struct {
-			Role    string `json:"role,omitempty"`
-			Content string `json:"content,omitempty"`
-		} `json:"delta"`
-		FinishReason *string `json:"finish_reason"`
-	} `json:"choices"`
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []chatChunkChoice      `json:"choices"`
+	Usage   map[string]interface{} `json:"usage,omitempty"`
+	// Fallback marks the finish chunk of a stream that carried the
+	// FALLBACK_RESPONSE text; see fallbackFor.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+type chatChunkChoice struct {
+	Index int `json:"index"`
+	Delta struct {
+		Role             string `json:"role,omitempty"`
+		Content          string `json:"content,omitempty"`
+		ReasoningContent string `json:"reasoning_content,omitempty"`
+	} `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
 }
 
 func newChatChunk(id string, created int64, model string, content string, includeRole bool) chatChunk {
@@ -613,14 +1763,7 @@ func newChatChunk(id string, created int64, model string, content string, includ
 		Object:  "chat.completion.chunk",
 		Created: created,
 		Model:   model,
-		Choices: make([]struct {
-			Index int `json:"index"`
-			Delta struct {
-				Role    string `json:"role,omitempty"`
-				Content string `json:"content,omitempty"`
-			} `json:"delta"`
-			FinishReason *string `json:"finish_reason"`
-		}, 1),
+		Choices: make([]chatChunkChoice, 1),
 	}
 	chunk.Choices[0].Index = 0
 	if includeRole {
@@ -640,31 +1783,66 @@ func newResponsesBase(respID, msgID, model string, created int64) map[string]int
 	}
 }
 
-func newResponsesFinal(respID, msgID, model string, created int64, content string) map[string]interface{} {
+func newResponsesFinal(respID, msgID, model string, created int64, content string, usage Usage) map[string]interface{} {
 	return map[string]interface{}{
-		"id":         respID,
-		"object":     "response",
-		"created_at": created,
-		"model":      model,
-		"output": []map[string]interface{}{
-			{
-				"id":   msgID,
-				"type": "message",
-				"role": "assistant",
-				"content": []map[string]interface{}{
-					{
-						"type": "output_text",
-						"text": content,
-					},
-				},
-			},
-		},
+		"id":          respID,
+		"object":      "response",
+		"created_at":  created,
+		"model":       model,
+		"output":      []map[string]interface{}{responseMessageItem(msgID, content, "completed")},
 		"output_text": content,
-		"usage": map[string]interface{}{
-			"input_tokens":  0,
-			"output_tokens": 0,
-			"total_tokens":  0,
-		},
+		"usage":       usage.responses(),
+	}
+}
+
+// responseMessageItem is the assistant message output item; every response
+// has exactly one, at output_index 0, holding one output_text part.
+func responseMessageItem(msgID, text, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      msgID,
+		"type":    "message",
+		"status":  status,
+		"role":    "assistant",
+		"content": []map[string]interface{}{responseTextPart(text)},
+	}
+}
+
+func responseTextPart(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "output_text",
+		"text":        text,
+		"annotations": []interface{}{},
+	}
+}
+
+// responseItemEvent builds response.output_item.added and .done.
+func responseItemEvent(eventType string, item map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":         eventType,
+		"output_index": 0,
+		"item":         item,
+	}
+}
+
+// responsePartEvent builds response.content_part.added and .done.
+func responsePartEvent(eventType, msgID, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":          eventType,
+		"item_id":       msgID,
+		"output_index":  0,
+		"content_index": 0,
+		"part":          responseTextPart(text),
+	}
+}
+
+// markIncomplete flags a Responses payload whose answer was cut short.
+func markIncomplete(resp map[string]interface{}) {
+	resp["status"] = "incomplete"
+	resp["incomplete_details"] = map[string]interface{}{"reason": "max_output_tokens"}
+	if output, ok := resp["output"].([]map[string]interface{}); ok {
+		for _, item := range output {
+			item["status"] = "incomplete"
+		}
 	}
 }
 
@@ -688,7 +1866,7 @@ func responseDoneEvent(msgID, text string) map[string]interface{} {
 	}
 }
 
-func newClaudeMessage(content, model string) map[string]interface{} {
+func newClaudeMessage(content, model string, usage Usage) map[string]interface{} {
 	return map[string]interface{}{
 		"id":    newID("msg"),
 		"type":  "message",
@@ -699,14 +1877,11 @@ func newClaudeMessage(content, model string) map[string]interface{} {
 		},
 		"stop_reason":   "end_turn",
 		"stop_sequence": nil,
-		"usage": map[string]interface{}{
-			"input_tokens":  0,
-			"output_tokens": 0,
-		},
+		"usage":         usage.claude(),
 	}
 }
 
-func newClaudeMessageStart(msgID, model string) map[string]interface{} {
+func newClaudeMessageStart(msgID, model string, inputTokens int) map[string]interface{} {
 	return map[string]interface{}{
 		"type": "message_start",
 		"message": map[string]interface{}{
@@ -715,25 +1890,46 @@ func newClaudeMessageStart(msgID, model string) map[string]interface{} {
 			"role":    "assistant",
 			"model":   model,
 			"content": []map[string]interface{}{},
+			"usage":   Usage{PromptTokens: inputTokens}.claude(),
 		},
 	}
 }
 
-func newClaudeContentStart() map[string]interface{} {
+// claudeBlocks tracks the open content block of a Claude stream. The caller
+// serializes access through the stream's sseWriter.
+type claudeBlocks struct {
+	index int
+	kind  string
+}
+
+// open switches the stream to a block of kind, closing the current one.
+func (b *claudeBlocks) open(w http.ResponseWriter, kind string) {
+	if b.kind == kind {
+		return
+	}
+	if b.kind != "" {
+		writeSSEEvent(w, "content_block_stop", newClaudeContentStop(b.index))
+		b.index++
+	}
+	b.kind = kind
+	writeSSEEvent(w, "content_block_start", newClaudeContentStart(b.index, kind))
+}
+
+func newClaudeContentStart(index int, kind string) map[string]interface{} {
 	return map[string]interface{}{
 		"type":  "content_block_start",
-		"index": 0,
+		"index": index,
 		"content_block": map[string]interface{}{
-			"type": "text",
-			"text": "",
+			"type": kind,
+			kind:   "",
 		},
 	}
 }
 
-func newClaudeContentDelta(text string) map[string]interface{} {
+func newClaudeContentDelta(index int, text string) map[string]interface{} {
 	return map[string]interface{}{
 		"type":  "content_block_delta",
-		"index": 0,
+		"index": index,
 		"delta": map[string]interface{}{
 			"type": "text_delta",
 			"text": text,
@@ -741,20 +1937,36 @@ func newClaudeContentDelta(text string) map[string]interface{} {
 	}
 }
 
-func newClaudeContentStop() map[string]interface{} {
+func newClaudeThinkingDelta(index int, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]interface{}{
+			"type":     "thinking_delta",
+			"thinking": text,
+		},
+	}
+}
+
+func newClaudeContentStop(index int) map[string]interface{} {
 	return map[string]interface{}{
 		"type":  "content_block_stop",
-		"index": 0,
+		"index": index,
 	}
 }
 
-func newClaudeMessageDelta() map[string]interface{} {
+func newClaudeMessageDelta(stopReason, stopSequence string, usage Usage) map[string]interface{} {
+	var sequence interface{}
+	if stopSequence != "" {
+		sequence = stopSequence
+	}
 	return map[string]interface{}{
 		"type": "message_delta",
 		"delta": map[string]interface{}{
-			"stop_reason":   "end_turn",
-			"stop_sequence": nil,
+			"stop_reason":   stopReason,
+			"stop_sequence": sequence,
 		},
+		"usage": map[string]interface{}{"output_tokens": usage.CompletionTokens},
 	}
 }
 
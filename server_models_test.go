@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModelsListsVariants(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	rec := httptest.NewRecorder()
+	methodOnly(http.MethodGet, s.handleModels)(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	var resp struct {
+		Object string `json:"object"`
+		Data   []struct {
+			ID      string `json:"id"`
+			Object  string `json:"object"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("%d %v: %s", rec.Code, err, rec.Body)
+	}
+
+	var ids []string
+	for _, model := range resp.Data {
+		if model.Object != "model" || model.OwnedBy != "miui" {
+			t.Errorf("model entry %+v", model)
+		}
+		ids = append(ids, model.ID)
+		deep, search, _ := parseModelFlags(model.ID)
+		if deep != strings.Contains(model.ID, "-thinking") || search != strings.Contains(model.ID, "-search") {
+			t.Errorf("%s parses as thinking=%v search=%v", model.ID, deep, search)
+		}
+	}
+	want := []string{"DOUBAO", "DOUBAO-thinking", "DOUBAO-search", "DOUBAO-thinking-search"}
+	if resp.Object != "list" || !reflect.DeepEqual(ids, want) {
+		t.Errorf("models %v, want %v", ids, want)
+	}
+
+	rec = httptest.NewRecorder()
+	methodOnly(http.MethodGet, s.handleModels)(rec, httptest.NewRequest(http.MethodPost, "/v1/models", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /v1/models: status %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,1472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a Server on a fresh store whose upstream is served
+// by upstream.
+func newTestServer(t *testing.T, upstream http.HandlerFunc) *Server {
+	t.Helper()
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	st := newTestStore(t)
+	routes, err := LoadModelRoutes("", up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderation, err := NewModerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(st, NewMiuiClient(routes), moderation, &PromptTemplates{}, nil)
+}
+
+// answerUpstream streams chunks as MIUI answer events followed by [DONE].
+func answerUpstream(chunks ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: {\"answer\":%q}\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+func TestWhoamiDoesNotCreateUsers(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	whoami := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/whoami", nil)
+		req.Header.Set("Authorization", "Bearer whoami-user")
+		rec := httptest.NewRecorder()
+		s.handleWhoami(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := whoami(); rec.Code != http.StatusNotFound {
+			t.Fatalf("unknown key: status %d, want 404: %s", rec.Code, rec.Body)
+		}
+	}
+
+	if _, err := s.store.GetConversation(context.Background(), "whoami-user", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	rec := whoami()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("known key: status %d: %s", rec.Code, rec.Body)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["conversations"] != float64(1) {
+		t.Errorf("conversations = %v, want 1", body["conversations"])
+	}
+}
+
+// chatRequest builds a non-streaming Chat Completions request for user on
+// conversation.
+func chatRequest(user, conversation, content string) *http.Request {
+	body := fmt.Sprintf(`{"model":"DOUBAO","messages":[{"role":"user","content":%q}]}`, content)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+user)
+	req.Header.Set("ConversationId", conversation)
+	return req
+}
+
+// streamChatRequest is chatRequest with streaming on.
+func streamChatRequest(user, conversation, content string) *http.Request {
+	body := fmt.Sprintf(`{"model":"DOUBAO","stream":true,"messages":[{"role":"user","content":%q}]}`, content)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+user)
+	req.Header.Set("ConversationId", conversation)
+	return req
+}
+
+// blockingUpstream answers "ok" once release is closed, signalling entered
+// as each request arrives.
+func blockingUpstream(t *testing.T) (upstream http.HandlerFunc, entered chan struct{}, release func()) {
+	entered = make(chan struct{}, 8)
+	released := make(chan struct{})
+	var once sync.Once
+	release = func() { once.Do(func() { close(released) }) }
+	t.Cleanup(release)
+	return func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-released
+		answerUpstream("ok")(w, r)
+	}, entered, release
+}
+
+func TestConversationBusyRejectsConcurrentRequest(t *testing.T) {
+	upstream, entered, release := blockingUpstream(t)
+	s := newTestServer(t, upstream)
+	s.rejectBusy = true
+
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, chatRequest("busy-user", "busy", "one"))
+		first <- rec
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("busy-user", "busy", "two"))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "conversation_busy") {
+		t.Fatalf("concurrent request: %d %s, want 409 conversation_busy", rec.Code, rec.Body)
+	}
+
+	release()
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("busy-user", "busy", "four"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request after the first finished: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConversationQueuesConcurrentRequests(t *testing.T) {
+	upstream, entered, release := blockingUpstream(t)
+	s := newTestServer(t, upstream)
+
+	var wg sync.WaitGroup
+	for _, content := range []string{"one", "two"} {
+		wg.Add(1)
+		go func(content string) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.handleChatCompletions(rec, chatRequest("queue-user", "queued", content))
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s: %d %s", content, rec.Code, rec.Body)
+			}
+		}(content)
+	}
+	<-entered
+	select {
+	case <-entered:
+		t.Fatal("second request reached upstream while the first was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	wg.Wait()
+
+	history, _, err := s.store.History(context.Background(), "queue-user", "queued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("history has %d messages, want 4", len(history))
+	}
+	for i, msg := range history {
+		if want := []string{"user", "assistant"}[i%2]; msg.Source != want {
+			t.Fatalf("history[%d] is from %s, want %s: turns interleaved", i, msg.Source, want)
+		}
+	}
+}
+
+func TestMaxStreamDurationEndsStream(t *testing.T) {
+	gone := make(chan struct{})
+	s := newTestServer(t, endlessUpstream(`{"answer":"tick "}`, gone))
+	s.maxStreamDuration = 150 * time.Millisecond
+
+	req := streamChatRequest("duration-user", "endless", "go on forever")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	s.handleChatCompletions(rec, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stream ran for %v past a 150ms cap", elapsed)
+	}
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "tick") {
+		t.Errorf("no content streamed before the cap: %s", body)
+	}
+	if !strings.Contains(body, `"finish_reason":"length"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("stream did not end with a length finish and [DONE]: %s", body)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream was not cancelled at the cap")
+	}
+}
+
+func TestContextLengthExceeded(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, countingUpstream("ok", &calls))
+	s.maxContextTokens = 50
+	conv, err := s.store.GetConversation(context.Background(), "long-user", "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv.mu.Lock()
+	conv.History = []Message{
+		{Source: "user", Content: strings.Repeat("long history ", 100)},
+		{Source: "assistant", Content: "noted"},
+	}
+	conv.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("long-user", "long", "and now?"))
+	var openAI struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &openAI)
+	if rec.Code != http.StatusBadRequest || openAI.Error.Code != "context_length_exceeded" {
+		t.Errorf("OpenAI: %d %s, want 400 context_length_exceeded", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"DOUBAO","max_tokens":64,"messages":[{"role":"user","content":"and now?"}]}`))
+	req.Header.Set("Authorization", "Bearer long-user")
+	req.Header.Set("ConversationId", "long")
+	rec = httptest.NewRecorder()
+	s.handleClaudeMessages(rec, req)
+	var claude struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &claude)
+	if rec.Code != http.StatusBadRequest || claude.Error.Type != "invalid_request_error" ||
+		!strings.HasPrefix(claude.Error.Message, "prompt is too long") {
+		t.Errorf("Claude: %d %s, want 400 prompt is too long", rec.Code, rec.Body)
+	}
+
+	if calls != 0 {
+		t.Errorf("upstream called %d times for oversized requests", calls)
+	}
+}
+
+func failingUpstream(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "upstream exploded", http.StatusInternalServerError)
+}
+
+func TestFallbackResponse(t *testing.T) {
+	s := newTestServer(t, failingUpstream)
+	s.fallbackResponse = "Service is busy, please try again."
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("fallback-user", "fb", "hello"))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Fallback") != "true" ||
+		!strings.Contains(rec.Body.String(), s.fallbackResponse) {
+		t.Errorf("buffered: %d X-Fallback=%q %s", rec.Code, rec.Header().Get("X-Fallback"), rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("fallback-user", "fb", "hello"))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Service is busy") || !strings.Contains(body, `"fallback":true`) ||
+		!strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("stream did not carry the flagged fallback: %s", body)
+	}
+
+	history, _, err := s.store.History(context.Background(), "fallback-user", "fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("fallback answers reached history: %v", history)
+	}
+}
+
+func TestFallbackNotUsedWithoutConfig(t *testing.T) {
+	s := newTestServer(t, failingUpstream)
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("fallback-user", "nofb", "hello"))
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("X-Fallback") != "" {
+		t.Errorf("got %d X-Fallback=%q, want a plain 502", rec.Code, rec.Header().Get("X-Fallback"))
+	}
+}
+
+func TestLeanResponses(t *testing.T) {
+	keys := func(s *Server) map[string]bool {
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, chatRequest("lean-user", "lean", "hi"))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%v: %s", err, rec.Body)
+		}
+		got := map[string]bool{}
+		for key := range body {
+			got[key] = true
+		}
+		return got
+	}
+
+	full := keys(newTestServer(t, answerUpstream("ok")))
+	for _, key := range []string{"id", "object", "created", "model", "choices", "usage"} {
+		if !full[key] {
+			t.Errorf("full response lacks %q", key)
+		}
+	}
+
+	t.Setenv("LEAN_RESPONSES", "true")
+	lean := keys(newTestServer(t, answerUpstream("ok")))
+	if lean["usage"] || !lean["choices"] || len(lean) != len(full)-1 {
+		t.Errorf("lean response keys %v, want the full set without usage", lean)
+	}
+
+	t.Setenv("LEAN_RESPONSE_FIELDS", "created, usage")
+	custom := keys(newTestServer(t, answerUpstream("ok")))
+	if custom["created"] || custom["usage"] || len(custom) != len(full)-2 {
+		t.Errorf("custom lean response keys %v, want created and usage dropped", custom)
+	}
+}
+
+// sseData returns the data payloads of an SSE body, without [DONE].
+func sseData(body string) []string {
+	var payloads []string
+	for _, line := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok && data != "[DONE]" {
+			payloads = append(payloads, data)
+		}
+	}
+	return payloads
+}
+
+func TestStreamRoleChunk(t *testing.T) {
+	type step struct{ role, content, finish string }
+	for _, tc := range []struct {
+		roleWithContent bool
+		want            []step
+	}{
+		{false, []step{{"assistant", "", ""}, {"", "Hel", ""}, {"", "lo", ""}, {"", "", "stop"}}},
+		{true, []step{{"assistant", "Hel", ""}, {"", "lo", ""}, {"", "", "stop"}}},
+	} {
+		s := newTestServer(t, answerUpstream("Hel", "lo"))
+		s.roleWithContent = tc.roleWithContent
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, streamChatRequest("role-user", "roles", "hi"))
+
+		var got []step
+		for _, data := range sseData(rec.Body.String()) {
+			var chunk struct {
+				Choices []struct {
+					Delta struct {
+						Role    string `json:"role"`
+						Content string `json:"content"`
+					} `json:"delta"`
+					FinishReason *string `json:"finish_reason"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatalf("%v in %q", err, data)
+			}
+			choice := chunk.Choices[0]
+			finish := ""
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+			got = append(got, step{choice.Delta.Role, choice.Delta.Content, finish})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("roleWithContent=%v: chunks %v, want %v", tc.roleWithContent, got, tc.want)
+		}
+	}
+}
+
+// queryRecorder is an upstream that sends each payload's query to queries
+// and answers "ok".
+func queryRecorder(queries chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		queries <- payload.Content
+		answerUpstream("ok")(w, r)
+	}
+}
+
+func TestPersistedSystemPrompt(t *testing.T) {
+	queries := make(chan string, 4)
+	s := newTestServer(t, queryRecorder(queries))
+	s.persistSystemPrompt = true
+
+	send := func(messages string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"DOUBAO","messages":`+messages+`}`))
+		req.Header.Set("Authorization", "Bearer system-user")
+		req.Header.Set("ConversationId", "seeded")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+		return <-queries
+	}
+
+	if q := send(`[{"role":"system","content":"Speak like a pirate."},{"role":"user","content":"hi"}]`); !strings.Contains(q, "Speak like a pirate.") {
+		t.Fatalf("first turn query %q lacks its system prompt", q)
+	}
+	if q := send(`[{"role":"user","content":"and again"}]`); !strings.Contains(q, "Speak like a pirate.") {
+		t.Errorf("later turn query %q did not inherit the first turn's system prompt", q)
+	}
+	q := send(`[{"role":"system","content":"Be formal."},{"role":"user","content":"now formally"}]`)
+	if !strings.Contains(q, "Be formal.") || strings.Contains(q, "pirate") {
+		t.Errorf("explicit system prompt not used for its own turn: %q", q)
+	}
+	if q := send(`[{"role":"user","content":"back to default"}]`); !strings.Contains(q, "Speak like a pirate.") {
+		t.Errorf("a later system prompt replaced the conversation's: %q", q)
+	}
+}
+
+func TestStreamReportsQueuePosition(t *testing.T) {
+	upstream, entered, release := blockingUpstream(t)
+	s := newTestServer(t, upstream)
+	s.miui.limiter = newUpstreamLimiter(1, defaultLowRemaining)
+	s.queuePosition = true
+
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		s.handleChatCompletions(httptest.NewRecorder(), chatRequest("queue-pos-user", "holder", "one"))
+	}()
+	<-entered
+
+	queued := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, streamChatRequest("queue-pos-user", "waiter", "two"))
+		queued <- rec
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.miui.limiter.mu.Lock()
+		waiting := s.miui.limiter.waiters.Len()
+		s.miui.limiter.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second request never queued for the upstream slot")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	release()
+	<-first
+
+	body := (<-queued).Body.String()
+	notice := strings.Index(body, ": queue position 1\n\n")
+	content := strings.Index(body, `"content":"ok"`)
+	if notice < 0 || content < 0 || notice > content {
+		t.Errorf("stream lacks a queue position notice before its content: %s", body)
+	}
+}
+
+func TestMixedFormatSystemPrompt(t *testing.T) {
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	for _, tc := range []struct {
+		body, want, not string
+	}{
+		{`"system":"Top level.","messages":[{"role":"user","content":"hi"}]`, "Top level.", ""},
+		{`"system":"Top level.","messages":[{"role":"system","content":"In messages."},{"role":"user","content":"hi"}]`, "In messages.", "Top level."},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"DOUBAO",`+tc.body+`}`))
+		req.Header.Set("Authorization", "Bearer mixed-user")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+		q := <-queries
+		if !strings.Contains(q, tc.want) || (tc.not != "" && strings.Contains(q, tc.not)) {
+			t.Errorf("OpenAI %s: query %q, want %q without %q", tc.body, q, tc.want, tc.not)
+		}
+	}
+
+	for _, tc := range []struct {
+		body string
+		want []string
+	}{
+		{`{"messages":[{"role":"system","content":"In messages."},{"role":"user","content":"hi"}]}`, []string{"In messages."}},
+		{`{"system":"Top level.","messages":[{"role":"system","content":"In messages."},{"role":"user","content":"hi"}]}`, []string{"Top level."}},
+	} {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		system, user, _ := extractClaudeMessages(body)
+		if !reflect.DeepEqual(system, tc.want) || user != "hi" {
+			t.Errorf("Claude %s: system %q user %q, want %q", tc.body, system, user, tc.want)
+		}
+	}
+}
+
+func TestPredictionField(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	for _, tc := range []struct {
+		prediction string
+		status     int
+	}{
+		{`{"type":"content","content":"func main() {}"}`, http.StatusOK},
+		{`{"type":"content","content":[{"type":"text","text":"func main() {}"}]}`, http.StatusOK},
+		{`"func main() {}"`, http.StatusBadRequest},
+		{`{"type":"diff","content":"x"}`, http.StatusBadRequest},
+		{`{"type":"content","content":[{"type":"image","text":"x"}]}`, http.StatusBadRequest},
+		{`{"type":"content","content":42}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+			`{"model":"DOUBAO","prediction":`+tc.prediction+`,"messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer prediction-user")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.prediction, rec.Code, tc.status, rec.Body)
+		}
+		if tc.status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "invalid_prediction") {
+			t.Errorf("%s: error lacks the invalid_prediction code: %s", tc.prediction, rec.Body)
+		}
+	}
+}
+
+// sseEvents returns the event names of an SSE body in order.
+func sseEvents(body string) []string {
+	var events []string
+	for _, line := range strings.Split(body, "\n") {
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestClaudeStreamPings(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprint(w, "data: {\"answer\":\"a\"}\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	stream := func(interval time.Duration) []string {
+		s.claudePingInterval = interval
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages",
+			strings.NewReader(`{"model":"DOUBAO","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer ping-user")
+		req.Header.Set("ConversationId", interval.String())
+		rec := httptest.NewRecorder()
+		s.handleClaudeMessages(rec, req)
+		return sseEvents(rec.Body.String())
+	}
+	golden := []string{"message_start", "content_block_start",
+		"content_block_delta", "content_block_delta", "content_block_delta", "content_block_delta", "content_block_delta",
+		"content_block_stop", "message_delta", "message_stop"}
+
+	// The upstream takes about 250ms; at a 40ms interval that is the
+	// initial ping plus about six more.
+	events := stream(40 * time.Millisecond)
+	var rest []string
+	pings, lastPing := 0, 0
+	for i, event := range events {
+		if event == "ping" {
+			pings++
+			lastPing = i
+			continue
+		}
+		rest = append(rest, event)
+	}
+	if len(events) < 2 || events[1] != "ping" {
+		t.Errorf("no ping right after message_start: %v", events)
+	}
+	if pings < 4 || pings > 9 {
+		t.Errorf("%d pings over a 250ms stream at a 40ms interval: %v", pings, events)
+	}
+	if lastPing > len(events)-4 {
+		t.Errorf("ping after the content block closed: %v", events)
+	}
+	if !reflect.DeepEqual(rest, golden) {
+		t.Errorf("events without pings = %v, want %v", rest, golden)
+	}
+
+	if events := stream(0); !reflect.DeepEqual(events, golden) {
+		t.Errorf("pings disabled: events %v, want %v", events, golden)
+	}
+}
+
+func TestDebugHeadersOnlyInDebugMode(t *testing.T) {
+	s := newTestServer(t, answerUpstream("ok"))
+	conv, err := s.store.GetConversation(context.Background(), "debug-user", "dbg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, debug := range []bool{false, true} {
+		s.debugHeaders = debug
+		for _, req := range []*http.Request{chatRequest("debug-user", "dbg", "hi"), streamChatRequest("debug-user", "dbg", "hi")} {
+			rec := httptest.NewRecorder()
+			s.handleChatCompletions(rec, req)
+			got := rec.Header().Get("X-Debug-Internal-Conv-Id")
+			if debug && got != conv.InternalID {
+				t.Errorf("debug mode: header %q, want %q", got, conv.InternalID)
+			}
+			if !debug && got != "" {
+				t.Errorf("internal id %q exposed outside debug mode", got)
+			}
+		}
+	}
+}
+
+// thinkingUpstream streams two reasoning chunks and then the answer "42".
+func thinkingUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "data: {\"intentionInfo\":{\"intentionText\":\"Let me \"}}\n\n")
+	fmt.Fprint(w, "data: {\"intentionInfo\":{\"intentionText\":\"think.\",\"end\":true}}\n\n")
+	fmt.Fprint(w, "data: {\"answer\":\"42\"}\n\n")
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func TestReasoningContent(t *testing.T) {
+	s := newTestServer(t, thinkingUpstream)
+	chat := func(stream bool) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"model":"DOUBAO-thinking","stream":%v,"messages":[{"role":"user","content":"why?"}]}`, stream)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer reasoning-user")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		return rec
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	rec := chat(false)
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if msg := resp.Choices[0].Message; msg.Content != "42" || msg.ReasoningContent != "Let me think." {
+		t.Errorf("message %+v, want answer and reasoning apart", msg)
+	}
+
+	var reasoning, content strings.Builder
+	for _, data := range sseData(chat(true).Body.String()) {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Content != "" && delta.ReasoningContent != "" {
+			t.Errorf("chunk mixes reasoning and answer: %s", data)
+		}
+		reasoning.WriteString(delta.ReasoningContent)
+		content.WriteString(delta.Content)
+	}
+	if reasoning.String() != "Let me think." || content.String() != "42" {
+		t.Errorf("streamed reasoning %q and content %q", reasoning.String(), content.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"DOUBAO-thinking","max_tokens":64,"messages":[{"role":"user","content":"why?"}]}`))
+	req.Header.Set("Authorization", "Bearer reasoning-user")
+	rec = httptest.NewRecorder()
+	s.handleClaudeMessages(rec, req)
+	var claude struct {
+		Content []map[string]string `json:"content"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &claude); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{{"type": "thinking", "thinking": "Let me think."}, {"type": "text", "text": "42"}}
+	if !reflect.DeepEqual(claude.Content, want) {
+		t.Errorf("Claude content %v, want %v", claude.Content, want)
+	}
+}
+
+func TestExcessiveSystemMessages(t *testing.T) {
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	s.maxSystemMessages = 3
+	send := func(count, size int) *httptest.ResponseRecorder {
+		var messages []string
+		for i := 0; i < count; i++ {
+			messages = append(messages, fmt.Sprintf(`{"role":"system","content":"rule-%d %s"}`, i, strings.Repeat("x", size)))
+		}
+		messages = append(messages, `{"role":"user","content":"hi"}`)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"DOUBAO","messages":[`+strings.Join(messages, ",")+`]}`))
+		req.Header.Set("Authorization", "Bearer system-cap-user")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		return rec
+	}
+
+	if rec := send(1000, 0); rec.Code != http.StatusOK {
+		t.Fatalf("1000 system messages: %d %s", rec.Code, rec.Body)
+	}
+	q := <-queries
+	if !strings.Contains(q, "rule-2") || strings.Contains(q, "rule-3") {
+		t.Errorf("query kept the wrong system messages: %.200q", q)
+	}
+
+	s.maxSystemChars = 100
+	rec := send(3, 50)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "system_prompt_too_long") {
+		t.Errorf("oversized system prompt: %d %s, want 400 system_prompt_too_long", rec.Code, rec.Body)
+	}
+	select {
+	case q := <-queries:
+		t.Errorf("oversized system prompt reached upstream: %.80q", q)
+	default:
+	}
+}
+
+func TestImageContentParts(t *testing.T) {
+	for _, tc := range []struct {
+		content, want string
+	}{
+		{`[{"type":"text","text":"What is this? "},{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]`,
+			"What is this? [图片：https://example.com/cat.png]"},
+		{`[{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}]`, "[图片]"},
+		{`[{"type":"input_image","image_url":"https://example.com/dog.jpg"}]`, "[图片：https://example.com/dog.jpg]"},
+		{`[{"type":"image","source":{"type":"base64","data":"iVBORw0KGgo="}}]`, "[图片]"},
+		{`[{"type":"audio","data":"..."}]`, ""},
+	} {
+		var content interface{}
+		if err := json.Unmarshal([]byte(tc.content), &content); err != nil {
+			t.Fatal(err)
+		}
+		if got := extractContent(content); got != tc.want {
+			t.Errorf("extractContent(%s) = %q, want %q", tc.content, got, tc.want)
+		}
+	}
+
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+		`{"model":"DOUBAO","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}]}`))
+	req.Header.Set("Authorization", "Bearer image-user")
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("image-only message: %d %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; !strings.Contains(q, "[图片：https://example.com/cat.png]") {
+		t.Errorf("query %q lacks the image placeholder", q)
+	}
+}
+
+func TestClaudeToolResultExtraction(t *testing.T) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"messages":[
+		{"role":"user","content":"weather in Paris?"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"weather","input":{"city":"Paris"}}]},
+		{"role":"user","content":[
+			{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"18C, cloudy"}]},
+			{"type":"tool_result","tool_use_id":"toolu_2","is_error":true,"content":"timeout"},
+			{"type":"text","text":"Summarize."}
+		]}
+	]}`), &body); err != nil {
+		t.Fatal(err)
+	}
+	_, user, _ := extractClaudeMessages(body)
+	want := "[工具结果 toolu_1]\n18C, cloudy\n[/工具结果]\n" +
+		"[工具结果 toolu_2（错误）]\ntimeout\n[/工具结果]\n" +
+		"Summarize."
+	if user != want {
+		t.Errorf("user text =\n%q\nwant\n%q", user, want)
+	}
+
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"DOUBAO","max_tokens":64,"messages":[
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_9","content":"42"}]}]}`))
+	req.Header.Set("Authorization", "Bearer tool-user")
+	rec := httptest.NewRecorder()
+	s.handleClaudeMessages(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tool_result-only message: %d %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; !strings.Contains(q, "[工具结果 toolu_9]\n42\n[/工具结果]") {
+		t.Errorf("query %q lacks the labeled tool result", q)
+	}
+}
+
+// brokenUpstream streams chunk and then drops the connection mid-stream.
+func brokenUpstream(chunk string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"answer\":%q}\n\n", chunk)
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestResponsesStreamFailedEvent(t *testing.T) {
+	s := newTestServer(t, brokenUpstream("Hel"))
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses",
+		strings.NewReader(`{"model":"DOUBAO","stream":true,"input":"hi"}`))
+	req.Header.Set("Authorization", "Bearer responses-user")
+	rec := httptest.NewRecorder()
+	s.handleResponses(rec, req)
+
+	body := rec.Body.String()
+	want := []string{"response.created", "response.in_progress", "response.output_item.added",
+		"response.content_part.added", "response.output_text.delta", "response.failed"}
+	if got := sseEvents(body); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	data := sseData(body)
+	var failed struct {
+		Type     string `json:"type"`
+		Response struct {
+			Status string `json:"status"`
+			Error  struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+			Output []struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"output"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal([]byte(data[len(data)-1]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Type != "response.failed" || failed.Response.Status != "failed" ||
+		failed.Response.Error.Code != "server_error" || failed.Response.Error.Message == "" {
+		t.Errorf("response.failed payload %+v", failed)
+	}
+	if out := failed.Response.Output; len(out) != 1 || len(out[0].Content) != 1 || out[0].Content[0].Text != "Hel" {
+		t.Errorf("response.failed output %+v, want the partial text", out)
+	}
+}
+
+func TestRawQueryMode(t *testing.T) {
+	queries := make(chan string, 1)
+	s := newTestServer(t, queryRecorder(queries))
+	s.prompts = &PromptTemplates{thinking: "Think step by step."}
+	s.rawQuery = true
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+		`{"model":"DOUBAO-thinking","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"exactly this"}]}`))
+	req.Header.Set("Authorization", "Bearer raw-user")
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d: %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; q != "exactly this" {
+		t.Errorf("raw mode sent %q upstream, want the bare user text", q)
+	}
+}
+
+func rateLimitedUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "7")
+	http.Error(w, "slow down", http.StatusTooManyRequests)
+}
+
+func TestUpstreamRateLimitShapes(t *testing.T) {
+	// Each protocol gets its own server, since the 429 pauses the shared
+	// upstream limiter for the Retry-After period.
+	s := newTestServer(t, rateLimitedUpstream)
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("limited-user", "rl", "hi"))
+	var openAI struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &openAI)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "7" || openAI.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("OpenAI: %d Retry-After=%q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+
+	s = newTestServer(t, rateLimitedUpstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"DOUBAO","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer limited-user")
+	rec = httptest.NewRecorder()
+	s.handleClaudeMessages(rec, req)
+	var claude struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &claude)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "7" ||
+		claude.Type != "error" || claude.Error.Type != "rate_limit_error" {
+		t.Errorf("Claude: %d Retry-After=%q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+}
+
+func TestStreamRateLimitEvent(t *testing.T) {
+	for _, tc := range []struct {
+		path, body string
+		serve      func(*Server) http.HandlerFunc
+		// marker is part of the error object that names the rate limit.
+		marker string
+	}{
+		{"/v1/chat/completions", `{"model":"DOUBAO","stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+			func(s *Server) http.HandlerFunc { return s.handleChatCompletions }, `"code":"rate_limit_exceeded"`},
+		{"/v1/completions", `{"model":"DOUBAO","stream":true,"prompt":"hi"}`,
+			func(s *Server) http.HandlerFunc { return s.handleCompletions }, `"code":"rate_limit_exceeded"`},
+		{"/v1/responses", `{"model":"DOUBAO","stream":true,"input":"hi"}`,
+			func(s *Server) http.HandlerFunc { return s.handleResponses }, `"code":"rate_limit_exceeded"`},
+		{"/v1/messages", `{"model":"DOUBAO","stream":true,"max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`,
+			func(s *Server) http.HandlerFunc { return s.handleClaudeMessages }, `"type":"rate_limit_error"`},
+		{"/api/chat", `{"model":"DOUBAO","messages":[{"role":"user","content":"hi"}]}`,
+			func(s *Server) http.HandlerFunc { return s.handleOllamaChat }, `rate limited`},
+		{"/v1beta/models/DOUBAO:streamGenerateContent", `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`,
+			func(s *Server) http.HandlerFunc { return s.handleGemini }, `"status":"RESOURCE_EXHAUSTED"`},
+	} {
+		// A new server each time, since the 429 pauses the upstream limiter.
+		s := newTestServer(t, rateLimitedUpstream)
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer limited-user")
+		rec := httptest.NewRecorder()
+		tc.serve(s)(rec, req)
+
+		var errObj map[string]interface{}
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			var payload map[string]interface{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &payload) != nil {
+				continue
+			}
+			if resp, ok := payload["response"].(map[string]interface{}); ok {
+				payload = resp
+			}
+			if obj, ok := payload["error"].(map[string]interface{}); ok {
+				errObj = obj
+			} else if _, ok := payload["error"]; ok {
+				errObj = payload
+			}
+		}
+		encoded, _ := json.Marshal(errObj)
+		if errObj["retry_after"] != float64(7) || !strings.Contains(string(encoded), tc.marker) {
+			t.Errorf("%s: error %s in %q", tc.path, encoded, rec.Body)
+		}
+	}
+}
+
+func TestBufferedAnswerMemoryCap(t *testing.T) {
+	gone := make(chan struct{})
+	s := newTestServer(t, endlessUpstream(`{"answer":"abcd"}`, gone))
+	s.miui.maxBufferedAnswerChars = 10
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleChatCompletions(rec, chatRequest("buffer-user", "capped", "write forever"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("non-streaming request kept buffering past the cap")
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if choice := resp.Choices[0]; choice.Message.Content != "abcdabcdab" || choice.FinishReason != "length" {
+		t.Errorf("choice %+v, want 10 characters cut for length", choice)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream was not closed at the buffered cap")
+	}
+}
+
+func TestBufferedAnswerExactlyAtCap(t *testing.T) {
+	s := newTestServer(t, answerUpstream("abcd", "efghij"))
+	s.miui.maxBufferedAnswerChars = 10
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("buffer-user", "exact", "write ten"))
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if choice := resp.Choices[0]; choice.Message.Content != "abcdefghij" || choice.FinishReason != "stop" {
+		t.Errorf("choice %+v, want the whole 10-character answer finished with stop", choice)
+	}
+}
+
+// stallingUpstream sends chunks, if any, then stalls until the client leaves.
+func stallingUpstream(gone chan<- struct{}, chunks ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() { gone <- struct{}{} }()
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: {\"answer\":%q}\n\n", chunk)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+func TestUpstreamTimeoutAbortsStall(t *testing.T) {
+	gone := make(chan struct{}, 1)
+	s := newTestServer(t, stallingUpstream(gone, "partial"))
+	s.upstreamTimeout = 150 * time.Millisecond
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("stall-user", "stall", "hi"))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request ran %v past a 150ms deadline", elapsed)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "partial") ||
+		!strings.Contains(rec.Body.String(), `"finish_reason":"length"`) {
+		t.Errorf("partial answer: %d %s, want it returned as cut short", rec.Code, rec.Body)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled upstream was not released at the deadline")
+	}
+	history, _, err := s.store.History(context.Background(), "stall-user", "stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].Content != "partial" {
+		t.Errorf("history %v, want the partial answer kept", history)
+	}
+
+	s = newTestServer(t, stallingUpstream(gone))
+	s.upstreamTimeout = 150 * time.Millisecond
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("stall-user", "silent", "hi"))
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "upstream_timeout") {
+		t.Errorf("silent upstream: %d %s, want 504 upstream_timeout", rec.Code, rec.Body)
+	}
+	<-gone
+}
+
+func TestSearchParamsReachPayload(t *testing.T) {
+	payloads := make(chan map[string]interface{}, 2)
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		payloads <- payload
+		answerUpstream("ok")(w, r)
+	})
+	for _, online := range []bool{true, false} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(fmt.Sprintf(
+			`{"model":"DOUBAO","online_search":%v,"search_depth":"deep","search_results":8,"messages":[{"role":"user","content":"hi"}]}`, online)))
+		req.Header.Set("Authorization", "Bearer search-user")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+
+		payload := <-payloads
+		depth, hasDepth := payload["searchDepth"]
+		results, hasResults := payload["searchResults"]
+		if online && (depth != "deep" || results != float64(8)) {
+			t.Errorf("online search: searchDepth %v searchResults %v", depth, results)
+		}
+		if !online && (hasDepth || hasResults) {
+			t.Errorf("search off: payload still carries searchDepth %v searchResults %v", depth, results)
+		}
+	}
+}
+
+func TestAnswerPrefixSuffix(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+	s.answerPrefix = "[Bot] "
+	s.answerSuffix = "\n-- Powered by X"
+	want := "[Bot] Hello\n-- Powered by X"
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("brand-user", "plain", "hi"))
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != want {
+		t.Errorf("non-streaming: %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("brand-user", "stream", "hi"))
+	var deltas []string
+	finishedAfter := -1
+	for _, data := range sseData(rec.Body.String()) {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		if content := chunk.Choices[0].Delta.Content; content != "" {
+			deltas = append(deltas, content)
+		}
+		if chunk.Choices[0].FinishReason != nil && finishedAfter < 0 {
+			finishedAfter = len(deltas)
+		}
+	}
+	if len(deltas) < 3 || deltas[0] != s.answerPrefix || deltas[len(deltas)-1] != s.answerSuffix ||
+		strings.Join(deltas, "") != want || finishedAfter != len(deltas) {
+		t.Errorf("streaming deltas %q, finish after %d", deltas, finishedAfter)
+	}
+
+	for _, id := range []string{"plain", "stream"} {
+		conv, err := s.store.GetConversation(context.Background(), "brand-user", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv.mu.Lock()
+		last := conv.History[len(conv.History)-1]
+		conv.mu.Unlock()
+		if last.Source != "assistant" || last.Content != "Hello" {
+			t.Errorf("%s: history holds %+v, want the bare answer", id, last)
+		}
+	}
+
+	// A client echoing the decorated answer back does not bring the
+	// decoration into history either.
+	transcript := s.undecorate([]Message{{Source: "user", Content: "hi"}, {Source: "assistant", Content: want}})
+	if transcript[1].Content != "Hello" {
+		t.Errorf("undecorate kept %q", transcript[1].Content)
+	}
+}
+
+func TestMaxStreamsPerConversation(t *testing.T) {
+	upstream, entered, release := blockingUpstream(t)
+	s := newTestServer(t, upstream)
+	s.maxStreamsPerConv = 2
+	conv, err := s.store.GetConversation(context.Background(), "streams-user", "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 2)
+	for _, content := range []string{"one", "two"} {
+		go func(content string) {
+			rec := httptest.NewRecorder()
+			s.handleChatCompletions(rec, streamChatRequest("streams-user", "hot", content))
+			done <- rec
+		}(content)
+	}
+	<-entered
+	// The second stream waits on the conversation but already holds a slot.
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&conv.Streams) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams admitted, want 2", atomic.LoadInt32(&conv.Streams))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("streams-user", "hot", "three"))
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "too_many_streams") {
+		t.Fatalf("stream past the cap: %d %s", rec.Code, rec.Body)
+	}
+	release()
+	for i := 0; i < 2; i++ {
+		if rec := <-done; rec.Code != http.StatusOK {
+			t.Errorf("admitted stream: %d %s", rec.Code, rec.Body)
+		}
+	}
+	if n := atomic.LoadInt32(&conv.Streams); n != 0 {
+		t.Errorf("%d stream slots still held", n)
+	}
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("streams-user", "hot", "four"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("stream after the others finished: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUsageTokenDetails(t *testing.T) {
+	s := newTestServer(t, thinkingUpstream)
+	s.persistSystemPrompt = true
+	const system = "Answer every question with a single number."
+
+	type usage struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens *int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+		CompletionTokensDetails struct {
+			ReasoningTokens *int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+	}
+	send := func(body string) usage {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer details-user")
+		req.Header.Set("ConversationId", "details")
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: %s", rec.Code, rec.Body)
+		}
+		var resp struct {
+			Usage *usage `json:"usage"`
+		}
+		if !strings.Contains(body, `"stream":true`) {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Usage == nil {
+				t.Fatalf("no usage in %s", rec.Body)
+			}
+			return *resp.Usage
+		}
+		for _, data := range sseData(rec.Body.String()) {
+			if json.Unmarshal([]byte(data), &resp) == nil && resp.Usage != nil {
+				return *resp.Usage
+			}
+		}
+		t.Fatalf("no usage chunk in %q", rec.Body)
+		return usage{}
+	}
+
+	reasoning := estimateTokens("Let me ") + estimateTokens("think.")
+	first := send(`{"model":"DOUBAO-thinking","messages":[{"role":"system","content":"` + system + `"},{"role":"user","content":"why?"}]}`)
+	if d := first.CompletionTokensDetails.ReasoningTokens; d == nil || *d != reasoning {
+		t.Errorf("first turn reasoning_tokens = %v, want %d", d, reasoning)
+	}
+	if first.CompletionTokens != estimateTokens("42")+reasoning {
+		t.Errorf("completion_tokens %d does not include the reasoning", first.CompletionTokens)
+	}
+	if d := first.PromptTokensDetails.CachedTokens; d == nil || *d != 0 {
+		t.Errorf("first turn cached_tokens = %v, want 0", d)
+	}
+
+	second := send(`{"model":"DOUBAO","deep_thinking":false,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"again?"}]}`)
+	if d := second.PromptTokensDetails.CachedTokens; d == nil || *d != estimateTokens(system) || *d > second.PromptTokens {
+		t.Errorf("second turn cached_tokens = %v, want %d of %d prompt tokens", d, estimateTokens(system), second.PromptTokens)
+	}
+	if d := second.CompletionTokensDetails.ReasoningTokens; d == nil || *d != 0 {
+		t.Errorf("second turn without deep thinking: reasoning_tokens = %v", d)
+	}
+}
+
+func TestStreamFallbackWithoutFlusher(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+		want    string
+	}{
+		{"/v1/chat/completions", s.handleChatCompletions,
+			`{"model":"DOUBAO","stream":true,"messages":[{"role":"user","content":"hi"}]}`, `"object":"chat.completion"`},
+		{"/v1/messages", s.handleClaudeMessages,
+			`{"model":"DOUBAO","stream":true,"max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`, `"type":"message"`},
+		{"/v1/responses", s.handleResponses,
+			`{"model":"DOUBAO","stream":true,"input":"hi"}`, `"object":"response"`},
+	} {
+		for _, fallback := range []bool{false, true} {
+			s.streamFallback = fallback
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer fallback-user")
+			req.Header.Set("ConversationId", fmt.Sprintf("%s-%v", tc.path, fallback))
+			rec := httptest.NewRecorder()
+			// The embedded interface hides the recorder's Flush.
+			tc.handler(struct{ http.ResponseWriter }{rec}, req)
+
+			if !fallback {
+				if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "stream_unsupported") {
+					t.Errorf("%s without fallback: %d %s", tc.path, rec.Code, rec.Body)
+				}
+				continue
+			}
+			var resp map[string]interface{}
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+				t.Errorf("%s fallback: %d %q, want one JSON response", tc.path, rec.Code, rec.Body)
+				continue
+			}
+			if !strings.Contains(rec.Body.String(), tc.want) || !strings.Contains(rec.Body.String(), "Hello") {
+				t.Errorf("%s fallback: %s", tc.path, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("%s fallback: Content-Type %q", tc.path, ct)
+			}
+		}
+	}
+}
+
+func TestResponsesStreamEventOrder(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses",
+		strings.NewReader(`{"model":"DOUBAO","stream":true,"input":"hi"}`))
+	req.Header.Set("Authorization", "Bearer responses-user")
+	rec := httptest.NewRecorder()
+	s.handleResponses(rec, req)
+
+	body := rec.Body.String()
+	want := []string{"response.created", "response.in_progress", "response.output_item.added",
+		"response.content_part.added", "response.output_text.delta", "response.output_text.delta",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done", "response.completed"}
+	if got := sseEvents(body); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+
+	var itemID, responseID string
+	for i, data := range sseData(body) {
+		var event struct {
+			Type         string `json:"type"`
+			ItemID       string `json:"item_id"`
+			OutputIndex  *int   `json:"output_index"`
+			ContentIndex *int   `json:"content_index"`
+			Text         string `json:"text"`
+			Item         struct {
+				ID string `json:"id"`
+			} `json:"item"`
+			Part struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"part"`
+			Response struct {
+				ID     string `json:"id"`
+				Output []struct {
+					ID string `json:"id"`
+				} `json:"output"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != want[i] {
+			t.Errorf("event %d has type %q under event name %q", i, event.Type, want[i])
+		}
+		switch event.Type {
+		case "response.created", "response.in_progress":
+			if responseID == "" {
+				responseID = event.Response.ID
+			}
+			if event.Response.ID != responseID {
+				t.Errorf("%s: response id %q, want %q", event.Type, event.Response.ID, responseID)
+			}
+		case "response.output_item.added", "response.output_item.done":
+			if itemID == "" {
+				itemID = event.Item.ID
+			}
+			if event.Item.ID != itemID || event.OutputIndex == nil || *event.OutputIndex != 0 {
+				t.Errorf("%s: item %q at output_index %v", event.Type, event.Item.ID, event.OutputIndex)
+			}
+		case "response.completed":
+			if event.Response.ID != responseID || len(event.Response.Output) != 1 || event.Response.Output[0].ID != itemID {
+				t.Errorf("completed: %s", data)
+			}
+		default:
+			if event.ItemID != itemID || event.OutputIndex == nil || *event.OutputIndex != 0 ||
+				event.ContentIndex == nil || *event.ContentIndex != 0 {
+				t.Errorf("%s: item_id %q output_index %v content_index %v, want %q 0 0",
+					event.Type, event.ItemID, event.OutputIndex, event.ContentIndex, itemID)
+			}
+		}
+		if event.Type == "response.output_text.done" && event.Text != "Hello" ||
+			event.Type == "response.content_part.done" && event.Part.Text != "Hello" {
+			t.Errorf("%s does not carry the full text: %s", event.Type, data)
+		}
+	}
+	if itemID == "" || responseID == "" {
+		t.Errorf("missing ids: item %q response %q", itemID, responseID)
+	}
+}
+
+func TestThinkingTimeoutIsGatewayTimeout(t *testing.T) {
+	gone := make(chan struct{})
+	s := newTestServer(t, endlessUpstream(`{"intentionInfo":{"intentionText":"thinking"}}`, gone))
+	s.miui.thinkingTimeout = 100 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("thinking-user", "slow", "think hard"))
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusGatewayTimeout || resp.Error.Code != "upstream_timeout" {
+		t.Errorf("status %d: %s; want 504 upstream_timeout", rec.Code, rec.Body)
+	}
+	<-gone
+}
+
+func TestChatErrorSameStatusEveryProtocol(t *testing.T) {
+	paths := []string{"/v1/chat/completions", "/v1/messages", "/api/chat", geminiPathPrefix + "DOUBAO:generateContent"}
+	for _, tc := range []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{&RateLimitError{RetryAfter: 3 * time.Second}, http.StatusTooManyRequests, "3"},
+		{&ContextLengthError{Tokens: 10, Limit: 5}, http.StatusBadRequest, ""},
+		{&SystemPromptLengthError{Chars: 10, Limit: 5}, http.StatusBadRequest, ""},
+		{&PayloadTooLargeError{Bytes: 10, Limit: 5}, http.StatusBadRequest, ""},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ""},
+		{errThinkingTimeout, http.StatusGatewayTimeout, ""},
+		{errStreamInterrupted, http.StatusBadGateway, ""},
+	} {
+		for _, path := range paths {
+			rec := httptest.NewRecorder()
+			writeChatError(rec, httptest.NewRequest(http.MethodPost, path, nil), tc.err)
+			if rec.Code != tc.status || rec.Header().Get("Retry-After") != tc.retryAfter {
+				t.Errorf("%v on %s: %d Retry-After=%q, want %d %q", tc.err, path, rec.Code,
+					rec.Header().Get("Retry-After"), tc.status, tc.retryAfter)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == nil {
+				t.Errorf("%v on %s: body %s", tc.err, path, rec.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout    = 30 * time.Second
+	defaultShutdownRetryAfter = 5
+	// defaultShutdownDrainDelay keeps the listener open long enough for
+	// clients to see a 503 with Retry-After instead of a refused connection,
+	// while staying inside Docker's default 10s stop grace period.
+	defaultShutdownDrainDelay = 2 * time.Second
+)
+
+// shutdownGate rejects new requests once shutdown has begun while tracking
+// the in-flight ones so they can drain before the store is closed.
+type shutdownGate struct {
+	closing    atomic.Bool
+	inflight   sync.WaitGroup
+	retryAfter int
+}
+
+func newShutdownGate(retryAfter int) *shutdownGate {
+	if retryAfter <= 0 {
+		retryAfter = defaultShutdownRetryAfter
+	}
+	return &shutdownGate{retryAfter: retryAfter}
+}
+
+// Begin marks the server as shutting down; subsequent requests get a 503.
+func (g *shutdownGate) Begin() {
+	g.closing.Store(true)
+}
+
+// Wait blocks until in-flight requests finish or ctx is done.
+func (g *shutdownGate) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *shutdownGate) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.closing.Load() {
+			g.reject(w, r)
+			return
+		}
+		g.inflight.Add(1)
+		defer g.inflight.Done()
+		// Re-check so a request racing Begin cannot slip past Wait.
+		if g.closing.Load() {
+			g.reject(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *shutdownGate) reject(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(g.retryAfter))
+	w.Header().Set("Connection", "close")
+	writeProtocolError(w, r.URL.Path, http.StatusServiceUnavailable, "server is shutting down",
+		"api_error", "server_shutting_down")
+}
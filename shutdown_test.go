@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownGateRejectsNewRequests(t *testing.T) {
+	gate := newShutdownGate(7)
+	handler := gate.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("before shutdown: status %d", rec.Code)
+	}
+
+	gate.Begin()
+	for _, tc := range []struct{ path, marker string }{
+		{"/v1/chat/completions", "server_shutting_down"},
+		{"/v1/messages", "api_error"},
+		{"/api/chat", "server is shutting down"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.path, nil))
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "7" ||
+			!strings.Contains(rec.Body.String(), tc.marker) {
+			t.Errorf("%s: %d Retry-After=%q %s", tc.path, rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+		}
+	}
+}
+
+func TestShutdownGateWaitsForInflight(t *testing.T) {
+	gate := newShutdownGate(0)
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := gate.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-entered
+	gate.Begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := gate.Wait(ctx); err == nil {
+		t.Fatal("Wait returned while a request was in flight")
+	}
+
+	close(release)
+	if err := gate.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSSEKeepAlive = 15 * time.Second
+
+// sseWriter serializes writes and flushes on a streaming response, so
+// content chunks, pings and queue notices may come from different goroutines.
+// Every method flushes before releasing the lock.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	// lastWrite is when a frame last went out; closed refuses writes once
+	// the handler is done with the response.
+	lastWrite time.Time
+	closed    bool
+	stop      chan struct{}
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := flusherOf(w)
+	if !ok {
+		return nil, false
+	}
+	return &sseWriter{w: w, flusher: flusher, lastWrite: time.Now(), stop: make(chan struct{})}, true
+}
+
+// newStreamWriter prepares a streaming response: SSE, padded with
+// SSE_INITIAL_PADDING and kept alive every SSE_KEEPALIVE, or newline-delimited JSON when the client sends
+// Accept: application/x-ndjson or STREAM_FORMAT=ndjson makes it the default.
+// Ollama streams are always NDJSON.
+func (s *Server) newStreamWriter(w http.ResponseWriter, r *http.Request) (*sseWriter, bool) {
+	sw, ok := newSSEWriter(w)
+	if !ok {
+		return nil, false
+	}
+	ndjson := s.ndjsonStreams || isOllamaPath(r.URL.Path) ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if !ndjson {
+		sw.Pad(s.ssePadding)
+		sw.keepAlive(s.sseKeepAlive)
+		return sw, true
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	sw.w = &ndjsonFramer{ResponseWriter: w}
+	return sw, true
+}
+
+// ndjsonFramer rewrites the SSE frames written through it as newline-delimited
+// JSON: each data payload becomes one line and comments and the [DONE]
+// sentinel are dropped. An event name is kept as the payload's "type" when
+// the payload has none. Frames always arrive as whole lines.
+type ndjsonFramer struct {
+	http.ResponseWriter
+	event string
+}
+
+func (f *ndjsonFramer) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			f.event = event
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		event := f.event
+		f.event = ""
+		if data == "[DONE]" {
+			continue
+		}
+		if event != "" {
+			data = withEventType(data, event)
+		}
+		if _, err := f.ResponseWriter.Write([]byte(data + "\n")); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *ndjsonFramer) Flush() {
+	if flusher, ok := flusherOf(f.ResponseWriter); ok {
+		flusher.Flush()
+	}
+}
+
+func (f *ndjsonFramer) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// withEventType adds "type": event to a JSON object payload lacking one.
+func withEventType(data, event string) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(data), &fields) != nil {
+		return data
+	}
+	if _, ok := fields["type"]; ok {
+		return data
+	}
+	fields["type"], _ = json.Marshal(event)
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return string(out)
+}
+
+// Data writes a data-only frame.
+func (sw *sseWriter) Data(payload interface{}) {
+	sw.Batch(func(w http.ResponseWriter) { writeSSEData(w, payload) })
+}
+
+// Event writes a named event frame.
+func (sw *sseWriter) Event(event string, payload interface{}) {
+	sw.Batch(func(w http.ResponseWriter) { writeSSEEvent(w, event, payload) })
+}
+
+// Line writes raw SSE text such as a comment or the [DONE] sentinel.
+func (sw *sseWriter) Line(line string) {
+	sw.Batch(func(w http.ResponseWriter) { writeSSELine(w, line) })
+}
+
+// Pad writes an SSE comment of n bytes and flushes it, nudging buffering
+// intermediaries into forwarding the stream. It is a no-op when n <= 0.
+func (sw *sseWriter) Pad(n int) {
+	if n <= 0 {
+		return
+	}
+	sw.Line(":" + strings.Repeat(" ", n) + "\n\n")
+}
+
+// Batch runs fn with the writer locked so several frames go out together.
+// After Close it does nothing.
+func (sw *sseWriter) Batch(fn func(w http.ResponseWriter)) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return
+	}
+	fn(sw.w)
+	sw.flusher.Flush()
+	sw.lastWrite = time.Now()
+}
+
+// keepAlive writes a ": keepalive" comment whenever nothing has been sent
+// for interval, so idle-closing proxies keep the connection open while the
+// upstream thinks. Once content flows the comments stop on their own. It is a
+// no-op when interval <= 0.
+func (sw *sseWriter) keepAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sw.stop:
+				return
+			case <-ticker.C:
+			}
+			sw.mu.Lock()
+			idle := time.Since(sw.lastWrite) >= interval
+			sw.mu.Unlock()
+			if idle {
+				sw.Line(": keepalive\n\n")
+			}
+		}
+	}()
+}
+
+// Close stops the keepalive and refuses further writes; handlers defer it
+// so nothing is written after they return.
+func (sw *sseWriter) Close() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.closed {
+		sw.closed = true
+		close(sw.stop)
+	}
+}
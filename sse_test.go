@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSSEWriterConcurrentWrites drives content, ping, queue-notice and
+// keepalive writers at once; run it under -race. The recorder is not safe
+// for concurrent use, so any unserialized write is reported.
+func TestSSEWriterConcurrentWrites(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw, ok := newSSEWriter(rec)
+	if !ok {
+		t.Fatal("recorder should be flushable")
+	}
+	sw.keepAlive(50 * time.Microsecond)
+
+	const writers, frames = 4, 100
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < frames; i++ {
+				sw.Data(map[string]string{"chunk": fmt.Sprintf("%d-%d", g, i)})
+			}
+		}(g)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < frames; i++ {
+			sw.Event("ping", map[string]string{"type": "ping"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < frames; i++ {
+			sw.Line(fmt.Sprintf(": queue position %d\n\n", i))
+		}
+	}()
+	wg.Wait()
+	sw.Close()
+	sw.Data(map[string]string{"chunk": "after close"})
+
+	data, pings := 0, 0
+	for _, frame := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n\n"), "\n\n") {
+		switch {
+		case strings.HasPrefix(frame, "data: "):
+			if strings.Contains(frame, "after close") {
+				t.Fatal("frame written after Close")
+			}
+			data++
+		case strings.HasPrefix(frame, "event: ping\ndata: "):
+			pings++
+		case strings.HasPrefix(frame, ":"):
+		default:
+			t.Fatalf("interleaved frame %q", frame)
+		}
+	}
+	if data != writers*frames || pings != frames {
+		t.Errorf("got %d data and %d ping frames, want %d and %d", data, pings, writers*frames, frames)
+	}
+}
+
+func TestStreamWriterNDJSON(t *testing.T) {
+	s := &Server{ssePadding: 16, sseKeepAlive: time.Hour}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	sw, ok := s.newStreamWriter(rec, req)
+	if !ok {
+		t.Fatal("recorder should be flushable")
+	}
+	defer sw.Close()
+
+	sw.Event("message_start", map[string]string{"id": "m1"})
+	sw.Line(": queue position 1\n\n")
+	sw.Data(map[string]string{"type": "delta"})
+	sw.Line("data: [DONE]\n\n")
+
+	want := `{"id":"m1","type":"message_start"}` + "\n" + `{"type":"delta"}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestInitialPadding(t *testing.T) {
+	for _, padding := range []int{0, 2048} {
+		s := newTestServer(t, answerUpstream("ok"))
+		s.ssePadding = padding
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, streamChatRequest("padding-user", "pad", "hi"))
+		body := rec.Body.String()
+
+		pad := ":" + strings.Repeat(" ", padding) + "\n\n"
+		if padding == 0 {
+			if strings.HasPrefix(body, ":") {
+				t.Errorf("padding sent while disabled: %.40q", body)
+			}
+			continue
+		}
+		if !strings.HasPrefix(body, pad) {
+			t.Fatalf("stream does not open with %d bytes of padding: %.40q", padding, body)
+		}
+		if !strings.HasPrefix(body[len(pad):], "data: ") {
+			t.Errorf("first event does not follow the padding: %.40q", body[len(pad):])
+		}
+	}
+}
+
+func TestChatStreamFramingFollowsAccept(t *testing.T) {
+	s := newTestServer(t, answerUpstream("Hel", "lo"))
+	for _, accept := range []string{"", "application/x-ndjson"} {
+		req := streamChatRequest("framing-user", "framing-"+accept, "hi")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.handleChatCompletions(rec, req)
+		body := rec.Body.String()
+
+		if accept == "" {
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+				t.Errorf("SSE: Content-Type = %q", ct)
+			}
+			if !strings.Contains(body, "data: [DONE]\n\n") || len(sseData(body)) < 3 {
+				t.Errorf("SSE body = %q", body)
+			}
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("NDJSON: Content-Type = %q", ct)
+		}
+		var content strings.Builder
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		for _, line := range lines {
+			var chunk struct {
+				Object  string `json:"object"`
+				Choices []struct {
+					Delta struct {
+						Content string `json:"content"`
+					} `json:"delta"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal([]byte(line), &chunk); err != nil || chunk.Object != "chat.completion.chunk" {
+				t.Fatalf("NDJSON line %q: %v", line, err)
+			}
+			if len(chunk.Choices) > 0 {
+				content.WriteString(chunk.Choices[0].Delta.Content)
+			}
+		}
+		if content.String() != "Hello" || len(lines) < 3 {
+			t.Errorf("NDJSON: %d lines with content %q", len(lines), content.String())
+		}
+	}
+}
+
+func TestKeepaliveBeforeSlowContent(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		answerUpstream("late")(w, r)
+	})
+	s.sseKeepAlive = 20 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("keepalive-user", "slow", "hi"))
+	body := rec.Body.String()
+	heartbeat := strings.Index(body, ": keepalive\n\n")
+	content := strings.Index(body, `"late"`)
+	if heartbeat < 0 || content < 0 || heartbeat > content {
+		t.Errorf("no keepalive before the first content: %q", body)
+	}
+}
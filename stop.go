@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var errStopSequence = errors.New("stop sequence reached")
+
+// stopFilter applies client stop sequences to answer chunks. Text that could
+// be the start of a stop sequence is held back until the next chunk shows
+// whether it is, so sequences split across chunks are still caught.
+type stopFilter struct {
+	stops   []string
+	emit    func(string)
+	onMatch func()
+
+	pending string
+	text    strings.Builder
+	matched string
+}
+
+func newStopFilter(stops []string, emit func(string), onMatch func()) *stopFilter {
+	return &stopFilter{stops: stops, emit: emit, onMatch: onMatch}
+}
+
+// Write takes the next answer chunk. After a match everything is dropped.
+func (f *stopFilter) Write(chunk string) {
+	if f.matched != "" {
+		return
+	}
+	buf := f.pending + chunk
+	cut := -1
+	for _, stop := range f.stops {
+		if i := strings.Index(buf, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut, f.matched = i, stop
+		}
+	}
+	if cut >= 0 {
+		f.pending = ""
+		f.forward(buf[:cut])
+		f.onMatch()
+		return
+	}
+	keep := f.heldBack(buf)
+	f.pending = buf[len(buf)-keep:]
+	f.forward(buf[:len(buf)-keep])
+}
+
+// Flush releases held-back text once the answer has ended without a match.
+func (f *stopFilter) Flush() {
+	if f.matched == "" {
+		f.forward(f.pending)
+	}
+	f.pending = ""
+}
+
+// Text is the answer up to the stop sequence, or up to what was flushed.
+func (f *stopFilter) Text() string {
+	return f.text.String()
+}
+
+// Matched is the stop sequence that ended the answer, or "".
+func (f *stopFilter) Matched() string {
+	return f.matched
+}
+
+// heldBack returns the length of the longest suffix of buf that is a proper
+// prefix of a stop sequence.
+func (f *stopFilter) heldBack(buf string) int {
+	longest := 0
+	for _, stop := range f.stops {
+		n := len(stop) - 1
+		if n > len(buf) {
+			n = len(buf)
+		}
+		for ; n > longest; n-- {
+			if strings.HasPrefix(stop, buf[len(buf)-n:]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+func (f *stopFilter) forward(text string) {
+	if text == "" {
+		return
+	}
+	f.text.WriteString(text)
+	if f.emit != nil {
+		f.emit(text)
+	}
+}
+
+// parseStopSequences reads OpenAI stop (a string or an array) and Claude
+// stop_sequences, dropping empty entries.
+func parseStopSequences(body map[string]interface{}) []string {
+	var stops []string
+	for _, key := range []string{"stop", "stop_sequences"} {
+		switch v := body[key].(type) {
+		case string:
+			if v != "" {
+				stops = append(stops, v)
+			}
+		case []interface{}:
+			for _, item := range v {
+				if s, _ := item.(string); s != "" {
+					stops = append(stops, s)
+				}
+			}
+		}
+	}
+	return stops
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStopFilter(t *testing.T) {
+	for _, tc := range []struct {
+		chunks  []string
+		stops   []string
+		emitted []string
+		matched string
+	}{
+		{[]string{"Hello E", "ND more"}, []string{"END"}, []string{"Hello ", ""}, "END"},
+		{[]string{"Hello", " world"}, []string{"END"}, []string{"Hello", " world"}, ""},
+		{[]string{"a E", "N", "X b"}, []string{"END"}, []string{"a ", "", "ENX b"}, ""},
+		{[]string{"x##y", "STOP"}, []string{"STOP", "##"}, []string{"x"}, "##"},
+		{[]string{"你好世", "界再见"}, []string{"世界"}, []string{"你好", ""}, "世界"},
+	} {
+		var emitted []string
+		matches := 0
+		f := newStopFilter(tc.stops, func(text string) { emitted = append(emitted, text) }, func() { matches++ })
+		for _, chunk := range tc.chunks {
+			f.Write(chunk)
+		}
+		f.Flush()
+
+		want := strings.Join(tc.emitted, "")
+		if got := strings.Join(emitted, ""); got != want || f.Text() != want {
+			t.Errorf("%q with %q: emitted %q, text %q; want %q", tc.chunks, tc.stops, got, f.Text(), want)
+		}
+		if f.Matched() != tc.matched || matches != map[bool]int{true: 1}[tc.matched != ""] {
+			t.Errorf("%q with %q: matched %q %d times, want %q", tc.chunks, tc.stops, f.Matched(), matches, tc.matched)
+		}
+	}
+}
+
+func TestStopSequenceSplitAcrossChunks(t *testing.T) {
+	s := newTestServer(t, answerUpstream("The answer E", "ND of text"))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"DOUBAO","stream":true,"stop":"END","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer stop-user")
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, req)
+	var content strings.Builder
+	var finish []string
+	for _, data := range sseData(rec.Body.String()) {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		if reason := chunk.Choices[0].FinishReason; reason != nil {
+			finish = append(finish, *reason)
+		}
+	}
+	if content.String() != "The answer " || !reflect.DeepEqual(finish, []string{"stop"}) {
+		t.Errorf("OpenAI stream: content %q, finish %v", content.String(), finish)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(
+		`{"model":"DOUBAO","max_tokens":64,"stop_sequences":["END"],"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer stop-user")
+	req.Header.Set("ConversationId", "claude")
+	rec = httptest.NewRecorder()
+	s.handleClaudeMessages(rec, req)
+	var claude struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason   string `json:"stop_reason"`
+		StopSequence string `json:"stop_sequence"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &claude); err != nil {
+		t.Fatal(err)
+	}
+	if len(claude.Content) != 1 || claude.Content[0].Text != "The answer " ||
+		claude.StopReason != "stop_sequence" || claude.StopSequence != "END" {
+		t.Errorf("Claude: %s", rec.Body)
+	}
+}
@@ -1,26 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	_ "modernc.org/sqlite"
 )
 
 const (
-	persistAfter  = 30 * time.Second
-	evictAfter    = 60 * time.Second
-	cleanupPeriod = 5 * time.Second
+	defaultPersistAfter  = 30 * time.Second
+	defaultEvictAfter    = 60 * time.Second
+	defaultCleanupPeriod = 5 * time.Second
+
+	defaultMaxCachedUsers = 10000
 )
 
 type Message struct {
 	Source  string `json:"source"`
 	Content string `json:"content"`
+	// ToolCallID links a "tool" message to the assistant tool call it
+	// answers.
+	ToolCallID string `json:"toolCallId,omitempty"`
 }
 
 type Conversation struct {
@@ -29,40 +44,172 @@ type Conversation struct {
 	OAID           string
 	MiID           string
 	InternalID     string
+	// Device is the owner's sticky device profile; scratch conversations
+	// leave it empty and get the default profile. It is guarded by
+	// deviceMu rather than mu so a ban can move it without waiting for an
+	// in-flight answer.
+	deviceMu sync.Mutex
+	Device   DeviceProfile
+
+	mu    sync.Mutex
+	InUse int32
+	// Streams counts the streaming requests admitted on the conversation,
+	// bounded by MAX_STREAMS_PER_CONV.
+	Streams int32
+	// Busy is set while a request holds the conversation under
+	// CONVERSATION_BUSY_POLICY=reject; see claimConversation.
+	Busy int32
 
-	mu          sync.Mutex
-	InUse       int32
 	History     []Message
 	LastActive  time.Time
 	LastPersist time.Time
 	Dirty       bool
+
+	// Reloaded is set when the conversation was restored from SQLite rather
+	// than created fresh in this process.
+	Reloaded bool
+	// Summary condenses History[:SummaryUpTo]; only the remaining messages
+	// are sent upstream verbatim.
+	Summary     string
+	SummaryUpTo int
+	// SystemPrompt is the durable system context set on the first turn.
+	SystemPrompt string
+	// PromptTokens and CompletionTokens are running estimates over all
+	// recorded turns.
+	PromptTokens     int
+	CompletionTokens int
+
+	// rawHistory caches the last compressed history window; see
+	// compressWindow.
+	rawHistory historyCache
+}
+
+// resolveSystemPrompt returns the system prompt for this turn. A prompt sent
+// on the first turn becomes the conversation's durable system context and is
+// reused by later turns that omit one.
+func (c *Conversation) resolveSystemPrompt(systemPrompt string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if systemPrompt != "" {
+		if c.SystemPrompt == "" && len(c.History) == 0 {
+			c.SystemPrompt = systemPrompt
+			c.Dirty = true
+		}
+		return systemPrompt
+	}
+	return c.SystemPrompt
+}
+
+// upstreamHistory returns the part of History not covered by Summary.
+func (c *Conversation) upstreamHistory() []Message {
+	if c.SummaryUpTo <= 0 || c.SummaryUpTo > len(c.History) {
+		return c.History
+	}
+	return c.History[c.SummaryUpTo:]
+}
+
+var errStoreClosed = errors.New("store is closed")
+
+// errUnknownUser reports a user key that has never been seen.
+var errUnknownUser = errors.New("unknown key")
+
+// CorruptHistoryError reports a stored history that could not be decoded
+// while STRICT_HISTORY is on.
+type CorruptHistoryError struct {
+	ConversationID string
+	Err            error
+}
+
+func (e *CorruptHistoryError) Error() string {
+	return fmt.Sprintf("stored history of conversation %q is corrupted", e.ConversationID)
 }
 
+func (e *CorruptHistoryError) Unwrap() error { return e.Err }
+
 type Store struct {
 	db *sql.DB
 
 	mu    sync.RWMutex
 	convs map[string]*Conversation
+	// loading holds conversations being loaded, keyed like convs, so
+	// concurrent first requests wait for one load instead of racing.
+	loading map[string]*conversationLoad
+
+	// users is an LRU cache in front of the users table, bounded by maxUsers.
+	userMu    sync.Mutex
+	users     map[string]*list.Element
+	userOrder *list.List
+	maxUsers  int
+
+	// fingerprints assigns each user a device profile kept in the users
+	// table until the profile is banned.
+	fingerprints *FingerprintPool
 
-	userMu sync.RWMutex
-	users  map[string]*User
+	compressHistory     bool
+	sharedConversations bool
+	eviction            evictionPolicy
+	// strictHistory fails GetConversation on an undecodable history instead
+	// of starting over empty; quarantineHistory copies such rows into
+	// corrupt_conversations before they are overwritten.
+	strictHistory     bool
+	quarantineHistory bool
+
+	// persistAfter is how long a dirty conversation waits before it is
+	// written; evictAfter is the inactivity TTL; cleanupPeriod is how often
+	// the cleanup loop checks both.
+	persistAfter  time.Duration
+	evictAfter    time.Duration
+	cleanupPeriod time.Duration
 
 	writeCh chan writeRequest
 	stopCh  chan struct{}
+	// sendMu guards writeCh against sends racing its close: senders hold
+	// it for reading, Close takes it for writing before closing writeCh.
+	sendMu    sync.RWMutex
+	closed    bool
+	loops     sync.WaitGroup
+	writeDone chan struct{}
 }
 
 type User struct {
 	OAID string
 	MiID string
+	// Fingerprint is the id of the user's device profile.
+	Fingerprint string
+}
+
+type conversationLoad struct {
+	done chan struct{}
+	conv *Conversation
+	err  error
+}
+
+type cachedUser struct {
+	key  string
+	user *User
 }
 
 type writeRequest struct {
-	fn   func(*sql.Tx) error
+	fn func(*sql.Tx) error
+	// db, when set, runs outside a transaction instead of fn; statements
+	// such as wal_checkpoint cannot run inside one.
+	db   func(*sql.DB) error
 	done chan error
 }
 
 func NewStore(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	dsn := dbPath
+	if pages := envInt("WAL_AUTOCHECKPOINT", 0); pages > 0 {
+		// wal_autocheckpoint is per connection, so it goes in the DSN to
+		// apply to every pooled connection.
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += fmt.Sprintf("%s_pragma=wal_autocheckpoint(%d)", sep, pages)
+	}
+
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -94,33 +241,166 @@ CREATE TABLE IF NOT EXISTS conversations (
   updated_at INTEGER NOT NULL,
   PRIMARY KEY (user_key, conversation_id)
 );
+
+CREATE INDEX IF NOT EXISTS conversations_updated_at ON conversations (updated_at);
+
+CREATE TABLE IF NOT EXISTS corrupt_conversations (
+  user_key TEXT NOT NULL,
+  conversation_id TEXT NOT NULL,
+  history_json BLOB NOT NULL,
+  error TEXT NOT NULL,
+  quarantined_at INTEGER NOT NULL
+);
 `
 	if _, err := db.Exec(schema); err != nil {
 		return nil, err
 	}
+	if err := addColumnIfMissing(db, "users", "fingerprint", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "conversations", "summary", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "conversations", "summary_upto", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "conversations", "system_prompt", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "conversations", "prompt_tokens", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "conversations", "completion_tokens", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	persistAfter := envDuration("PERSIST_AFTER", defaultPersistAfter)
+	evictAfter := envDuration("EVICT_AFTER", defaultEvictAfter)
+	cleanupPeriod := envDuration("CLEANUP_PERIOD", defaultCleanupPeriod)
+	if persistAfter <= 0 {
+		persistAfter = defaultPersistAfter
+	}
+	if cleanupPeriod <= 0 {
+		cleanupPeriod = defaultCleanupPeriod
+	}
+	if evictAfter < persistAfter {
+		// Eviction persists anyway, but a TTL shorter than the persist
+		// delay would make PERSIST_AFTER meaningless.
+		log.Printf("EVICT_AFTER %s is shorter than PERSIST_AFTER %s; using %s", evictAfter, persistAfter, persistAfter)
+		evictAfter = persistAfter
+	}
+
+	fingerprints, err := LoadFingerprintPool(os.Getenv("FINGERPRINT_POOL_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	eviction, err := newEvictionPolicy(os.Getenv("EVICTION_POLICY"), evictAfter, envInt("MAX_LIVE_CONVERSATIONS", 0))
+	if err != nil {
+		return nil, err
+	}
 
 	store := &Store{
-		db:      db,
-		convs:   make(map[string]*Conversation),
-		users:   make(map[string]*User),
-		writeCh: make(chan writeRequest, 1024),
-		stopCh:  make(chan struct{}),
+		db:        db,
+		convs:     make(map[string]*Conversation),
+		loading:   make(map[string]*conversationLoad),
+		users:     make(map[string]*list.Element),
+		userOrder: list.New(),
+		maxUsers:  envInt("MAX_CACHED_USERS", defaultMaxCachedUsers),
+
+		fingerprints: fingerprints,
+
+		writeCh:   make(chan writeRequest, 1024),
+		stopCh:    make(chan struct{}),
+		writeDone: make(chan struct{}),
+
+		compressHistory:     envBool("COMPRESS_STORED_HISTORY", false),
+		sharedConversations: envBool("SHARED_CONVERSATIONS", false),
+		eviction:            eviction,
+		strictHistory:       envBool("STRICT_HISTORY", false),
+		quarantineHistory:   envBool("QUARANTINE_CORRUPT_HISTORY", false),
+
+		persistAfter:  persistAfter,
+		evictAfter:    evictAfter,
+		cleanupPeriod: cleanupPeriod,
 	}
 
 	go store.writeLoop()
+	store.loops.Add(1)
 	go store.cleanupLoop()
+	if interval := envDuration("WAL_CHECKPOINT_INTERVAL", 0); interval > 0 {
+		store.loops.Add(1)
+		go store.checkpointLoop(interval)
+	}
 
 	return store, nil
 }
 
+// addColumnIfMissing migrates databases created before a column existed.
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+// Close stops the background loops, then closes the write queue once no
+// sender can still be using it, and waits for queued writes to commit.
 func (s *Store) Close() error {
 	close(s.stopCh)
+	s.loops.Wait()
+
+	s.sendMu.Lock()
+	s.closed = true
 	close(s.writeCh)
+	s.sendMu.Unlock()
+	<-s.writeDone
+
 	return s.db.Close()
 }
 
+// enqueue submits req to the write loop. It reports false, without sending,
+// once the store is stopping.
+func (s *Store) enqueue(req writeRequest) bool {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case <-s.stopCh:
+		return false
+	case s.writeCh <- req:
+		return true
+	}
+}
+
 func (s *Store) writeLoop() {
+	defer close(s.writeDone)
 	for req := range s.writeCh {
+		if req.db != nil {
+			err := req.db(s.db)
+			if req.done != nil {
+				req.done <- err
+			}
+			continue
+		}
+
 		tx, err := s.db.Begin()
 		if err != nil {
 			if req.done != nil {
@@ -135,15 +415,40 @@ func (s *Store) writeLoop() {
 			}
 			continue
 		}
+		start := time.Now()
 		err = tx.Commit()
+		dbCommitDuration.Observe(time.Since(start).Seconds())
 		if req.done != nil {
 			req.done <- err
 		}
 	}
 }
 
+// checkpointLoop periodically truncates the WAL. Checkpoints are queued on
+// the write loop so they never contend with our own write transactions.
+func (s *Store) checkpointLoop(interval time.Duration) {
+	defer s.loops.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+		if !s.enqueue(writeRequest{db: func(db *sql.DB) error {
+			_, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`)
+			return err
+		}}) {
+			return
+		}
+	}
+}
+
 func (s *Store) cleanupLoop() {
-	ticker := time.NewTicker(cleanupPeriod)
+	defer s.loops.Done()
+	ticker := time.NewTicker(s.cleanupPeriod)
 	defer ticker.Stop()
 
 	for {
@@ -153,24 +458,33 @@ func (s *Store) cleanupLoop() {
 		case <-ticker.C:
 		}
 		now := time.Now()
-		var evictKeys []string
+		var idle []evictionCandidate
 
 		s.mu.RLock()
+		live := len(s.convs)
 		for key, conv := range s.convs {
 			if atomic.LoadInt32(&conv.InUse) > 0 {
 				continue
 			}
 
-			if conv.Dirty && now.Sub(conv.LastPersist) >= persistAfter {
+			// A request may claim the conversation after the InUse check;
+			// skip it rather than wait out its upstream call.
+			if !conv.mu.TryLock() {
+				continue
+			}
+			due := conv.Dirty && now.Sub(conv.LastPersist) >= s.persistAfter
+			lastActive := conv.LastActive
+			conv.mu.Unlock()
+			if due {
 				s.persistConversation(conv, now)
 			}
 
-			if now.Sub(conv.LastActive) >= evictAfter {
-				evictKeys = append(evictKeys, key)
-			}
+			idle = append(idle, evictionCandidate{key: key, lastActive: lastActive})
 		}
 		s.mu.RUnlock()
 
+		evictKeys := s.eviction.choose(now, live, idle)
+
 		if len(evictKeys) == 0 {
 			continue
 		}
@@ -186,14 +500,162 @@ func (s *Store) cleanupLoop() {
 			}
 			s.persistConversation(conv, now)
 			delete(s.convs, key)
+			conversationsEvicted.Inc()
 		}
 		s.mu.Unlock()
 	}
 }
 
+// StoreStats are the sizes of the Store's in-memory state.
+type StoreStats struct {
+	Conversations   int
+	Users           int
+	WriteQueueDepth int
+}
+
+// Stats reads the cache sizes under their locks.
+func (s *Store) Stats() StoreStats {
+	s.mu.RLock()
+	conversations := len(s.convs)
+	s.mu.RUnlock()
+	s.userMu.Lock()
+	users := len(s.users)
+	s.userMu.Unlock()
+	return StoreStats{
+		Conversations:   conversations,
+		Users:           users,
+		WriteQueueDepth: len(s.writeCh),
+	}
+}
+
+// ConversationStats summarizes a conversation for the metadata endpoint.
+type ConversationStats struct {
+	Messages         int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// ConversationStats returns message count and token totals, from memory when
+// the conversation is resident and from SQLite otherwise.
+func (s *Store) ConversationStats(ctx context.Context, userKey, conversationID string) (stats ConversationStats, found bool, err error) {
+	var key string
+	key, userKey, conversationID = s.conversationKey(userKey, conversationID)
+	_, span := tracer.Start(ctx, "store.ConversationStats", conversationAttributes(userKey, conversationID))
+	defer func() { endSpan(span, err) }()
+
+	s.mu.RLock()
+	conv, ok := s.convs[key]
+	s.mu.RUnlock()
+	if ok {
+		conv.mu.Lock()
+		stats = ConversationStats{
+			Messages:         len(conv.History),
+			PromptTokens:     conv.PromptTokens,
+			CompletionTokens: conv.CompletionTokens,
+		}
+		conv.mu.Unlock()
+		return stats, true, nil
+	}
+
+	var historyJSON []byte
+	err = s.db.QueryRow(
+		`SELECT history_json, prompt_tokens, completion_tokens FROM conversations WHERE user_key = ? AND conversation_id = ?`,
+		userKey, conversationID,
+	).Scan(&historyJSON, &stats.PromptTokens, &stats.CompletionTokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stats, false, nil
+	}
+	if err != nil {
+		return stats, false, err
+	}
+	var history []Message
+	if err := decodeHistory(historyJSON, &history); err != nil {
+		return stats, false, err
+	}
+	stats.Messages = len(history)
+	return stats, true, nil
+}
+
+// CacheEntry describes a conversation resident in memory.
+type CacheEntry struct {
+	Key            string    `json:"-"`
+	UserKey        string    `json:"-"`
+	ConversationID string    `json:"conversation_id"`
+	Messages       int       `json:"messages"`
+	Bytes          int       `json:"bytes"`
+	InUse          bool      `json:"in_use"`
+	Dirty          bool      `json:"dirty"`
+	LastActive     time.Time `json:"last_active"`
+}
+
+// CacheEntries lists the resident conversations, most recently active first.
+func (s *Store) CacheEntries() []CacheEntry {
+	s.mu.RLock()
+	entries := make([]CacheEntry, 0, len(s.convs))
+	for key, conv := range s.convs {
+		conv.mu.Lock()
+		size := 0
+		for _, msg := range conv.History {
+			size += len(msg.Source) + len(msg.Content)
+		}
+		entries = append(entries, CacheEntry{
+			Key:            key,
+			UserKey:        conv.UserKey,
+			ConversationID: conv.ConversationID,
+			Messages:       len(conv.History),
+			Bytes:          size,
+			InUse:          atomic.LoadInt32(&conv.InUse) > 0,
+			Dirty:          conv.Dirty,
+			LastActive:     conv.LastActive,
+		})
+		conv.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastActive.After(entries[j].LastActive)
+	})
+	return entries
+}
+
+// Evict persists and drops the given resident conversations, or all of them
+// when no keys are passed. Conversations with a request in flight are left in
+// place and reported as skipped.
+func (s *Store) Evict(keys ...string) (evicted, skipped []string) {
+	var only map[string]bool
+	if len(keys) > 0 {
+		only = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			only[key] = true
+		}
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, conv := range s.convs {
+		if only != nil && !only[k] {
+			continue
+		}
+		if atomic.LoadInt32(&conv.InUse) > 0 {
+			skipped = append(skipped, k)
+			continue
+		}
+		s.persistConversation(conv, now)
+		delete(s.convs, k)
+		conversationsEvicted.Inc()
+		evicted = append(evicted, k)
+	}
+	return evicted, skipped
+}
+
 func (s *Store) persistConversation(conv *Conversation, now time.Time) {
 	conv.mu.Lock()
 	historyCopy := append([]Message(nil), conv.History...)
+	summary := conv.Summary
+	summaryUpTo := conv.SummaryUpTo
+	systemPrompt := conv.SystemPrompt
+	promptTokens, completionTokens := conv.PromptTokens, conv.CompletionTokens
 	internalID := conv.InternalID
 	userKey := conv.UserKey
 	conversationID := conv.ConversationID
@@ -201,121 +663,402 @@ func (s *Store) persistConversation(conv *Conversation, now time.Time) {
 	conv.LastPersist = now
 	conv.mu.Unlock()
 
-	historyJSON, err := json.Marshal(historyCopy)
+	historyJSON, err := s.encodeHistory(historyCopy)
 	if err != nil {
 		return
 	}
+	// Plain JSON keeps TEXT affinity so the column stays readable with
+	// json_extract and the sqlite shell; only gzip rows are stored as BLOBs.
+	var historyValue any = string(historyJSON)
+	if s.compressHistory {
+		historyValue = historyJSON
+	}
 
-	s.writeCh <- writeRequest{fn: func(tx *sql.Tx) error {
+	conversationsPersisted.Inc()
+	s.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
 		_, err := tx.Exec(
-			`INSERT INTO conversations (user_key, conversation_id, internal_conv_id, history_json, updated_at)
-			 VALUES (?, ?, ?, ?, ?)
+			`INSERT INTO conversations (user_key, conversation_id, internal_conv_id, history_json, summary, summary_upto, system_prompt,
+			   prompt_tokens, completion_tokens, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 			 ON CONFLICT(user_key, conversation_id)
-			 DO UPDATE SET internal_conv_id=excluded.internal_conv_id, history_json=excluded.history_json, updated_at=excluded.updated_at`,
-			userKey, conversationID, internalID, string(historyJSON), now.Unix(),
+			 DO UPDATE SET internal_conv_id=excluded.internal_conv_id, history_json=excluded.history_json,
+			   summary=excluded.summary, summary_upto=excluded.summary_upto, system_prompt=excluded.system_prompt,
+			   prompt_tokens=excluded.prompt_tokens, completion_tokens=excluded.completion_tokens, updated_at=excluded.updated_at`,
+			userKey, conversationID, internalID, historyValue, summary, summaryUpTo, systemPrompt,
+			promptTokens, completionTokens, now.Unix(),
 		)
 		return err
-	}}
+	}})
+}
+
+func (s *Store) cachedUser(userKey string) (*User, bool) {
+	s.userMu.Lock()
+	defer s.userMu.Unlock()
+	elem, ok := s.users[userKey]
+	if !ok {
+		return nil, false
+	}
+	s.userOrder.MoveToFront(elem)
+	return elem.Value.(*cachedUser).user, true
+}
+
+// cacheUser records a user as most recently used. Evicted entries are only
+// dropped from memory; the users table stays the source of truth.
+func (s *Store) cacheUser(userKey string, user *User) {
+	s.userMu.Lock()
+	defer s.userMu.Unlock()
+	if elem, ok := s.users[userKey]; ok {
+		elem.Value.(*cachedUser).user = user
+		s.userOrder.MoveToFront(elem)
+		return
+	}
+	s.users[userKey] = s.userOrder.PushFront(&cachedUser{key: userKey, user: user})
+	for s.maxUsers > 0 && s.userOrder.Len() > s.maxUsers {
+		oldest := s.userOrder.Back()
+		s.userOrder.Remove(oldest)
+		delete(s.users, oldest.Value.(*cachedUser).key)
+	}
 }
 
-func (s *Store) getOrCreateUser(userKey string) (string, string, error) {
-	s.userMu.RLock()
-	if user, ok := s.users[userKey]; ok {
-		s.userMu.RUnlock()
-		return user.OAID, user.MiID, nil
+func (s *Store) getOrCreateUser(userKey string) (User, error) {
+	if user, ok := s.cachedUser(userKey); ok && s.fingerprints.Usable(user.Fingerprint) {
+		return *user, nil
 	}
-	s.userMu.RUnlock()
 
-	var oaid, miID string
-	err := s.db.QueryRow(`SELECT oaid, mi_id FROM users WHERE user_key = ?`, userKey).Scan(&oaid, &miID)
+	var user User
+	err := s.db.QueryRow(`SELECT oaid, mi_id, fingerprint FROM users WHERE user_key = ?`, userKey).
+		Scan(&user.OAID, &user.MiID, &user.Fingerprint)
 	if err == nil {
-		s.userMu.Lock()
-		s.users[userKey] = &User{OAID: oaid, MiID: miID}
-		s.userMu.Unlock()
-		return oaid, miID, nil
+		return s.stickFingerprint(userKey, user)
 	}
 	if !errors.Is(err, sql.ErrNoRows) {
-		return "", "", err
+		return User{}, err
 	}
 
-	oaid = newOAID()
-	miID = newMiID()
+	oaid := newOAID()
+	miID := newMiID()
+	fingerprint := s.fingerprints.Assign(userKey)
 	now := time.Now().Unix()
 
 	done := make(chan error, 1)
-	s.writeCh <- writeRequest{fn: func(tx *sql.Tx) error {
-		_, err := tx.Exec(`INSERT OR IGNORE INTO users (user_key, oaid, mi_id, created_at) VALUES (?, ?, ?, ?)`,
-			userKey, oaid, miID, now)
+	if !s.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO users (user_key, oaid, mi_id, fingerprint, created_at) VALUES (?, ?, ?, ?, ?)`,
+			userKey, oaid, miID, fingerprint, now)
 		return err
-	}, done: done}
+	}, done: done}) {
+		return User{}, errStoreClosed
+	}
 
 	if err := <-done; err != nil {
-		return "", "", err
+		return User{}, err
 	}
 
-	err = s.db.QueryRow(`SELECT oaid, mi_id FROM users WHERE user_key = ?`, userKey).Scan(&oaid, &miID)
+	err = s.db.QueryRow(`SELECT oaid, mi_id, fingerprint FROM users WHERE user_key = ?`, userKey).
+		Scan(&user.OAID, &user.MiID, &user.Fingerprint)
 	if err != nil {
-		return "", "", err
+		return User{}, err
 	}
 
-	s.userMu.Lock()
-	s.users[userKey] = &User{OAID: oaid, MiID: miID}
-	s.userMu.Unlock()
+	return s.stickFingerprint(userKey, user)
+}
 
-	return oaid, miID, nil
+// stickFingerprint gives a user without a usable device profile (never
+// assigned, or banned since) a new one and persists it, then caches the user.
+func (s *Store) stickFingerprint(userKey string, user User) (User, error) {
+	if !s.fingerprints.Usable(user.Fingerprint) {
+		if fingerprint := s.fingerprints.Assign(userKey); fingerprint != "" {
+			done := make(chan error, 1)
+			if !s.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+				_, err := tx.Exec(`UPDATE users SET fingerprint = ? WHERE user_key = ?`, fingerprint, userKey)
+				return err
+			}, done: done}) {
+				return User{}, errStoreClosed
+			}
+			if err := <-done; err != nil {
+				return User{}, err
+			}
+			user.Fingerprint = fingerprint
+		}
+	}
+	s.cacheUser(userKey, &user)
+	return user, nil
+}
+
+// BanFingerprint stops assigning a device profile and reports how many users
+// hold it. Those users are reassigned on their next request.
+func (s *Store) BanFingerprint(ctx context.Context, id string) (users int, err error) {
+	_, span := tracer.Start(ctx, "store.BanFingerprint", trace.WithAttributes(attribute.String("miui.fingerprint", id)))
+	defer func() { endSpan(span, err) }()
+
+	if err := s.fingerprints.Ban(id); err != nil {
+		return 0, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE fingerprint = ?`, id).Scan(&users)
+	return users, err
+}
+
+// UserSeed is a user to pre-create; empty OAID or MiID are generated.
+type UserSeed struct {
+	UserKey string
+	OAID    string
+	MiID    string
+}
+
+// CreateUsers inserts users in one transaction and reports which keys were
+// created and which already existed. Existing users are left unchanged.
+func (s *Store) CreateUsers(ctx context.Context, seeds []UserSeed) (created, existing []string, err error) {
+	_, span := tracer.Start(ctx, "store.CreateUsers", trace.WithAttributes(attribute.Int("miui.users", len(seeds))))
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now().Unix()
+	done := make(chan error, 1)
+	if !s.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+		created, existing = nil, nil
+		stmt, err := tx.Prepare(`INSERT OR IGNORE INTO users (user_key, oaid, mi_id, fingerprint, created_at) VALUES (?, ?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, seed := range seeds {
+			if seed.OAID == "" {
+				seed.OAID = newOAID()
+			}
+			if seed.MiID == "" {
+				seed.MiID = newMiID()
+			}
+			res, err := stmt.Exec(seed.UserKey, seed.OAID, seed.MiID, s.fingerprints.Assign(seed.UserKey), now)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				created = append(created, seed.UserKey)
+			} else {
+				existing = append(existing, seed.UserKey)
+			}
+		}
+		return nil
+	}, done: done}) {
+		return nil, nil, errStoreClosed
+	}
+	if err := <-done; err != nil {
+		return nil, nil, err
+	}
+	return created, existing, nil
 }
 
-func (s *Store) GetConversation(userKey, conversationID string) (*Conversation, error) {
+// sharedConversationOwner owns every conversation when SHARED_CONVERSATIONS is
+// on; it also supplies the upstream identity those conversations use.
+const sharedConversationOwner = "*shared*"
+
+// conversationKey returns the cache key, the user key owning the stored row
+// and the conversation id, defaulted to "default". Conversations are scoped
+// per user unless SHARED_CONVERSATIONS makes ids global.
+func (s *Store) conversationKey(userKey, conversationID string) (key, owner, id string) {
 	if conversationID == "" {
 		conversationID = "default"
 	}
+	if s.sharedConversations {
+		userKey = sharedConversationOwner
+	}
+	return fmt.Sprintf("%s|%s", userKey, conversationID), userKey, conversationID
+}
 
-	key := fmt.Sprintf("%s|%s", userKey, conversationID)
+func (s *Store) GetConversation(ctx context.Context, userKey, conversationID string) (conv *Conversation, err error) {
+	var key string
+	key, userKey, conversationID = s.conversationKey(userKey, conversationID)
+	_, span := tracer.Start(ctx, "store.GetConversation", conversationAttributes(userKey, conversationID))
+	defer func() { endSpan(span, err) }()
 
 	s.mu.RLock()
-	if conv, ok := s.convs[key]; ok {
+	if cached, ok := s.convs[key]; ok {
 		s.mu.RUnlock()
-		return conv, nil
+		span.SetAttributes(attribute.Bool("miui.cache_hit", true))
+		return s.residentConversation(cached)
 	}
 	s.mu.RUnlock()
+	span.SetAttributes(attribute.Bool("miui.cache_hit", false))
+
+	// Concurrent first requests for a conversation share one load, so a new
+	// conversation gets exactly one internal id.
+	s.mu.Lock()
+	if cached, ok := s.convs[key]; ok {
+		s.mu.Unlock()
+		return s.residentConversation(cached)
+	}
+	if load, ok := s.loading[key]; ok {
+		s.mu.Unlock()
+		select {
+		case <-load.done:
+			if load.err != nil {
+				return nil, load.err
+			}
+			return s.residentConversation(load.conv)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	load := &conversationLoad{done: make(chan struct{})}
+	s.loading[key] = load
+	s.mu.Unlock()
+
+	conv, err = s.loadConversation(ctx, key, userKey, conversationID)
+
+	s.mu.Lock()
+	delete(s.loading, key)
+	if err == nil {
+		s.convs[key] = conv
+	}
+	s.mu.Unlock()
+	load.conv, load.err = conv, err
+	close(load.done)
+	return conv, err
+}
 
-	oaid, miID, err := s.getOrCreateUser(userKey)
+// residentConversation returns a conversation another request already
+// loaded, after the same checks every cache hit gets.
+func (s *Store) residentConversation(conv *Conversation) (*Conversation, error) {
+	if err := s.refreshDevice(conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// loadConversation reads a conversation from SQLite, or starts a new one with
+// a fresh internal id when there is no row.
+func (s *Store) loadConversation(ctx context.Context, key, userKey, conversationID string) (*Conversation, error) {
+	user, err := s.getOrCreateUser(userKey)
 	if err != nil {
 		return nil, err
 	}
+	oaid, miID := user.OAID, user.MiID
 
-	var internalID, historyJSON string
+	var internalID, summary, systemPrompt string
+	var historyJSON []byte
+	var summaryUpTo, promptTokens, completionTokens int
 	err = s.db.QueryRow(
-		`SELECT internal_conv_id, history_json FROM conversations WHERE user_key = ? AND conversation_id = ?`,
+		`SELECT internal_conv_id, history_json, summary, summary_upto, system_prompt, prompt_tokens, completion_tokens
+		 FROM conversations WHERE user_key = ? AND conversation_id = ?`,
 		userKey, conversationID,
-	).Scan(&internalID, &historyJSON)
+	).Scan(&internalID, &historyJSON, &summary, &summaryUpTo, &systemPrompt, &promptTokens, &completionTokens)
 
 	history := []Message{}
+	reloaded := err == nil
 	if err == nil {
-		_ = json.Unmarshal([]byte(historyJSON), &history)
+		if decodeErr := decodeHistory(historyJSON, &history); decodeErr != nil {
+			if err := s.corruptHistory(ctx, key, userKey, conversationID, historyJSON, decodeErr); err != nil {
+				return nil, err
+			}
+			history = []Message{}
+		}
 	} else if errors.Is(err, sql.ErrNoRows) {
 		internalID = newConversationID(oaid)
 	} else if err != nil {
 		return nil, err
 	}
 
-	conv := &Conversation{
+	return &Conversation{
 		UserKey:        userKey,
 		ConversationID: conversationID,
 		OAID:           oaid,
 		MiID:           miID,
 		InternalID:     internalID,
+		Device:         s.fingerprints.Profile(user.Fingerprint),
 		History:        history,
 		LastActive:     time.Now(),
 		LastPersist:    time.Now(),
 		Dirty:          false,
+		Reloaded:       reloaded,
+		Summary:        summary,
+		SummaryUpTo:    summaryUpTo,
+		SystemPrompt:   systemPrompt,
+
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+	}, nil
+}
+
+// Preload loads the n most recently updated conversations into memory so
+// their first turn after a restart skips the SQLite reload. Rows are loaded
+// through GetConversation and are evicted like any other idle conversation.
+func (s *Store) Preload(n int) (loaded int, err error) {
+	ctx := context.Background()
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT user_key, conversation_id FROM conversations ORDER BY updated_at DESC LIMIT ?`, n)
+	if err != nil {
+		return 0, err
+	}
+	type row struct{ userKey, conversationID string }
+	var recent []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.userKey, &r.conversationID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		recent = append(recent, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
 	}
 
-	s.mu.Lock()
-	s.convs[key] = conv
-	s.mu.Unlock()
+	for _, r := range recent {
+		_, err := s.GetConversation(ctx, r.userKey, r.conversationID)
+		var corrupt *CorruptHistoryError
+		if errors.As(err, &corrupt) {
+			// Strict mode leaves the row for an operator; skip it.
+			continue
+		}
+		if err != nil {
+			return loaded, err
+		}
+		loaded++
+	}
+	return loaded, nil
+}
 
-	return conv, nil
+// refreshDevice moves a resident conversation off a banned device profile
+// onto its owner's reassigned one.
+func (s *Store) refreshDevice(conv *Conversation) error {
+	if s.fingerprints.Usable(conv.device().ID) {
+		return nil
+	}
+	user, err := s.getOrCreateUser(conv.UserKey)
+	if err != nil {
+		return err
+	}
+	conv.deviceMu.Lock()
+	conv.Device = s.fingerprints.Profile(user.Fingerprint)
+	conv.deviceMu.Unlock()
+	return nil
+}
+
+func (c *Conversation) device() DeviceProfile {
+	c.deviceMu.Lock()
+	defer c.deviceMu.Unlock()
+	return c.Device
+}
+
+// corruptHistory handles a history_json row that failed to decode. In strict
+// mode the row is left alone and an error returned; otherwise the
+// conversation continues empty, with the row optionally quarantined first
+// since the next persist overwrites it.
+func (s *Store) corruptHistory(ctx context.Context, key, userKey, conversationID string, data []byte, decodeErr error) error {
+	corruptHistoryRows.Inc()
+	logf(ctx, "corrupted history for %s: %v", key, decodeErr)
+	if s.strictHistory {
+		return &CorruptHistoryError{ConversationID: conversationID, Err: decodeErr}
+	}
+	if s.quarantineHistory {
+		data = append([]byte(nil), data...)
+		now := time.Now().Unix()
+		s.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`INSERT INTO corrupt_conversations (user_key, conversation_id, history_json, error, quarantined_at)
+				VALUES (?, ?, ?, ?, ?)`, userKey, conversationID, data, decodeErr.Error(), now)
+			return err
+		}})
+	}
+	return nil
 }
 
 func (s *Store) Touch(conv *Conversation) {
@@ -323,3 +1066,127 @@ func (s *Store) Touch(conv *Conversation) {
 	conv.LastActive = time.Now()
 	conv.mu.Unlock()
 }
+
+// History returns a copy of a conversation's history without marking it
+// active. Resident conversations are read from memory, others from SQLite.
+func (s *Store) History(ctx context.Context, userKey, conversationID string) (history []Message, found bool, err error) {
+	history, _, found, err = s.Transcript(ctx, userKey, conversationID)
+	return history, found, err
+}
+
+// Transcript is History plus the conversation's persisted system prompt.
+func (s *Store) Transcript(ctx context.Context, userKey, conversationID string) (history []Message, systemPrompt string, found bool, err error) {
+	var key string
+	key, userKey, conversationID = s.conversationKey(userKey, conversationID)
+	_, span := tracer.Start(ctx, "store.Transcript", conversationAttributes(userKey, conversationID))
+	defer func() { endSpan(span, err) }()
+
+	s.mu.RLock()
+	conv, ok := s.convs[key]
+	s.mu.RUnlock()
+	if ok {
+		conv.mu.Lock()
+		history = append([]Message(nil), conv.History...)
+		systemPrompt = conv.SystemPrompt
+		conv.mu.Unlock()
+		return history, systemPrompt, true, nil
+	}
+
+	var historyJSON []byte
+	err = s.db.QueryRow(
+		`SELECT history_json, system_prompt FROM conversations WHERE user_key = ? AND conversation_id = ?`,
+		userKey, conversationID,
+	).Scan(&historyJSON, &systemPrompt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	history = []Message{}
+	if err := decodeHistory(historyJSON, &history); err != nil {
+		return nil, "", false, err
+	}
+	return history, systemPrompt, true, nil
+}
+
+// UserInfo returns a user's device identity and how many conversations it
+// owns, counting resident ones not yet persisted. It never creates a user:
+// an unseen key yields errUnknownUser.
+func (s *Store) UserInfo(ctx context.Context, userKey string) (user User, conversations int, err error) {
+	_, span := tracer.Start(ctx, "store.UserInfo", conversationAttributes(userKey, ""))
+	defer func() { endSpan(span, err) }()
+
+	if cached, ok := s.cachedUser(userKey); ok {
+		user = *cached
+	} else {
+		err = s.db.QueryRow(`SELECT oaid, mi_id, fingerprint FROM users WHERE user_key = ?`, userKey).
+			Scan(&user.OAID, &user.MiID, &user.Fingerprint)
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, 0, errUnknownUser
+		}
+		if err != nil {
+			return User{}, 0, err
+		}
+	}
+
+	ids := map[string]bool{}
+	rows, err := s.db.Query(`SELECT conversation_id FROM conversations WHERE user_key = ?`, userKey)
+	if err != nil {
+		return User{}, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return User{}, 0, err
+		}
+		ids[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return User{}, 0, err
+	}
+
+	s.mu.RLock()
+	for _, conv := range s.convs {
+		if conv.UserKey == userKey {
+			ids[conv.ConversationID] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	return user, len(ids), nil
+}
+
+// encodeHistory serializes a history for the history_json column. With
+// COMPRESS_STORED_HISTORY the JSON is gzipped; the gzip magic bytes let
+// decodeHistory tell those rows from older plaintext ones.
+func (s *Store) encodeHistory(history []Message) ([]byte, error) {
+	data, err := json.Marshal(history)
+	if err != nil || !s.compressHistory {
+		return data, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeHistory reads a history_json value written compressed or not.
+func decodeHistory(data []byte, history *[]Message) error {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return json.NewDecoder(zr).Decode(history)
+	}
+	return json.Unmarshal(data, history)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a store in a temporary directory, closed with the test.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	st, err := NewStore(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestGetConversationConcurrentFirstAccess(t *testing.T) {
+	st := newTestStore(t)
+
+	const callers = 32
+	convs := make([]*Conversation, callers)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range convs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			conv, err := st.GetConversation(context.Background(), "race-user", "new-conv")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			convs[i] = conv
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, conv := range convs {
+		if conv == nil {
+			t.Fatalf("caller %d got no conversation", i)
+		}
+		if conv != convs[0] {
+			t.Fatalf("caller %d got a different conversation", i)
+		}
+		if conv.InternalID != convs[0].InternalID || conv.InternalID == "" {
+			t.Fatalf("caller %d: internal id %q, want %q", i, conv.InternalID, convs[0].InternalID)
+		}
+	}
+}
+
+// TestStoreCloseWhileWriting races Close against a cleanup loop busy
+// persisting conversations that requests keep dirtying; run it under -race.
+// A send on the closed write channel would panic.
+func TestStoreCloseWhileWriting(t *testing.T) {
+	t.Setenv("CLEANUP_PERIOD", "1ms")
+	t.Setenv("PERSIST_AFTER", "1ms")
+
+	for round := 0; round < 10; round++ {
+		st, err := NewStore(filepath.Join(t.TempDir(), "db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-closed:
+						return
+					default:
+					}
+					conv, err := st.GetConversation(context.Background(), "close-user", fmt.Sprintf("c%d-%d", g, i%4))
+					if err != nil {
+						continue // the store is closing
+					}
+					atomic.AddInt32(&conv.InUse, 1)
+					conv.mu.Lock()
+					conv.History = []Message{{Source: "user", Content: fmt.Sprint(i)}}
+					conv.Dirty = true
+					conv.mu.Unlock()
+					atomic.AddInt32(&conv.InUse, -1)
+				}
+			}(g)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		err = st.Close()
+		close(closed)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUserCacheEvictsPastCap(t *testing.T) {
+	t.Setenv("MAX_CACHED_USERS", "2")
+	st := newTestStore(t)
+
+	first, err := st.getOrCreateUser("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"u2", "u3"} {
+		if _, err := st.getOrCreateUser(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := st.cachedUser("u1"); ok {
+		t.Error("least recently used user still cached past the cap")
+	}
+	for _, key := range []string{"u2", "u3"} {
+		if _, ok := st.cachedUser(key); !ok {
+			t.Errorf("%s evicted, want it cached", key)
+		}
+	}
+
+	again, err := st.getOrCreateUser("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Errorf("evicted user reloaded as %+v, want %+v from the users table", again, first)
+	}
+	if _, ok := st.cachedUser("u2"); ok {
+		t.Error("reloading u1 did not evict the next least recently used user")
+	}
+}
+
+func TestPeriodicCheckpointTruncatesWAL(t *testing.T) {
+	t.Setenv("WAL_CHECKPOINT_INTERVAL", "20ms")
+	path := filepath.Join(t.TempDir(), "db")
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	done := make(chan error, 1)
+	st.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+		for i := 0; i < 200; i++ {
+			if _, err := tx.Exec(`INSERT INTO users (user_key, oaid, mi_id, fingerprint, created_at) VALUES (?, '', '', '', 0)`,
+				fmt.Sprintf("wal-user-%d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, done: done})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		info, err := os.Stat(path + "-wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("WAL still %d bytes after periodic checkpoints", info.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoredHistoryCompression(t *testing.T) {
+	history := []Message{{Source: "user", Content: "你好"}, {Source: "assistant", Content: "hello"}}
+	path := filepath.Join(t.TempDir(), "db")
+
+	save := func(compress bool, conversationID string) {
+		t.Helper()
+		st, err := NewStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.compressHistory = compress
+		conv, err := st.GetConversation(context.Background(), "gzip-user", conversationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv.mu.Lock()
+		conv.History = append([]Message(nil), history...)
+		conv.mu.Unlock()
+		st.persistConversation(conv, time.Now())
+	}
+	save(false, "plain")
+	save(true, "packed")
+
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, tc := range []struct{ id, storage string }{
+		{"plain", "text"},
+		{"packed", "blob"},
+	} {
+		var storage string
+		if err := st.db.QueryRow(`SELECT typeof(history_json) FROM conversations WHERE conversation_id = ?`, tc.id).Scan(&storage); err != nil {
+			t.Fatal(err)
+		}
+		if storage != tc.storage {
+			t.Errorf("%s history stored as %s, want %s", tc.id, storage, tc.storage)
+		}
+		got, found, err := st.History(context.Background(), "gzip-user", tc.id)
+		if err != nil || !found {
+			t.Fatalf("%s: found %v, %v", tc.id, found, err)
+		}
+		if len(got) != len(history) || got[0] != history[0] || got[1] != history[1] {
+			t.Errorf("%s history read back as %v", tc.id, got)
+		}
+	}
+}
+
+// evictAndFlush evicts every resident conversation and waits for their rows
+// to be written.
+func evictAndFlush(t *testing.T, st *Store) {
+	t.Helper()
+	st.Evict()
+	done := make(chan error, 1)
+	st.enqueue(writeRequest{fn: func(*sql.Tx) error { return nil }, done: done})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConversationIDScope(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		st := newTestStore(t)
+		st.sharedConversations = shared
+
+		alice, err := st.GetConversation(context.Background(), "alice", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice.mu.Lock()
+		alice.History = []Message{{Source: "user", Content: "alice's secret"}}
+		alice.mu.Unlock()
+		evictAndFlush(t, st)
+
+		bob, err := st.GetConversation(context.Background(), "bob", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob.mu.Lock()
+		seen := len(bob.History) == 1 && bob.History[0].Content == "alice's secret"
+		bob.mu.Unlock()
+		if seen != shared {
+			t.Errorf("shared=%v: bob sees alice's conversation after reload: %v", shared, seen)
+		}
+		if (bob.InternalID == alice.InternalID) != shared {
+			t.Errorf("shared=%v: internal ids %q and %q", shared, alice.InternalID, bob.InternalID)
+		}
+
+		reloaded, err := st.GetConversation(context.Background(), "alice", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reloaded.InternalID != alice.InternalID || len(reloaded.History) != 1 {
+			t.Errorf("shared=%v: alice reloaded %q with %d messages", shared, reloaded.InternalID, len(reloaded.History))
+		}
+	}
+}
+
+func TestCorruptedHistoryRow(t *testing.T) {
+	st := newTestStore(t)
+	corrupt := func(conversationID string) {
+		t.Helper()
+		done := make(chan error, 1)
+		st.enqueue(writeRequest{fn: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`INSERT INTO conversations (user_key, conversation_id, internal_conv_id, history_json, updated_at)
+				VALUES ('corrupt-user', ?, 'internal', '[{"source":"user","content":', 0)`, conversationID)
+			return err
+		}, done: done})
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := counterValue(t, corruptHistoryRows)
+	corrupt("lenient")
+	conv, err := st.GetConversation(context.Background(), "corrupt-user", "lenient")
+	if err != nil || len(conv.History) != 0 {
+		t.Fatalf("lenient: %v, %d messages; want an empty conversation", err, len(conv.History))
+	}
+	if got := counterValue(t, corruptHistoryRows) - before; got != 1 {
+		t.Errorf("corrupt history counter rose by %v, want 1", got)
+	}
+
+	st.quarantineHistory = true
+	corrupt("quarantined")
+	if _, err := st.GetConversation(context.Background(), "corrupt-user", "quarantined"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	st.enqueue(writeRequest{fn: func(*sql.Tx) error { return nil }, done: done})
+	<-done
+	var saved string
+	if err := st.db.QueryRow(`SELECT history_json FROM corrupt_conversations WHERE conversation_id = 'quarantined'`).Scan(&saved); err != nil {
+		t.Fatalf("row not quarantined: %v", err)
+	}
+	if saved != `[{"source":"user","content":` {
+		t.Errorf("quarantined %q", saved)
+	}
+
+	st.strictHistory = true
+	corrupt("strict")
+	var corruptErr *CorruptHistoryError
+	if _, err := st.GetConversation(context.Background(), "corrupt-user", "strict"); !errors.As(err, &corruptErr) {
+		t.Fatalf("strict: %v, want a CorruptHistoryError", err)
+	}
+	var history string
+	if err := st.db.QueryRow(`SELECT history_json FROM conversations WHERE conversation_id = 'strict'`).Scan(&history); err != nil || history != `[{"source":"user","content":` {
+		t.Errorf("strict mode changed the row: %q %v", history, err)
+	}
+}
+
+func TestPreloadRecentConversations(t *testing.T) {
+	st := newTestStore(t)
+	ids := []string{"oldest", "older", "newer", "newest"}
+	for _, id := range ids {
+		conv, err := st.GetConversation(context.Background(), "preload-user", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv.mu.Lock()
+		conv.History = []Message{{Source: "user", Content: "in " + id}}
+		conv.mu.Unlock()
+	}
+	evictAndFlush(t, st)
+	for i, id := range ids {
+		if _, err := st.db.Exec(`UPDATE conversations SET updated_at = ? WHERE conversation_id = ?`, 1000+i, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := st.Preload(2)
+	if err != nil || loaded != 2 {
+		t.Fatalf("Preload = %d, %v", loaded, err)
+	}
+	st.mu.RLock()
+	resident := len(st.convs)
+	for _, id := range ids[2:] {
+		key, _, _ := st.conversationKey("preload-user", id)
+		conv, ok := st.convs[key]
+		if !ok || len(conv.History) != 1 || conv.History[0].Content != "in "+id {
+			t.Errorf("%s not preloaded with its history", id)
+		}
+	}
+	st.mu.RUnlock()
+	if resident != 2 {
+		t.Errorf("%d conversations resident after preloading 2", resident)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	defaultSummaryKeepMessages = 20
+	// defaultSummaryRefreshMessages is how many messages past the keep
+	// window may build up before the summary is refreshed, so it costs an
+	// upstream call every few turns rather than on every turn.
+	defaultSummaryRefreshMessages = 10
+
+	// maxOverflowSummaryRounds bounds the upstream calls spent compacting
+	// one overflowing request.
+	maxOverflowSummaryRounds = 3
+
+	summaryPrompt       = "请将以下对话压缩为简洁的背景摘要，保留关键事实、用户偏好和未解决的问题，不要添加额外评论。\n\n"
+	summaryQueryPrefix  = "对话背景摘要："
+	summaryPreviousHint = "已有摘要："
+)
+
+// summarizeMessages folds messages, and any previous summary, into a compact
+// summary using a throwaway upstream conversation so the user's own upstream
+// thread is left untouched.
+func (s *Server) summarizeMessages(ctx context.Context, conv *Conversation, previous string, messages []Message) (string, error) {
+	var b strings.Builder
+	b.WriteString(summaryPrompt)
+	if previous != "" {
+		b.WriteString(summaryPreviousHint)
+		b.WriteString(previous)
+		b.WriteString("\n\n")
+	}
+	for _, msg := range messages {
+		b.WriteString(historyRole(msg.Source))
+		b.WriteString("：")
+		b.WriteString(msg.Content)
+		b.WriteString("\n")
+	}
+
+	scratch := &Conversation{
+		UserKey:    conv.UserKey,
+		OAID:       conv.OAID,
+		MiID:       conv.MiID,
+		InternalID: newConversationID(conv.OAID),
+		Device:     conv.device(),
+	}
+	summary, err := s.miui.Chat(ctx, scratch, b.String(), ChatOptions{})
+	return strings.TrimSpace(summary), err
+}
+
+// refreshContextSummary keeps the summary of a reloaded conversation covering
+// everything older than the most recent summaryKeepMessages messages, once
+// more than summaryRefreshMessages have built up beyond them. The summary
+// always ends on a turn boundary. The caller must hold conv.mu.
+func (s *Server) refreshContextSummary(ctx context.Context, conv *Conversation) {
+	if !s.contextSummary {
+		if !s.autoSummarize {
+			conv.Summary, conv.SummaryUpTo = "", 0
+		}
+		return
+	}
+	if !conv.Reloaded {
+		return
+	}
+
+	if len(conv.History)-conv.SummaryUpTo <= s.summaryKeepMessages+s.summaryRefreshMessages {
+		return
+	}
+	// Turns are not strict user/assistant pairs (tool turns, adopted
+	// transcripts), so back up to the start of a turn.
+	upTo := len(conv.History) - s.summaryKeepMessages
+	for upTo > conv.SummaryUpTo && upTo < len(conv.History) && conv.History[upTo].Source != "user" {
+		upTo--
+	}
+	if upTo <= conv.SummaryUpTo {
+		return
+	}
+
+	summary, err := s.summarizeMessages(ctx, conv, conv.Summary, conv.History[conv.SummaryUpTo:upTo])
+	if err != nil || summary == "" {
+		logf(ctx, "context summary for %s|%s failed: %v", conv.UserKey, conv.ConversationID, err)
+		return
+	}
+	conv.Summary = summary
+	conv.SummaryUpTo = upTo
+	conv.Dirty = true
+}
+
+// contextTokens estimates the upstream context for query. The caller must
+// hold conv.mu.
+func contextTokens(conv *Conversation, query string) int {
+	return estimateTokens(withContextSummary(conv, query)) + estimateHistoryTokens(conv.upstreamHistory())
+}
+
+// compactToFit folds the oldest unsummarized turns into the summary until
+// the context fits in limit tokens. Each round summarizes at most limit
+// tokens of history so the summarization call itself fits. The caller must
+// hold conv.mu.
+func (s *Server) compactToFit(ctx context.Context, conv *Conversation, query string, limit int) int {
+	tokens := contextTokens(conv, query)
+	for round := 0; round < maxOverflowSummaryRounds && tokens > limit; round++ {
+		excess := tokens - limit
+		start := conv.SummaryUpTo
+		cut := start
+		removed := 0
+		for cut < len(conv.History) && removed < excess {
+			end := nextTurnStart(conv.History, cut)
+			turn := 0
+			for _, msg := range conv.History[cut:end] {
+				turn += estimateTokens(msg.Content)
+			}
+			if cut > start && removed+turn > limit {
+				break
+			}
+			removed += turn
+			cut = end
+		}
+		if cut == start {
+			break
+		}
+
+		summary, err := s.summarizeMessages(ctx, conv, conv.Summary, conv.History[start:cut])
+		if err != nil || summary == "" {
+			logf(ctx, "overflow summary for %s|%s failed: %v", conv.UserKey, conv.ConversationID, err)
+			break
+		}
+		conv.Summary = summary
+		conv.SummaryUpTo = cut
+		conv.Dirty = true
+		tokens = contextTokens(conv, query)
+	}
+	return tokens
+}
+
+// nextTurnStart returns the index of the first user message after i, or
+// len(history) when history[i] belongs to the last turn.
+func nextTurnStart(history []Message, i int) int {
+	for i++; i < len(history); i++ {
+		if history[i].Source == "user" {
+			return i
+		}
+	}
+	return len(history)
+}
+
+// withContextSummary prepends the stored summary to the upstream query.
+func withContextSummary(conv *Conversation, query string) string {
+	if conv.Summary == "" {
+		return query
+	}
+	return summaryQueryPrefix + conv.Summary + "\n\n" + query
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingUpstream answers every call with answer and counts the calls.
+func countingUpstream(answer string, calls *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		answerUpstream(answer)(w, r)
+	}
+}
+
+// toolTurns builds n turns, every other one with a tool round trip, so turns
+// are not plain user/assistant pairs.
+func toolTurns(n int) []Message {
+	var history []Message
+	for i := 0; i < n; i++ {
+		history = append(history, Message{Source: "user", Content: "question"})
+		if i%2 == 1 {
+			history = append(history,
+				Message{Source: "assistant", Content: "looking it up"},
+				Message{Source: "tool", Content: "result", ToolCallID: "call"})
+		}
+		history = append(history, Message{Source: "assistant", Content: "answer"})
+	}
+	return history
+}
+
+func TestRefreshContextSummaryCutsOnTurns(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, countingUpstream("SUMMARY", &calls))
+	s.contextSummary = true
+	s.summaryKeepMessages = 5
+	s.summaryRefreshMessages = 4
+
+	conv := &Conversation{Reloaded: true, History: toolTurns(4)} // 10 messages
+	s.refreshContextSummary(context.Background(), conv)
+	if calls != 1 || conv.Summary != "SUMMARY" {
+		t.Fatalf("calls %d, summary %q; want one summarization", calls, conv.Summary)
+	}
+	if conv.SummaryUpTo == 0 || conv.History[conv.SummaryUpTo].Source != "user" {
+		t.Fatalf("SummaryUpTo %d does not start a turn", conv.SummaryUpTo)
+	}
+	if kept := len(conv.History) - conv.SummaryUpTo; kept < s.summaryKeepMessages {
+		t.Errorf("only %d messages kept verbatim, want at least %d", kept, s.summaryKeepMessages)
+	}
+
+	// Below the refresh threshold another turn costs no upstream call.
+	conv.History = append(conv.History, Message{Source: "user", Content: "more"}, Message{Source: "assistant", Content: "ok"})
+	s.refreshContextSummary(context.Background(), conv)
+	if calls != 1 {
+		t.Errorf("summary refreshed after one more turn; calls %d", calls)
+	}
+
+	conv.History = append(conv.History, toolTurns(4)...)
+	s.refreshContextSummary(context.Background(), conv)
+	if calls != 2 || conv.History[conv.SummaryUpTo].Source != "user" {
+		t.Errorf("calls %d, SummaryUpTo %d; want a refresh on a turn boundary", calls, conv.SummaryUpTo)
+	}
+}
+
+func TestContextSummaryPersistsAndPrefixesQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, err := st.GetConversation(context.Background(), "summary-user", "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv.mu.Lock()
+	conv.History = toolTurns(3)
+	conv.Summary, conv.SummaryUpTo = "earlier facts", 2
+	conv.mu.Unlock()
+	st.persistConversation(conv, conv.LastActive)
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	conv, err = st.GetConversation(context.Background(), "summary-user", "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conv.Reloaded || conv.Summary != "earlier facts" || conv.SummaryUpTo != 2 {
+		t.Fatalf("reloaded summary %q up to %d", conv.Summary, conv.SummaryUpTo)
+	}
+	if got := len(conv.upstreamHistory()); got != len(conv.History)-2 {
+		t.Errorf("upstream history has %d messages, want the %d after the summary", got, len(conv.History)-2)
+	}
+	if query := withContextSummary(conv, "next"); !strings.HasPrefix(query, summaryQueryPrefix+"earlier facts") || !strings.HasSuffix(query, "next") {
+		t.Errorf("query %q lacks the summary prefix", query)
+	}
+}
+
+func TestCompactToFitFoldsWholeTurns(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, countingUpstream("S", &calls))
+
+	conv := &Conversation{History: toolTurns(6)}
+	for i := range conv.History {
+		conv.History[i].Content = strings.Repeat("word ", 40)
+	}
+	limit := contextTokens(conv, "q") / 2
+
+	tokens := s.compactToFit(context.Background(), conv, "q", limit)
+	if tokens > limit {
+		t.Fatalf("context still %d tokens over a %d limit", tokens, limit)
+	}
+	if calls == 0 || conv.Summary != "S" {
+		t.Fatalf("calls %d, summary %q; want the oldest turns summarized", calls, conv.Summary)
+	}
+	if conv.SummaryUpTo < len(conv.History) && conv.History[conv.SummaryUpTo].Source != "user" {
+		t.Errorf("SummaryUpTo %d splits a turn", conv.SummaryUpTo)
+	}
+}
+
+func TestNextTurnStart(t *testing.T) {
+	history := toolTurns(3) // u a | u a t a | u a
+	for _, tc := range []struct{ from, want int }{
+		{0, 2}, {1, 2}, {2, 6}, {4, 6}, {6, 8}, {7, 8},
+	} {
+		if got := nextTurnStart(history, tc.from); got != tc.want {
+			t.Errorf("nextTurnStart(%d) = %d, want %d", tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestCheckContextLengthSummarizesOnOverflow(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, countingUpstream("S", &calls))
+	conv := &Conversation{History: toolTurns(6)}
+	for i := range conv.History {
+		conv.History[i].Content = strings.Repeat("word ", 40)
+	}
+	s.maxContextTokens = contextTokens(conv, "q") / 2
+
+	var ctxErr *ContextLengthError
+	if err := s.checkContextLength(context.Background(), conv, "q"); !errors.As(err, &ctxErr) {
+		t.Fatalf("without auto-summarize: %v, want ContextLengthError", err)
+	}
+	if calls != 0 {
+		t.Fatalf("summarized %d times without AUTO_SUMMARIZE_ON_OVERFLOW", calls)
+	}
+
+	s.autoSummarize = true
+	if err := s.checkContextLength(context.Background(), conv, "q"); err != nil {
+		t.Fatalf("with auto-summarize: %v", err)
+	}
+	if calls == 0 || !conv.Dirty {
+		t.Error("overflow did not summarize and mark the conversation for persisting")
+	}
+}
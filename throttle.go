@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpstreamConcurrency = 256
+	defaultLowRemaining        = 10
+	defaultRateLimitBackoff    = 2 * time.Second
+	queueHeartbeatInterval     = 5 * time.Second
+)
+
+// upstreamLimiter bounds concurrent upstream calls. The effective limit shrinks
+// when Miui reports rate-limit pressure and recovers by one slot per healthy
+// response, so the shared device fingerprint backs off before it gets banned.
+type upstreamLimiter struct {
+	mu           sync.Mutex
+	max          int
+	limit        int
+	inUse        int
+	lowRemaining int
+	pausedUntil  time.Time
+	changed      chan struct{}
+	// waiters queues blocked Acquire calls so slots are handed out in
+	// arrival order and each waiter knows its position.
+	waiters *list.List
+}
+
+func newUpstreamLimiter(maxConcurrency, lowRemaining int) *upstreamLimiter {
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultUpstreamConcurrency
+	}
+	return &upstreamLimiter{
+		max:          maxConcurrency,
+		limit:        maxConcurrency,
+		lowRemaining: lowRemaining,
+		changed:      make(chan struct{}),
+		waiters:      list.New(),
+	}
+}
+
+// Acquire blocks until a slot is free. While queued, onQueued (if set) is
+// called with the 1-based queue position whenever it changes, and again every
+// queueHeartbeatInterval.
+func (l *upstreamLimiter) Acquire(ctx context.Context, onQueued func(position int)) error {
+	var ticket *list.Element
+	defer func() {
+		if ticket != nil {
+			l.mu.Lock()
+			l.waiters.Remove(ticket)
+			l.notifyLocked()
+			l.mu.Unlock()
+		}
+	}()
+
+	// One timer serves every pause this call waits out, rather than a new
+	// one per wakeup.
+	pause := time.NewTimer(time.Hour)
+	pause.Stop()
+	defer pause.Stop()
+
+	var heartbeat <-chan time.Time
+	reported := 0
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		changed := l.changed
+		var wait <-chan time.Time
+		next := l.waiters.Front() == ticket
+		if now.Before(l.pausedUntil) {
+			if !pause.Stop() {
+				select {
+				case <-pause.C:
+				default:
+				}
+			}
+			pause.Reset(l.pausedUntil.Sub(now))
+			wait = pause.C
+		} else if next && l.inUse < l.limit {
+			l.inUse++
+			if ticket != nil {
+				l.waiters.Remove(ticket)
+				ticket = nil
+				l.notifyLocked()
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		if ticket == nil {
+			ticket = l.waiters.PushBack(struct{}{})
+		}
+		position := 1
+		for e := l.waiters.Front(); e != ticket; e = e.Next() {
+			position++
+		}
+		l.mu.Unlock()
+
+		if onQueued != nil {
+			if heartbeat == nil {
+				ticker := time.NewTicker(queueHeartbeatInterval)
+				defer ticker.Stop()
+				heartbeat = ticker.C
+			}
+			if position != reported {
+				reported = position
+				onQueued(position)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-wait:
+		case <-heartbeat:
+			reported = 0
+		}
+	}
+}
+
+func (l *upstreamLimiter) Release() {
+	l.mu.Lock()
+	l.inUse--
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+// Observe feeds the status and rate-limit headers of an upstream response,
+// including error responses, into the limiter.
+func (l *upstreamLimiter) Observe(status int, header http.Header) {
+	remaining, hasRemaining := parseRateLimitRemaining(header)
+	retryAfter, hasRetryAfter := parseRetryAfter(header, time.Now())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		l.limit = max(1, l.limit/2)
+		if !hasRetryAfter {
+			retryAfter = defaultRateLimitBackoff
+		}
+		l.pauseLocked(retryAfter)
+	case hasRemaining && remaining <= l.lowRemaining:
+		l.limit = max(1, min(l.limit, remaining))
+		if remaining == 0 && hasRetryAfter {
+			l.pauseLocked(retryAfter)
+		}
+	case status == http.StatusOK && l.limit < l.max:
+		l.limit++
+	}
+	l.notifyLocked()
+}
+
+// Limit reports the current effective concurrency.
+func (l *upstreamLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *upstreamLimiter) pauseLocked(d time.Duration) {
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func (l *upstreamLimiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func parseRateLimitRemaining(header http.Header) (int, bool) {
+	val := strings.TrimSpace(header.Get("X-RateLimit-Remaining"))
+	if val == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseRetryAfter accepts both delta-seconds and HTTP-date forms.
+func parseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	val := strings.TrimSpace(header.Get("Retry-After"))
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(val); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
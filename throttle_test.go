@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"7", 7 * time.Second, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	} {
+		header := http.Header{}
+		if tc.value != "" {
+			header.Set("Retry-After", tc.value)
+		}
+		got, ok := parseRetryAfter(header, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestUpstreamLimiterObserve(t *testing.T) {
+	l := newUpstreamLimiter(16, defaultLowRemaining)
+
+	l.Observe(http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	if got := l.Limit(); got != 8 {
+		t.Fatalf("after one 429: limit %d, want 8", got)
+	}
+	for i := 0; i < 5; i++ {
+		l.Observe(http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	}
+	if got := l.Limit(); got != 1 {
+		t.Fatalf("after repeated 429s: limit %d, want floor of 1", got)
+	}
+
+	l.Observe(http.StatusOK, nil)
+	l.Observe(http.StatusOK, nil)
+	if got := l.Limit(); got != 3 {
+		t.Fatalf("after two healthy responses: limit %d, want 3", got)
+	}
+
+	l.Observe(http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"2"}})
+	if got := l.Limit(); got != 2 {
+		t.Fatalf("low remaining: limit %d, want 2", got)
+	}
+}
+
+func TestUpstreamLimiterPausesAfter429(t *testing.T) {
+	l := newUpstreamLimiter(4, defaultLowRemaining)
+	l.Observe(http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, nil); err == nil {
+		l.Release()
+		t.Fatal("Acquire succeeded during the Retry-After pause")
+	}
+
+	start := time.Now()
+	if err := l.Acquire(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("Acquire waited %v after a 1s pause", waited)
+	}
+}
+
+func TestUpstreamLimiterQueuesInOrder(t *testing.T) {
+	l := newUpstreamLimiter(1, defaultLowRemaining)
+	if err := l.Acquire(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	positions := make(chan int, 4)
+	acquired := make(chan struct{})
+	go func() {
+		if err := l.Acquire(context.Background(), func(p int) { positions <- p }); err != nil {
+			t.Error(err)
+		}
+		close(acquired)
+	}()
+
+	select {
+	case p := <-positions:
+		if p != 1 {
+			t.Fatalf("queue position %d, want 1", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued Acquire never reported its position")
+	}
+	l.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("queued Acquire did not get the released slot")
+	}
+	l.Release()
+}
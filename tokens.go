@@ -0,0 +1,134 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// estimateTokens approximates a token count for mixed Chinese/English text:
+// each CJK character counts as one token, other text as one token per four
+// bytes of non-space characters, rounded up per word.
+func estimateTokens(text string) int {
+	tokens := 0
+	word := 0
+	flush := func() {
+		if word > 0 {
+			tokens += (word + 3) / 4
+			word = 0
+		}
+	}
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		switch {
+		case isCJK(r):
+			flush()
+			tokens++
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			flush()
+			tokens++
+		default:
+			word += size
+		}
+	}
+	flush()
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+func estimateHistoryTokens(history []Message) int {
+	tokens := 0
+	for _, msg := range history {
+		tokens += estimateTokens(msg.Content)
+	}
+	return tokens
+}
+
+// Usage holds estimated token counts for one exchange.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	// ReasoningTokens estimates the deep-thinking text, which OpenAI counts
+	// as part of the completion. CachedTokens is the part of the prompt
+	// taken from the conversation's persisted system prompt.
+	ReasoningTokens int
+	CachedTokens    int
+}
+
+func (u Usage) openAI() map[string]interface{} {
+	completion := u.CompletionTokens + u.ReasoningTokens
+	return map[string]interface{}{
+		"prompt_tokens":     u.PromptTokens,
+		"completion_tokens": completion,
+		"total_tokens":      u.PromptTokens + completion,
+		"prompt_tokens_details": map[string]interface{}{
+			"cached_tokens": u.CachedTokens,
+		},
+		"completion_tokens_details": map[string]interface{}{
+			"reasoning_tokens": u.ReasoningTokens,
+		},
+	}
+}
+
+func (u Usage) responses() map[string]interface{} {
+	output := u.CompletionTokens + u.ReasoningTokens
+	return map[string]interface{}{
+		"input_tokens":  u.PromptTokens,
+		"output_tokens": output,
+		"total_tokens":  u.PromptTokens + output,
+		"input_tokens_details": map[string]interface{}{
+			"cached_tokens": u.CachedTokens,
+		},
+		"output_tokens_details": map[string]interface{}{
+			"reasoning_tokens": u.ReasoningTokens,
+		},
+	}
+}
+
+func (u Usage) claude() map[string]interface{} {
+	return map[string]interface{}{
+		"input_tokens":  u.PromptTokens,
+		"output_tokens": u.CompletionTokens,
+	}
+}
+
+func (u Usage) gemini() map[string]interface{} {
+	return map[string]interface{}{
+		"promptTokenCount":     u.PromptTokens,
+		"candidatesTokenCount": u.CompletionTokens,
+		"totalTokenCount":      u.PromptTokens + u.CompletionTokens,
+	}
+}
+
+// truncateTokens returns the longest prefix of text whose estimate stays
+// within limit, and whether anything was cut.
+func truncateTokens(text string, limit int) (string, bool) {
+	tokens := 0
+	word := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case isCJK(r), unicode.IsPunct(r) || unicode.IsSymbol(r):
+			tokens += (word+3)/4 + 1
+			word = 0
+		case unicode.IsSpace(r):
+			tokens += (word + 3) / 4
+			word = 0
+		default:
+			word += size
+		}
+		if tokens+(word+3)/4 > limit {
+			return text[:i], true
+		}
+		i += size
+	}
+	return text, false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a recording tracer provider and the trace-context
+// propagator for the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return recorder
+}
+
+func TestTracingSpansAndPropagation(t *testing.T) {
+	recorder := recordSpans(t)
+	var upstreamTraceparent string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		answerUpstream("ok")(w, r)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := chatRequest("trace-user", "traced", "hi")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	traceRequests(http.HandlerFunc(s.handleChatCompletions)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s in trace %s, want the incoming %s", span.Name(), got, traceID)
+		}
+	}
+	for _, name := range []string{"POST /v1/chat/completions", "store.GetConversation", "miui.Chat"} {
+		if spans[name] == nil {
+			t.Fatalf("no %q span among %v", name, spans)
+		}
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans["POST /v1/chat/completions"].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["http.request.method"].AsString() != http.MethodPost || attrs["http.response.status_code"].AsInt64() != http.StatusOK {
+		t.Errorf("server span attributes %v", attrs)
+	}
+
+	chat := spans["miui.Chat"].SpanContext()
+	if want := "00-" + traceID + "-" + chat.SpanID().String() + "-01"; upstreamTraceparent != want {
+		t.Errorf("upstream traceparent %q, want %q", upstreamTraceparent, want)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const translatePrompt = "请将以下内容翻译成%s，保留原有格式，只输出译文：\n\n"
+
+// errTranslationCut reports a streamed translation that failed part way;
+// the client already holds the partial translation, so it ends the answer
+// as cut short rather than as an error.
+var errTranslationCut = errors.New("translation cut short")
+
+// isChineseTarget reports whether a TRANSLATE_TO value names Chinese.
+func isChineseTarget(target string) bool {
+	switch strings.ToLower(strings.TrimSpace(target)) {
+	case "zh", "zh-cn", "zh-hans", "chinese", "中文", "简体中文":
+		return true
+	}
+	return false
+}
+
+// mostlyCJK reports whether at least a third of the letters in text are CJK.
+func mostlyCJK(text string) bool {
+	cjk, letters := 0, 0
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			cjk++
+			letters++
+		case unicode.IsLetter(r):
+			letters++
+		}
+	}
+	return letters > 0 && cjk*3 >= letters
+}
+
+// needsTranslation is a coarse language check: the upstream answers in
+// Chinese, so only the Chinese/non-Chinese split is detected.
+func needsTranslation(answer, target string) bool {
+	return mostlyCJK(answer) != isChineseTarget(target)
+}
+
+// translateAnswer returns answer in the TRANSLATE_TO language, translating it
+// through a throwaway upstream conversation when it is in another language.
+// The result, translated or not, is passed to onChunk. On failure the
+// original answer is kept, unless part of the translation was already
+// streamed: that part is returned with errTranslationCut.
+//
+// The translation runs on its own context with the upstream timeout, since
+// ctx may already be cancelled on purpose (a stop sequence, the stream cap
+// or the upstream timeout) while the answer itself is usable.
+func (s *Server) translateAnswer(ctx context.Context, conv *Conversation, answer string, onChunk func(string)) (string, error) {
+	if !needsTranslation(answer, s.translateTo) {
+		if onChunk != nil {
+			onChunk(answer)
+		}
+		return answer, nil
+	}
+	timeout := s.upstreamTimeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	streamed := false
+	emit := func(text string) {
+		streamed = true
+		if onChunk != nil {
+			onChunk(text)
+		}
+	}
+	scratch := &Conversation{
+		UserKey:    conv.UserKey,
+		OAID:       conv.OAID,
+		MiID:       conv.MiID,
+		InternalID: newConversationID(conv.OAID),
+		Device:     conv.device(),
+	}
+	query := fmt.Sprintf(translatePrompt, s.translateTo) + answer
+	translated, err := s.miui.Chat(ctx, scratch, query, ChatOptions{OnChunk: emit})
+	if err == nil && strings.TrimSpace(translated) != "" {
+		return translated, nil
+	}
+	logf(ctx, "translate answer to %s: %v", s.translateTo, err)
+	if streamed && onChunk != nil {
+		return translated, errTranslationCut
+	}
+	if onChunk != nil {
+		onChunk(answer)
+	}
+	return answer, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// translatingUpstream answers questions with answer and translation
+// requests with translated, counting the latter.
+func translatingUpstream(answer, translated string, translations *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload MiuiPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		if strings.HasPrefix(payload.Content, fmt.Sprintf(translatePrompt, "English")) {
+			atomic.AddInt32(translations, 1)
+			if translated == "" {
+				failingUpstream(w, r)
+				return
+			}
+			answerUpstream(translated)(w, r)
+			return
+		}
+		answerUpstream(answer)(w, r)
+	}
+}
+
+func TestTranslateAnswer(t *testing.T) {
+	var translations int32
+	s := newTestServer(t, translatingUpstream("你好，世界", "Hello, world", &translations))
+	s.translateTo = "English"
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("translate-user", "tr", "hi"))
+	if !strings.Contains(rec.Body.String(), "Hello, world") || strings.Contains(rec.Body.String(), "你好") {
+		t.Errorf("buffered answer not translated: %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleChatCompletions(rec, streamChatRequest("translate-user", "tr", "again"))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Hello, world") || strings.Contains(body, "你好") || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("stream did not carry only the translation: %s", body)
+	}
+	if n := atomic.LoadInt32(&translations); n != 2 {
+		t.Errorf("%d translation calls, want 2", n)
+	}
+
+	history, _, err := s.store.History(context.Background(), "translate-user", "tr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 || history[1].Content != "Hello, world" {
+		t.Errorf("history holds %v, want the translated answers", history)
+	}
+}
+
+func TestTranslateSkipsTargetLanguage(t *testing.T) {
+	var translations int32
+	s := newTestServer(t, translatingUpstream("Already English.", "unused", &translations))
+	s.translateTo = "English"
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("translate-user", "en", "hi"))
+	if !strings.Contains(rec.Body.String(), "Already English.") || translations != 0 {
+		t.Errorf("%d translation calls for an English answer: %s", translations, rec.Body)
+	}
+}
+
+func TestTranslateFailureKeepsAnswer(t *testing.T) {
+	var translations int32
+	s := newTestServer(t, translatingUpstream("你好，世界", "", &translations))
+	s.translateTo = "English"
+
+	rec := httptest.NewRecorder()
+	s.handleChatCompletions(rec, chatRequest("translate-user", "fail", "hi"))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "你好，世界") || translations != 1 {
+		t.Errorf("failed translation: %d after %d calls: %s", rec.Code, translations, rec.Body)
+	}
+}
+
+func TestNeedsTranslation(t *testing.T) {
+	for _, tc := range []struct {
+		answer, target string
+		want           bool
+	}{
+		{"你好，世界", "English", true},
+		{"Hello", "English", false},
+		{"你好，世界", "zh-CN", false},
+		{"Hello", "中文", true},
+		{"Go 语言的并发模型", "English", true},
+		{"12345", "English", false},
+	} {
+		if got := needsTranslation(tc.answer, tc.target); got != tc.want {
+			t.Errorf("needsTranslation(%q, %q) = %v, want %v", tc.answer, tc.target, got, tc.want)
+		}
+	}
+}
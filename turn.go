@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+)
+
+// chatTurn is one user turn on its way upstream. Every chat-style API maps
+// its request body onto a system prompt, the user's text and options; from
+// there the conversation lookup, admission, query building and upstream call
+// are shared, and each API only renders the answer in its own shape.
+type chatTurn struct {
+	conv  *Conversation
+	opts  RequestOptions
+	query string
+	// done releases the conversation claim and stream slot taken by
+	// beginTurn.
+	done func()
+}
+
+// turnResult is the answer to a turn. A failed upstream call that was
+// replaced by the configured fallback answer has fallback set and a nil err;
+// otherwise err is nil or one that truncated reports.
+type turnResult struct {
+	full     string
+	usage    Usage
+	err      error
+	fallback bool
+}
+
+// beginTurn loads the request's conversation, admits the request on it and
+// builds the upstream query, checking it against the context limit. On
+// failure the error is answered in the protocol of r's path and false is
+// returned; otherwise the caller must call turn.done once it has finished.
+func (s *Server) beginTurn(w http.ResponseWriter, r *http.Request, systemParts []string, userText string, opts RequestOptions) (*chatTurn, bool) {
+	systemPrompt, err := s.assembleSystemPrompt(systemParts)
+	if err != nil {
+		writeChatError(w, r, err)
+		return nil, false
+	}
+
+	conv, err := s.store.GetConversation(r.Context(), extractUserKey(r), r.Header.Get("ConversationId"))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return nil, false
+	}
+	s.writeDebugHeaders(w, conv)
+	done, ok := s.admitRequest(w, r, conv, &opts)
+	if !ok {
+		return nil, false
+	}
+
+	if s.persistSystemPrompt {
+		systemPrompt = conv.resolveSystemPrompt(systemPrompt)
+	}
+	opts.UserText = userText
+	query := s.buildQuery(conv, opts, systemPrompt, userText)
+	if err := s.checkContextLength(r.Context(), conv, query); err != nil {
+		done()
+		writeChatError(w, r, err)
+		return nil, false
+	}
+	return &chatTurn{conv: conv, opts: opts, query: query, done: done}, true
+}
+
+// startStream sets the streaming headers and opens the stream writer. When
+// nothing behind w can flush it answers stream_unsupported in the protocol
+// of r's path and returns false.
+func (s *Server) startStream(w http.ResponseWriter, r *http.Request) (*sseWriter, bool) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	sw, ok := s.newStreamWriter(w, r)
+	if !ok {
+		writeProtocolError(w, r.URL.Path, http.StatusInternalServerError, "stream_unsupported", "invalid_request_error", nil)
+		return nil, false
+	}
+	return sw, true
+}
+
+// streamTurn runs the turn upstream, sending the answer to onChunk as it
+// arrives. If the upstream fails before any text was sent, the fallback
+// answer is streamed in its place when one is configured. Otherwise, unless
+// the client has gone, onError terminates the stream explicitly with the
+// classified failure so the client does not hang on a half-open response,
+// and false is returned.
+func (s *Server) streamTurn(r *http.Request, sw *sseWriter, turn *chatTurn, onChunk func(string), onError func(turnResult, chatFailure)) (turnResult, bool) {
+	ctx, cancel := s.streamContext(r)
+	defer cancel()
+
+	turn.opts.OnQueued = s.queuePositionReporter(sw)
+	paced, drain := s.paceChunks(r.Context(), onChunk)
+	full, usage, err := s.performChat(ctx, turn.conv, turn.query, turn.opts, paced)
+	drain()
+	res := turnResult{full: full, usage: usage, err: err}
+	if err == nil || truncated(err) {
+		return res, true
+	}
+	text, ok := s.fallbackFor(r, err)
+	if !ok || full != "" {
+		if r.Context().Err() == nil {
+			onError(res, streamFailure(err))
+		}
+		return res, false
+	}
+	onChunk(text)
+	usage.CompletionTokens = estimateTokens(text)
+	return turnResult{full: text, usage: usage, fallback: true}, true
+}
+
+// bufferTurn runs the turn upstream without streaming. If the upstream
+// fails the fallback answer replaces it when one is configured and
+// X-Fallback is set; otherwise the error is answered in the protocol of r's
+// path and false is returned.
+func (s *Server) bufferTurn(w http.ResponseWriter, r *http.Request, turn *chatTurn) (turnResult, bool) {
+	ctx, cancel := s.upstreamContext(r)
+	defer cancel()
+	full, usage, err := s.performChat(ctx, turn.conv, turn.query, turn.opts, nil)
+	if err == nil || truncated(err) {
+		return turnResult{full: full, usage: usage, err: err}, true
+	}
+	text, ok := s.fallbackFor(r, err)
+	if !ok {
+		writeChatError(w, r, err)
+		return turnResult{}, false
+	}
+	w.Header().Set("X-Fallback", "true")
+	usage.CompletionTokens = estimateTokens(text)
+	return turnResult{full: text, usage: usage, fallback: true}, true
+}
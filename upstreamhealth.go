@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamHealth tracks the outcome of real upstream calls, so /health can
+// report upstream status from traffic instead of synthetic probes.
+type upstreamHealth struct {
+	// lastSuccess and lastFailure are Unix nanoseconds; zero means never.
+	lastSuccess         atomic.Int64
+	lastFailure         atomic.Int64
+	consecutiveFailures atomic.Int64
+}
+
+// record notes the outcome of one Chat call. An answer cut at a length limit
+// counts as a success.
+func (h *upstreamHealth) record(err error) {
+	now := time.Now().UnixNano()
+	if err == nil || errors.Is(err, errAnswerLimit) {
+		h.lastSuccess.Store(now)
+		h.consecutiveFailures.Store(0)
+		return
+	}
+	h.lastFailure.Store(now)
+	h.consecutiveFailures.Add(1)
+}
+
+func (h *upstreamHealth) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"last_success":         healthTime(h.lastSuccess.Load()),
+		"last_failure":         healthTime(h.lastFailure.Load()),
+		"consecutive_failures": h.consecutiveFailures.Load(),
+	}
+}
+
+func healthTime(nanos int64) interface{} {
+	if nanos == 0 {
+		return nil
+	}
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthReportsUpstreamOutcomes(t *testing.T) {
+	var failing atomic.Bool
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			failingUpstream(w, r)
+			return
+		}
+		answerUpstream("ok")(w, r)
+	})
+	conv, err := s.store.GetConversation(context.Background(), "health-user", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := func() (lastSuccess, lastFailure interface{}, failures float64) {
+		rec := httptest.NewRecorder()
+		s.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var body struct {
+			Upstream map[string]interface{} `json:"upstream"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Upstream["last_success"], body.Upstream["last_failure"], body.Upstream["consecutive_failures"].(float64)
+	}
+	call := func(fail bool) {
+		failing.Store(fail)
+		_, err := s.miui.Chat(context.Background(), conv, "hi", ChatOptions{})
+		if (err != nil) != fail {
+			t.Fatalf("Chat with failing=%v returned %v", fail, err)
+		}
+	}
+	// recent reports whether an RFC 3339 health timestamp is from this test.
+	start := time.Now().Add(-time.Second)
+	recent := func(value interface{}) bool {
+		text, _ := value.(string)
+		at, err := time.Parse(time.RFC3339, text)
+		return err == nil && !at.Before(start.Truncate(time.Second)) && !at.After(time.Now())
+	}
+
+	if success, failure, failures := health(); success != nil || failure != nil || failures != 0 {
+		t.Fatalf("before any call: %v %v %v", success, failure, failures)
+	}
+
+	call(false)
+	if success, failure, failures := health(); !recent(success) || failure != nil || failures != 0 {
+		t.Errorf("after a success: %v %v %v", success, failure, failures)
+	}
+
+	call(true)
+	call(true)
+	success, failure, failures := health()
+	if !recent(success) || !recent(failure) || failures != 2 {
+		t.Errorf("after two failures: %v %v %v", success, failure, failures)
+	}
+
+	call(false)
+	if success, failure, failures := health(); !recent(success) || !recent(failure) || failures != 0 {
+		t.Errorf("after recovering: %v %v %v", success, failure, failures)
+	}
+}
+
+func TestUpstreamHealthRecord(t *testing.T) {
+	var h upstreamHealth
+	h.record(errAnswerLimit)
+	if h.lastSuccess.Load() == 0 || h.consecutiveFailures.Load() != 0 {
+		t.Error("an answer cut at the length limit did not count as a success")
+	}
+	h.record(errStreamInterrupted)
+	h.record(errStreamInterrupted)
+	if h.lastFailure.Load() < h.lastSuccess.Load() || h.consecutiveFailures.Load() != 2 {
+		t.Errorf("after two failures: success %d failure %d count %d",
+			h.lastSuccess.Load(), h.lastFailure.Load(), h.consecutiveFailures.Load())
+	}
+}